@@ -0,0 +1,274 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// DefaultBucket is the KV bucket of the members.
+	DefaultBucket = "calef_members"
+	// DefaultTTL is how long a member stays without heartbeats.
+	DefaultTTL = 10 * time.Second
+)
+
+// Membership keeps the list of live nodes in a NATS KV bucket and shards keys
+// across them with a consistent hash ring. Every node puts its key with a
+// heartbeat, keys expire with the bucket TTL when a node dies. Listeners are
+// notified when the members change, so work can be rebalanced. They run apart
+// from the heartbeats, so a long rebalance doesn't expire the node.
+type Membership struct {
+	ctx      context.Context
+	nc       *nats.Conn
+	log      *slog.Logger
+	node     string
+	bucket   string
+	ttl      time.Duration
+	replicas int
+
+	kv   jetstream.KeyValue
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+
+	mu        sync.RWMutex
+	members   []string
+	ring      *Ring
+	listeners []func()
+	// changed coalesces the changes not yet passed to the listeners.
+	changed chan struct{}
+}
+
+func NewMembership(ctx context.Context, nc *nats.Conn, node string) *Membership {
+	return &Membership{
+		ctx:      ctx,
+		nc:       nc,
+		log:      slog.With("service", "Membership", "node", node),
+		node:     node,
+		bucket:   DefaultBucket,
+		ttl:      DefaultTTL,
+		replicas: DefaultReplicas,
+		// The node owns everything until it sees the others.
+		members: []string{node},
+		changed: make(chan struct{}, 1),
+	}
+}
+
+func (m *Membership) SetBucket(bucket string) *Membership { m.bucket = bucket; return m }
+
+// SetTTL sets how long a node stays a member without heartbeats.
+func (m *Membership) SetTTL(ttl time.Duration) *Membership {
+	if ttl > 0 {
+		m.ttl = ttl
+	}
+
+	return m
+}
+
+// SetReplicas sets the number of ring points per node.
+func (m *Membership) SetReplicas(n int) *Membership {
+	if n > 0 {
+		m.replicas = n
+	}
+
+	return m
+}
+
+// OnChange registers a listener called after the members change. Changes
+// while the listeners run are passed to them once when they are done.
+func (m *Membership) OnChange(fn func()) *Membership {
+	m.mu.Lock()
+	m.listeners = append(m.listeners, fn)
+	m.mu.Unlock()
+
+	return m
+}
+
+// Node returns the name of this node.
+func (m *Membership) Node() string { return m.node }
+
+// Members returns the sorted names of the live nodes.
+func (m *Membership) Members() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return slices.Clone(m.members)
+}
+
+// Owns reports whether the key is sharded to this node.
+func (m *Membership) Owns(key string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.ring == nil {
+		return true
+	}
+
+	return m.ring.Owner(key) == m.node
+}
+
+// Spawn joins the cluster and keeps the members up to date until Stop.
+func (m *Membership) Spawn() error {
+	js, err := jetstream.New(m.nc)
+	if err != nil {
+		return fmt.Errorf("failed to create jetstream context: %w", err)
+	}
+
+	m.kv, err = js.CreateOrUpdateKeyValue(m.ctx, jetstream.KeyValueConfig{
+		Bucket:  m.bucket,
+		TTL:     m.ttl,
+		Storage: jetstream.MemoryStorage,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %s: %w", m.bucket, err)
+	}
+
+	if err := m.heartbeat(); err != nil {
+		return err
+	}
+
+	ctx, stop := context.WithCancel(m.ctx)
+	m.stop = stop
+
+	watcher, err := m.kv.WatchAll(ctx, jetstream.MetaOnly())
+	if err != nil {
+		stop()
+		return fmt.Errorf("failed to watch bucket %s: %w", m.bucket, err)
+	}
+
+	if err := m.refresh(); err != nil {
+		stop()
+		return err
+	}
+
+	m.wg.Add(2)
+	go func() {
+		defer m.wg.Done()
+		defer watcher.Stop()
+		m.run(ctx, watcher)
+	}()
+	go func() {
+		defer m.wg.Done()
+		m.notify(ctx)
+	}()
+
+	return nil
+}
+
+// Stop leaves the cluster, so the others take over the keys of the node.
+func (m *Membership) Stop() error {
+	if m.stop == nil {
+		return nil
+	}
+
+	m.stop()
+	m.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.ttl)
+	defer cancel()
+
+	if err := m.kv.Delete(ctx, m.node); err != nil {
+		return fmt.Errorf("failed to leave cluster: %w", err)
+	}
+
+	return nil
+}
+
+// run beats and refreshes the members on every change of the bucket. Expired
+// keys aren't watched, so the members are refreshed with every beat too.
+func (m *Membership) run(ctx context.Context, watcher jetstream.KeyWatcher) {
+	ticker := time.NewTicker(m.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.heartbeat(); err != nil {
+				m.log.Error("failed to send heartbeat", "err", err)
+			}
+		case _, ok := <-watcher.Updates():
+			if !ok {
+				return
+			}
+		}
+
+		if err := m.refresh(); err != nil {
+			m.log.Error("failed to refresh members", "err", err)
+		}
+	}
+}
+
+func (m *Membership) heartbeat() error {
+	if _, err := m.kv.Put(m.ctx, m.node, []byte(time.Now().UTC().Format(time.RFC3339))); err != nil {
+		return fmt.Errorf("failed to put member %s: %w", m.node, err)
+	}
+
+	return nil
+}
+
+// refresh reads the members and rebuilds the ring when they changed.
+func (m *Membership) refresh() error {
+	members, err := m.kv.Keys(m.ctx)
+	if err != nil && !errors.Is(err, jetstream.ErrNoKeysFound) {
+		return fmt.Errorf("failed to list members: %w", err)
+	}
+
+	// The node is a member while it runs, even if its key just expired.
+	if !slices.Contains(members, m.node) {
+		members = append(members, m.node)
+	}
+
+	slices.Sort(members)
+
+	m.mu.Lock()
+	if m.ring != nil && slices.Equal(members, m.members) {
+		m.mu.Unlock()
+		return nil
+	}
+
+	if m.ring == nil {
+		m.ring = NewRing(m.replicas)
+	}
+
+	m.members = members
+	m.ring.Set(members)
+	m.mu.Unlock()
+
+	m.log.Info("cluster members changed", "members", members)
+
+	select {
+	case m.changed <- struct{}{}:
+	default:
+		// The listeners are notified of the pending change already.
+	}
+
+	return nil
+}
+
+// notify calls the listeners after the members change until ctx is done.
+func (m *Membership) notify(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.changed:
+		}
+
+		m.mu.RLock()
+		listeners := slices.Clone(m.listeners)
+		m.mu.RUnlock()
+
+		for _, fn := range listeners {
+			fn()
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"strconv"
+)
+
+// DefaultReplicas is the number of points of a node on the ring.
+const DefaultReplicas = 128
+
+// Ring assigns keys to nodes by consistent hashing, so a joining or leaving
+// node only moves the keys of its own ring points. It isn't safe for
+// concurrent use.
+type Ring struct {
+	replicas int
+	points   []uint32
+	owners   map[uint32]string
+}
+
+func NewRing(replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+
+	return &Ring{replicas: replicas, owners: make(map[uint32]string)}
+}
+
+// Set replaces the nodes of the ring.
+func (r *Ring) Set(nodes []string) {
+	r.points = r.points[:0]
+	clear(r.owners)
+
+	for _, node := range nodes {
+		for i := range r.replicas {
+			p := hash(node + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[p]; taken {
+				continue
+			}
+
+			r.owners[p] = node
+			r.points = append(r.points, p)
+		}
+	}
+
+	slices.Sort(r.points)
+}
+
+// Owner returns the node owning the key, empty when the ring has no nodes.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	i, _ := slices.BinarySearch(r.points, hash(key))
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.owners[r.points[i]]
+}
+
+// hash spreads similar keys, e.g. symbols of an exchange, evenly.
+func hash(s string) uint32 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -4,11 +4,17 @@ import (
 	"context"
 	"log"
 	"log/slog"
+	"maps"
+	"os"
 	"os/signal"
+	"slices"
 	"syscall"
+	"time"
 
+	"github.com/11me/calef/cluster"
+	"github.com/11me/calef/common"
 	"github.com/11me/calef/config"
-	"github.com/11me/calef/consumers/aggregators"
+	"github.com/11me/calef/consumers"
 	"github.com/11me/calef/consumers/exchange"
 	"github.com/11me/calef/models"
 	"github.com/11me/calef/server"
@@ -40,30 +46,213 @@ func main() {
 		log.Fatal(err)
 	}
 
-	controlSvc := services.NewControlService(ctx, nc)
+	exchangeConsumers := make([]*exchange.Consumer, 0, len(conf.Exchange.Names))
+	for _, name := range conf.Exchange.Names {
+		adapter, err := exchange.NewAdapter(name, &conf.Exchange)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		exchangeConsumer := exchange.NewConsumer(ctx, nc, adapter).
+			SetStreamsPerConn(conf.Exchange.StreamsPerConn).
+			SetKeepalive(exchange.Keepalive{
+				PingInterval: conf.Exchange.PingInterval,
+				ReadTimeout:  conf.Exchange.ReadTimeout,
+				StaleTimeout: conf.Exchange.StaleTimeout,
+				RotateBefore: conf.Exchange.RotateBefore,
+			}).
+			SetBackfill(conf.Exchange.Backfill).
+			SetDepthLevels(conf.Exchange.DepthLevels).
+			SetOpenInterestInterval(conf.Exchange.OpenInterestInterval)
+		exchangeConsumers = append(exchangeConsumers, exchangeConsumer)
+	}
+
+	barSource := models.BarSource(conf.Exchange.BarSource)
+	if !barSource.Valid() {
+		log.Fatalf("unknown bar source %q", barSource)
+	}
+
+	var baseTimeframe models.Timeframe
+	if conf.Exchange.BaseTimeframe != "" {
+		baseTimeframe, err = models.ParseTimeframe(conf.Exchange.BaseTimeframe)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	streamSvc := services.NewStreamService(ctx, nc, exchangeConsumers...).
+		SetBarSource(barSource).
+		SetBarGrace(conf.Exchange.BarGrace).
+		SetBarLateWindow(conf.Exchange.BarLateWindow).
+		SetBaseTimeframe(baseTimeframe)
+
+	var historySvc *services.HistoryService
+	if conf.Exchange.HistoryBars > 0 {
+		historySvc = services.NewHistoryService(ctx, nc, conf.Exchange.HistoryBars, exchangeConsumers...)
+		if err := historySvc.Spawn(); err != nil {
+			log.Fatal(err)
+		}
+
+		streamSvc.SetHistory(historySvc)
+	}
+
+	var (
+		recorderSvc   *services.RecorderService
+		barsRetention map[models.Timeframe]time.Duration
+	)
+	if conf.Nats.JetStream {
+		barsRetention = make(map[models.Timeframe]time.Duration, len(conf.Nats.BarsRetention))
+		for s, retention := range conf.Nats.BarsRetention {
+			tf, err := models.ParseTimeframe(s)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			barsRetention[tf] = retention
+		}
 
-	binanceConsumer := exchange.NewBinanceConsumer(ctx, nc)
-	binanceConsumer.SubscribeTicks(symbols...)
+		recorderSvc, err = services.NewRecorderService(ctx, nc)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		recorderSvc.
+			SetTicksRetention(conf.Nats.TicksRetention).
+			SetBarsRetention(barsRetention).
+			SetDuplicateWindow(conf.Nats.DuplicateWindow)
+
+		// Persistence is optional, e.g. when the server runs without JetStream.
+		if err := recorderSvc.Spawn(); err != nil {
+			slog.Error("failed to persist to jetstream", "err", err)
+			recorderSvc = nil
+		}
+	}
+
+	controlSvc := services.NewControlService(ctx, nc, streamSvc)
+
+	if recorderSvc != nil && conf.Nats.DurablePortfolios {
+		controlSvc.SetDurable(&consumers.Durable{
+			Name:           "portfolio",
+			AckWait:        conf.Nats.AckWait,
+			MaxDeliver:     conf.Nats.MaxDeliver,
+			Backoff:        conf.Nats.Backoff,
+			DeadLetterSubj: conf.Nats.DeadLetterSubj,
+		}, slices.Collect(maps.Keys(barsRetention))...)
+	}
+
+	// Every instance claims the same streams and portfolios, the members
+	// shard which of them it runs.
+	var membership *cluster.Membership
+	if conf.Cluster.Enabled {
+		node := conf.Cluster.Node
+		if node == "" {
+			if node, err = os.Hostname(); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		membership = cluster.NewMembership(ctx, nc, node).
+			SetBucket(conf.Cluster.Bucket).
+			SetTTL(conf.Cluster.TTL).
+			SetReplicas(conf.Cluster.Replicas).
+			OnChange(streamSvc.Rebalance).
+			OnChange(controlSvc.Rebalance)
+
+		streamSvc.SetShard(membership)
+		controlSvc.SetShard(membership)
+
+		if err := membership.Spawn(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := controlSvc.Spawn(); err != nil {
+		log.Fatal(err)
+	}
 
 	srv := server.NewServer(conf.Addr)
 	srv.HandleFunc("POST /api/portfolios", handlers.HandleSubmitPortfolio(controlSvc))
 	srv.HandleFunc("DELETE /api/portfolios/{id}", handlers.HandleStopPortfolio(controlSvc))
+	srv.HandleFunc("GET /api/streams/health", handlers.HandleStreamsHealth(streamSvc))
+
+	// Default streams, portfolios acquire the rest on demand.
+	for _, name := range conf.Exchange.Names {
+		for _, tf := range timeframes {
+			for _, symbol := range symbols {
+				inst := models.Instrument{Exchange: name, Symbol: symbol}
+				if err := streamSvc.Acquire(inst, tf, models.PriceTrade); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
+
+	for _, symbol := range conf.Exchange.DepthSymbols {
+		if err := streamSvc.AcquireDepth(common.ParseInstrument(symbol)); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	aggs := make([]*aggregators.BarAggregator, 0, len(symbols)*len(timeframes))
-	for _, tf := range timeframes {
-		for _, symbol := range symbols {
-			agg := aggregators.NewBarAggregator(ctx, nc, symbol, tf)
-			aggs = append(aggs, agg)
-			agg.Spawn()
+	for _, bars := range conf.Exchange.InfoBars {
+		inst, spec, err := common.ParseInfoBars(bars)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := streamSvc.AcquireInfoBars(inst, spec); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, series := range conf.Exchange.HeikinAshi {
+		inst, tf, err := common.ParseSeries(series)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := streamSvc.AcquireHeikinAshi(inst, tf); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	go binanceConsumer.Start()
+	for _, exchangeConsumer := range exchangeConsumers {
+		if err := exchangeConsumer.Start(); err != nil {
+			log.Fatal(err)
+		}
+	}
 	go srv.Start()
 
 	<-ctx.Done()
 
-	for i := range aggs {
-		aggs[i].Stop()
+	for _, exchangeConsumer := range exchangeConsumers {
+		if err := exchangeConsumer.Stop(); err != nil {
+			slog.Error("exchange consumer stopped with error", "exchange", exchangeConsumer.Name(), "err", err)
+		}
+	}
+
+	if membership != nil {
+		if err := membership.Stop(); err != nil {
+			slog.Error("failed to leave cluster", "err", err)
+		}
+	}
+
+	if err := controlSvc.Stop(); err != nil {
+		slog.Error("failed to stop portfolios", "err", err)
+	}
+
+	if err := streamSvc.StopAll(); err != nil {
+		slog.Error("failed to stop streams", "err", err)
+	}
+
+	if historySvc != nil {
+		if err := historySvc.Stop(); err != nil {
+			slog.Error("failed to stop history", "err", err)
+		}
+	}
+
+	if recorderSvc != nil {
+		if err := recorderSvc.Stop(); err != nil {
+			slog.Error("failed to stop recorder", "err", err)
+		}
 	}
 }
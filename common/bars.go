@@ -0,0 +1,17 @@
+package common
+
+import (
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+)
+
+// NewClosedBarMsg returns the encoded closed bar on its closed bars subject.
+// It carries the Nats-Msg-Id of the bar, so JetStream stores every revision
+// once.
+func NewClosedBarMsg(bar *models.Bar, tf models.Timeframe, data []byte) *nats.Msg {
+	msg := nats.NewMsg(ClosedBarsSubj(bar.Exchange, bar.Symbol, tf))
+	msg.Data = data
+	msg.Header.Set(nats.MsgIdHdr, BarMsgID(bar, tf))
+
+	return msg
+}
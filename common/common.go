@@ -2,17 +2,188 @@ package common
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/11me/calef/models"
 )
 
-func BinanceTicksSubj(symbol string) string {
+// Subject prefixes of the binance markets.
+const (
+	BinanceSpot        = "binance"
+	BinanceFutures     = "binancef"
+	BinanceCoinFutures = "binanced"
+)
+
+func TicksSubj(exchange, symbol string) string {
 	symbol = strings.ToLower(strings.TrimSpace(symbol))
-	return fmt.Sprintf("binancef.ticks.%s", symbol)
+	return fmt.Sprintf("%s.ticks.%s", exchange, symbol)
 }
 
-func BinanceBarsSubj(symbol string, tf models.Timeframe) string {
+func BarsSubj(exchange, symbol string, tf models.Timeframe) string {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	return fmt.Sprintf("%s.bars.%s.%s", exchange, tf.String(), symbol)
+}
+
+// InfoBarsSubj is the subject of information-driven bars of a symbol, e.g.
+// "binancef.tickbars.1000.btcusdt". Dots of fractional thresholds are
+// replaced by underscores.
+func InfoBarsSubj(exchange, symbol string, spec models.BarSpec) string {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	threshold := strings.ReplaceAll(strconv.FormatFloat(spec.Threshold, 'f', -1, 64), ".", "_")
+
+	return fmt.Sprintf("%s.%sbars.%s.%s", exchange, spec.Type, threshold, symbol)
+}
+
+// HeikinAshiSubj is the subject of Heikin-Ashi candles of a symbol.
+func HeikinAshiSubj(exchange, symbol string, tf models.Timeframe) string {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	return fmt.Sprintf("%s.heikinashi.%s.%s", exchange, tf.String(), symbol)
+}
+
+// ClosedBarsSubj is the subject time bars are published on once closed, and
+// again for every revision. It is persisted to JetStream.
+func ClosedBarsSubj(exchange, symbol string, tf models.Timeframe) string {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	return fmt.Sprintf("%s.closedbars.%s.%s", exchange, tf.String(), symbol)
+}
+
+// BarMsgID is the Nats-Msg-Id of a closed bar, revisions have their own.
+func BarMsgID(bar *models.Bar, tf models.Timeframe) string {
+	symbol := strings.ToLower(strings.TrimSpace(bar.Symbol))
+	return fmt.Sprintf("%s.%s.%s.%d.%d", bar.Exchange, symbol, tf.String(), bar.StartTime.Unix(), bar.Revision)
+}
+
+// DepthSubj is the subject of the maintained order book of a symbol.
+func DepthSubj(exchange, symbol string) string {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	return fmt.Sprintf("%s.depth.%s", exchange, symbol)
+}
+
+// HistorySubj is the request subject of the latest closed bars of a symbol.
+func HistorySubj(exchange, symbol string, tf models.Timeframe) string {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	return fmt.Sprintf("%s.history.%s.%s", exchange, tf.String(), symbol)
+}
+
+// KlinesSubj is the subject of exchange built bars of a symbol.
+func KlinesSubj(exchange, symbol string, tf models.Timeframe) string {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	return fmt.Sprintf("%s.klines.%s.%s", exchange, tf.String(), symbol)
+}
+
+// QuotesSubj is the subject of best bid/ask updates of a symbol.
+func QuotesSubj(exchange, symbol string) string {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	return fmt.Sprintf("%s.quotes.%s", exchange, symbol)
+}
+
+// QuoteBarsSubj is the subject of mid price and spread bars of a symbol.
+func QuoteBarsSubj(exchange, symbol string, tf models.Timeframe) string {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	return fmt.Sprintf("%s.quotebars.%s.%s", exchange, tf.String(), symbol)
+}
+
+// MarkPriceSubj is the subject of mark price and funding updates of a symbol.
+func MarkPriceSubj(exchange, symbol string) string {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	return fmt.Sprintf("%s.markprice.%s", exchange, symbol)
+}
+
+// LiquidationsSubj is the subject of liquidation orders of a symbol.
+func LiquidationsSubj(exchange, symbol string) string {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	return fmt.Sprintf("%s.liquidations.%s", exchange, symbol)
+}
+
+// OpenInterestSubj is the subject of open interest of a symbol.
+func OpenInterestSubj(exchange, symbol string) string {
 	symbol = strings.ToLower(strings.TrimSpace(symbol))
-	return fmt.Sprintf("binancef.bars.%s.%s", tf.String(), symbol)
+	return fmt.Sprintf("%s.openinterest.%s", exchange, symbol)
+}
+
+// ConnEventsSubj is the subject of connection state changes of an exchange.
+func ConnEventsSubj(exchange string) string {
+	return fmt.Sprintf("%s.events.conn", exchange)
+}
+
+// GapEventsSubj is the subject of trade gaps detected on an exchange.
+func GapEventsSubj(exchange string) string {
+	return fmt.Sprintf("%s.events.gaps", exchange)
+}
+
+// BarEventsSubj is the subject of discrepancies between bars and exchange klines.
+func BarEventsSubj(exchange string) string {
+	return fmt.Sprintf("%s.events.bars", exchange)
+}
+
+func BinanceTicksSubj(symbol string) string {
+	return TicksSubj(BinanceFutures, symbol)
+}
+
+func BinanceBarsSubj(symbol string, tf models.Timeframe) string {
+	return BarsSubj(BinanceFutures, symbol, tf)
+}
+
+// ParseInstrument parses "<exchange>:<symbol>", a plain symbol refers to the
+// binance USD-M futures exchange.
+func ParseInstrument(s string) models.Instrument {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	exchange, symbol, ok := strings.Cut(s, ":")
+	if !ok {
+		return models.Instrument{Exchange: BinanceFutures, Symbol: s}
+	}
+
+	return models.Instrument{Exchange: exchange, Symbol: symbol}
+}
+
+// ParseInfoBars parses "<exchange>:<symbol>:<type>:<threshold>", the exchange
+// may be omitted as in ParseInstrument.
+func ParseInfoBars(s string) (models.Instrument, models.BarSpec, error) {
+	s = strings.TrimSpace(s)
+
+	i := strings.LastIndex(s, ":")
+	if i > 0 {
+		i = strings.LastIndex(s[:i], ":")
+	}
+
+	if i <= 0 {
+		return models.Instrument{}, models.BarSpec{}, fmt.Errorf("invalid info bars %q", s)
+	}
+
+	spec, err := models.ParseBarSpec(s[i+1:])
+	if err != nil {
+		return models.Instrument{}, models.BarSpec{}, err
+	}
+
+	return ParseInstrument(s[:i]), spec, nil
+}
+
+// ParseSeries parses "<exchange>:<symbol>:<timeframe>", the exchange may be
+// omitted as in ParseInstrument.
+func ParseSeries(s string) (models.Instrument, models.Timeframe, error) {
+	s = strings.TrimSpace(s)
+
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return models.Instrument{}, 0, fmt.Errorf("invalid series %q", s)
+	}
+
+	tf, err := models.ParseTimeframe(s[i+1:])
+	if err != nil {
+		return models.Instrument{}, 0, err
+	}
+
+	return ParseInstrument(s[:i]), tf, nil
+}
+
+// FormulaVar returns the variable name of the instrument in portfolio formulas:
+// the plain symbol for the default exchange, "<exchange>_<symbol>" otherwise.
+func FormulaVar(inst models.Instrument) string {
+	if inst.Exchange == BinanceFutures {
+		return inst.Symbol
+	}
+
+	return inst.Exchange + "_" + inst.Symbol
 }
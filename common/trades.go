@@ -0,0 +1,50 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+)
+
+// SchemaVersionHeader carries the wire format version of the message payload.
+const SchemaVersionHeader = "Calef-Schema-Version"
+
+var ErrUnsupportedSchema = errors.New("unsupported schema version")
+
+// NewTradeMsg encodes the trade into a message with the schema version header.
+// Trades with an id carry a Nats-Msg-Id, so JetStream drops duplicates, e.g.
+// of backfills after a reconnect.
+func NewTradeMsg(subj string, trade *models.Trade) (*nats.Msg, error) {
+	data, err := json.Marshal(trade)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := nats.NewMsg(subj)
+	msg.Data = data
+	msg.Header.Set(SchemaVersionHeader, models.TradeSchemaVersion)
+	if trade.TradeID != "" {
+		msg.Header.Set(nats.MsgIdHdr, fmt.Sprintf("%s.%s.%s", trade.Exchange, strings.ToLower(trade.Symbol), trade.TradeID))
+	}
+
+	return msg, nil
+}
+
+// DecodeTrade decodes a trade message, rejecting schema versions it doesn't understand.
+func DecodeTrade(msg *nats.Msg) (models.Trade, error) {
+	var trade models.Trade
+
+	if v := msg.Header.Get(SchemaVersionHeader); v != models.TradeSchemaVersion {
+		return trade, fmt.Errorf("%w: %q", ErrUnsupportedSchema, v)
+	}
+
+	if err := json.Unmarshal(msg.Data, &trade); err != nil {
+		return trade, err
+	}
+
+	return trade, nil
+}
@@ -2,24 +2,118 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/caarlos0/env/v10"
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	Nats   `envPrefix:"NATS_"`
-	Server `envPrefix:"SERVER_"`
+	Nats     `envPrefix:"NATS_"`
+	Server   `envPrefix:"SERVER_"`
+	Exchange `envPrefix:"EXCHANGE_"`
+	Cluster  `envPrefix:"CLUSTER_"`
 }
 
 type Nats struct {
 	URL string `env:"URL,notEmpty"`
+
+	// JetStream persists ticks and closed bars to JetStream streams.
+	JetStream bool `env:"JETSTREAM" envDefault:"true"`
+	// TicksRetention is how long ticks are kept, zero keeps them forever.
+	TicksRetention time.Duration `env:"TICKS_RETENTION" envDefault:"24h"`
+	// BarsRetention is how long closed bars are kept per timeframe, e.g.
+	// "1m=720h,1d=0". Zero keeps them forever, other timeframes aren't kept.
+	BarsRetention map[string]time.Duration `env:"BARS_RETENTION" envKeyValSeparator:"=" envDefault:"1m=720h,5m=2160h,1h=8760h,1d=0"`
+	// DuplicateWindow is how long message ids are tracked to drop duplicates.
+	DuplicateWindow time.Duration `env:"DUPLICATE_WINDOW" envDefault:"10m"`
+
+	// DurablePortfolios consumes the closed bars of portfolios on kept
+	// timeframes from durable consumers.
+	DurablePortfolios bool `env:"DURABLE_PORTFOLIOS"`
+	// AckWait is how long a durable delivery waits for its ack.
+	AckWait time.Duration `env:"ACK_WAIT" envDefault:"30s"`
+	// MaxDeliver limits the deliveries of a message, negative is unlimited.
+	MaxDeliver int `env:"MAX_DELIVER" envDefault:"5"`
+	// Backoff delays the redeliveries of failed messages by their delivery.
+	Backoff []time.Duration `env:"BACKOFF" envDefault:"1s,5s,30s"`
+	// DeadLetterSubj receives messages whose last delivery failed.
+	DeadLetterSubj string `env:"DEAD_LETTER_SUBJ" envDefault:"calef.deadletters"`
+}
+
+type Cluster struct {
+	// Enabled shards instruments and portfolios across the instances in the
+	// members bucket.
+	Enabled bool `env:"ENABLED"`
+	// Node names the instance in the cluster, the hostname by default.
+	Node string `env:"NODE"`
+	// Bucket is the KV bucket of the members.
+	Bucket string `env:"BUCKET" envDefault:"calef_members"`
+	// TTL is how long a member stays without heartbeats.
+	TTL time.Duration `env:"TTL" envDefault:"10s"`
+	// Replicas is the number of hash ring points per member.
+	Replicas int `env:"REPLICAS" envDefault:"128"`
 }
 
 type Server struct {
 	Addr string `env:"ADDR" envDefault:":3435"`
 }
 
+type Exchange struct {
+	// Names lists registered exchange adapters to stream ticks from.
+	Names []string `env:"NAMES" envDefault:"binancef"`
+	// URLs overrides websocket endpoints per adapter, e.g. "bybit=ws://127.0.0.1:9000".
+	URLs map[string]string `env:"URLS" envKeyValSeparator:"="`
+	// RestURLs overrides REST endpoints per adapter, e.g. "binancef=http://127.0.0.1:9001".
+	RestURLs map[string]string `env:"REST_URLS" envKeyValSeparator:"="`
+	// StreamsPerConn caps symbols per websocket connection below the venue limit.
+	StreamsPerConn int `env:"STREAMS_PER_CONN"`
+
+	// PingInterval is how often websocket pings are sent.
+	PingInterval time.Duration `env:"PING_INTERVAL" envDefault:"30s"`
+	// ReadTimeout closes a connection that received nothing, pongs included.
+	ReadTimeout time.Duration `env:"READ_TIMEOUT" envDefault:"90s"`
+	// StaleTimeout reconnects when no market data arrives on a connection, zero disables it.
+	StaleTimeout time.Duration `env:"STALE_TIMEOUT" envDefault:"5m"`
+	// RotateBefore replaces a connection this long before the venue closes it.
+	RotateBefore time.Duration `env:"ROTATE_BEFORE" envDefault:"30m"`
+
+	// Backfill fetches trades missed during reconnects over REST.
+	Backfill bool `env:"BACKFILL"`
+
+	// DepthSymbols lists "<exchange>:<symbol>" order books to maintain.
+	DepthSymbols []string `env:"DEPTH_SYMBOLS"`
+	// DepthLevels is the number of order book levels published per side.
+	DepthLevels int `env:"DEPTH_LEVELS" envDefault:"20"`
+
+	// InfoBars lists "<exchange>:<symbol>:<type>:<threshold>" information-driven
+	// bars to aggregate, e.g. "binancef:btcusdt:tick:1000". The threshold of
+	// renko bars is the brick size, of range bars the range.
+	InfoBars []string `env:"INFO_BARS"`
+	// HeikinAshi lists "<exchange>:<symbol>:<timeframe>" Heikin-Ashi candles
+	// to derive from time bars.
+	HeikinAshi []string `env:"HEIKIN_ASHI"`
+
+	// BarSource is "trades", "klines" (exchange klines) or "reconcile" (trades
+	// checked against klines).
+	BarSource string `env:"BAR_SOURCE" envDefault:"trades"`
+
+	// BarGrace keeps trade-built bars open for late trades after their interval.
+	BarGrace time.Duration `env:"BAR_GRACE" envDefault:"2s"`
+	// BarLateWindow is the number of closed bars amended by late trades.
+	BarLateWindow int `env:"BAR_LATE_WINDOW" envDefault:"3"`
+	// BaseTimeframe is aggregated from trades, its multiples are rolled up
+	// from its bars. Empty aggregates every timeframe from trades.
+	BaseTimeframe string `env:"BASE_TIMEFRAME" envDefault:"1m"`
+
+	// HistoryBars is the number of closed bars backfilled from exchange klines
+	// and kept per symbol and timeframe, zero disables history.
+	HistoryBars int `env:"HISTORY_BARS" envDefault:"200"`
+
+	// OpenInterestInterval is how often open interest is polled over REST.
+	OpenInterestInterval time.Duration `env:"OPEN_INTEREST_INTERVAL" envDefault:"15s"`
+}
+
 func New() (*Config, error) {
 	err := godotenv.Load()
 	if err != nil {
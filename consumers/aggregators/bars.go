@@ -4,133 +4,415 @@ import (
 	"context"
 	"encoding/json"
 	"log/slog"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	c "github.com/11me/calef/common"
 	"github.com/11me/calef/consumers"
 	"github.com/11me/calef/models"
 	"github.com/nats-io/nats.go"
-	"github.com/valyala/fastjson"
+	"github.com/shopspring/decimal"
 )
 
+// DefaultGrace is how long a bar stays open for late trades after its
+// interval ends.
+const DefaultGrace = 2 * time.Second
+
+// DefaultLateWindow is the number of closed bars amended by late trades.
+const DefaultLateWindow = 3
+
+// maxFlatBars bounds flat bars emitted at once, e.g. when trades are replayed
+// with old timestamps. Longer gaps are skipped.
+const maxFlatBars = 1440
+
+// barState is a bar with the times of its first and last trades, out of
+// order trades replace the open or close, and the first or last trade id, only
+// when they are earlier or later.
+type barState struct {
+	bar     models.Bar
+	openAt  time.Time
+	closeAt time.Time
+	// flat is set for bars closed without trades.
+	flat bool
+}
+
+func newBarState(bar models.Bar, at time.Time) *barState {
+	return &barState{bar: bar, openAt: at, closeAt: at}
+}
+
+func (st *barState) add(trade *models.Trade) {
+	price, at := trade.Price, trade.ExchangeTime
+
+	if st.flat {
+		st.flat = false
+		st.bar.Open, st.bar.High, st.bar.Low, st.bar.Close = price, price, price, price
+		st.bar.FirstTradeID, st.bar.LastTradeID = trade.TradeID, trade.TradeID
+		st.bar.AddVolume(trade)
+		st.openAt, st.closeAt = at, at
+
+		return
+	}
+
+	st.bar.High = decimal.Max(st.bar.High, price)
+	st.bar.Low = decimal.Min(st.bar.Low, price)
+	st.bar.AddVolume(trade)
+
+	if at.Before(st.openAt) {
+		st.bar.Open = price
+		st.bar.FirstTradeID = trade.TradeID
+		st.openAt = at
+	}
+
+	if !at.Before(st.closeAt) {
+		st.bar.Close = price
+		st.bar.LastTradeID = trade.TradeID
+		st.closeAt = at
+	}
+}
+
+// BarAggregator builds bars from trades. Bars are closed by the wall clock
+// once their interval and the grace period passed, intervals without trades
+// are closed as flat bars carrying the previous close. Late trades amend the
+// last closed bars within the late window and republish them with the next
+// revision, older trades are dropped.
 type BarAggregator struct {
-	ctx        context.Context
-	nc         *nats.Conn
-	log        *slog.Logger
-	symbol     string
-	tf         models.Timeframe
-	consumer   *consumers.Consumer
-	currentBar *models.Bar
+	ctx      context.Context
+	nc       *nats.Conn
+	log      *slog.Logger
+	exchange string
+	symbol   string
+	tf       models.Timeframe
+	grace    time.Duration
+	consumer *consumers.Consumer
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	// lateWindow is the number of closed bars amended by late trades.
+	lateWindow int
+
+	mu sync.Mutex
+	// bars holds the open bars by start, there is more than one within the
+	// grace period only.
+	bars map[time.Time]*barState
+	// closed holds the closed bars within the late window by start.
+	closed map[time.Time]*barState
+	// nextStart is the start of the oldest bar not closed yet.
+	nextStart time.Time
+	lastClose decimal.Decimal
+	// amended and dropped count late trades since the last report.
+	amended, dropped int
 }
 
-func NewBarAggregator(ctx context.Context, nc *nats.Conn, symbol string, tf models.Timeframe) *BarAggregator {
+func NewBarAggregator(ctx context.Context, nc *nats.Conn, exchange, symbol string, tf models.Timeframe) *BarAggregator {
 	agg := &BarAggregator{
 		ctx:      ctx,
 		nc:       nc,
+		exchange: exchange,
 		symbol:   symbol,
 		tf:       tf,
-		log:      slog.With("service", "BarAggregator", "symbol", symbol, "timeframe", tf.String()),
+		grace:    DefaultGrace,
+		log:      slog.With("service", "BarAggregator", "exchange", exchange, "symbol", symbol, "timeframe", tf.String()),
 		consumer: consumers.NewConsumer(ctx, nc),
+		stop:     make(chan struct{}),
+		bars:     make(map[time.Time]*barState),
+		closed:   make(map[time.Time]*barState),
+
+		lateWindow: DefaultLateWindow,
 	}
 
 	agg.consumer.
 		SetConcurrency(1).
 		SetLogger(agg.log).
-		Subscribe(c.BinanceTicksSubj(agg.symbol), agg)
+		Subscribe(c.TicksSubj(agg.exchange, agg.symbol), agg)
 
 	return agg
 }
 
+// SetGrace sets how long a bar waits for late trades after its interval.
+func (ba *BarAggregator) SetGrace(d time.Duration) *BarAggregator {
+	if d >= 0 {
+		ba.grace = d
+	}
+
+	return ba
+}
+
+// SetLateWindow sets the number of closed bars amended by late trades.
+func (ba *BarAggregator) SetLateWindow(n int) *BarAggregator {
+	if n >= 0 {
+		ba.lateWindow = n
+	}
+
+	return ba
+}
+
+// SetSeed continues the open bar, e.g. fetched from the exchange after a
+// restart. Trades of the bar received before the seed may be counted twice.
+func (ba *BarAggregator) SetSeed(bar *models.Bar) *BarAggregator {
+	if bar != nil && !bar.IsClosed {
+		seed := *bar
+		seed.StartTime = seed.StartTime.UTC()
+		seed.EndTime = seed.StartTime.Add(time.Duration(ba.tf))
+
+		// Trades of the seed time are unknown, any later trade sets the close.
+		st := newBarState(seed, seed.StartTime)
+		st.closeAt = time.Time{}
+
+		ba.bars[seed.StartTime] = st
+		ba.nextStart = seed.StartTime
+	}
+
+	return ba
+}
+
 func (ba *BarAggregator) Spawn() error {
-	return ba.consumer.Start()
+	if err := ba.consumer.Start(); err != nil {
+		return err
+	}
+
+	ba.wg.Add(1)
+
+	go func() {
+		defer ba.wg.Done()
+		ba.closer()
+	}()
+
+	return nil
 }
 
 func (ba *BarAggregator) Stop() error {
+	close(ba.stop)
+	ba.wg.Wait()
+
 	return ba.consumer.Stop()
 }
 
 func (ba *BarAggregator) Handle(msg *nats.Msg) error {
-	parser := fastjson.Parser{}
-	val, err := parser.ParseBytes(msg.Data)
+	trade, err := c.DecodeTrade(msg)
 	if err != nil {
 		ba.log.Error("failed to parse tick", "err", err, "data", string(msg.Data))
 		return err
 	}
 
-	symbolTick := string(val.GetStringBytes("s"))
-	if strings.ToLower(symbolTick) != ba.symbol {
+	if trade.Exchange != ba.exchange || strings.ToLower(trade.Symbol) != ba.symbol {
 		return nil
 	}
 
-	priceStr := string(val.GetStringBytes("p"))
-	quantityStr := string(val.GetStringBytes("q"))
-	eventTime := val.GetInt64("E")
+	price := trade.Price
 
-	price, err := strconv.ParseFloat(priceStr, 64)
-	if err != nil {
-		ba.log.Error("failed to parse price", "err", err)
-		return err
+	// Determine the bucket for the current tick based on the timeframe.
+	tickBucket := trade.ExchangeTime.UTC().Truncate(time.Duration(ba.tf))
+
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+
+	if ba.nextStart.IsZero() {
+		ba.nextStart = tickBucket
 	}
 
-	quantity, err := strconv.ParseFloat(quantityStr, 64)
-	if err != nil {
-		ba.log.Error("failed to parse quantity", "err", err)
+	subjBars := c.BarsSubj(ba.exchange, ba.symbol, ba.tf)
+
+	st, ok := ba.bars[tickBucket]
+	switch {
+	case ok:
+		st.add(&trade)
+	case !tickBucket.Before(ba.nextStart):
+		st = newBarState(models.Bar{
+			Exchange:     ba.exchange,
+			Symbol:       ba.symbol,
+			Open:         price,
+			High:         price,
+			Low:          price,
+			Close:        price,
+			FirstTradeID: trade.TradeID,
+			LastTradeID:  trade.TradeID,
+			StartTime:    tickBucket,
+			EndTime:      tickBucket.Add(time.Duration(ba.tf)),
+			IsClosed:     false,
+		}, trade.ExchangeTime)
+		st.bar.AddVolume(&trade)
+		ba.bars[tickBucket] = st
+	default:
+		st, ok = ba.closed[tickBucket]
+		if !ok {
+			ba.dropped++
+			ba.log.Debug("dropping trade older than the late window", "tradeId", trade.TradeID, "time", trade.ExchangeTime)
+
+			return nil
+		}
+
+		st.add(&trade)
+		st.bar.Revision++
+		ba.amended++
+
+		if err := ba.publishBar(subjBars, &st.bar); err != nil {
+			ba.log.Error("failed to publish amended candle", "subject", subjBars, "err", err)
+			return err
+		}
+
+		ba.carryClose(tickBucket)
+
+		return nil
+	}
+
+	if err := ba.publishBar(subjBars, &st.bar); err != nil {
+		ba.log.Error("failed to publish candle", "subject", subjBars, "err", err)
 		return err
 	}
 
-	// Determine the bucket for the current tick based on the timeframe.
-	tickTime := time.Unix(0, eventTime*int64(time.Millisecond))
-	tickBucket := tickTime.Truncate(time.Duration(ba.tf))
+	return nil
+}
+
+// closer closes bars when their interval and the grace period passed.
+func (ba *BarAggregator) closer() {
+	tf := time.Duration(ba.tf)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ba.stop:
+			return
+		case <-ba.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		ba.closeDue(now)
+
+		// The next bar is due when its interval ends plus the grace period.
+		next := now.Add(-ba.grace).Truncate(tf).Add(tf + ba.grace)
+		timer.Reset(time.Until(next))
+	}
+}
+
+// closeDue closes the bars whose interval ended more than the grace period
+// before now, missing bars are closed as flat bars.
+func (ba *BarAggregator) closeDue(now time.Time) {
+	tf := time.Duration(ba.tf)
+	cutoff := now.Add(-ba.grace).Truncate(tf).Add(-tf)
+	subjBars := c.BarsSubj(ba.exchange, ba.symbol, ba.tf)
+
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+
+	if ba.nextStart.IsZero() {
+		return
+	}
+
+	flat := 0
+
+	for ; !ba.nextStart.After(cutoff); ba.nextStart = ba.nextStart.Add(tf) {
+		st, ok := ba.bars[ba.nextStart]
+		if ok {
+			delete(ba.bars, ba.nextStart)
+		} else {
+			if flat >= maxFlatBars {
+				if next := ba.oldestOpen(cutoff); next.After(ba.nextStart) {
+					ba.log.Warn("skipping flat bars", "from", ba.nextStart, "to", next)
+					ba.nextStart = next.Add(-tf)
 
-	subjBars := c.BinanceBarsSubj(ba.symbol, ba.tf)
+					continue
+				}
+			}
+
+			flat++
 
-	if ba.currentBar == nil || tickBucket.After(ba.currentBar.StartTime) {
-		if ba.currentBar != nil {
-			ba.currentBar.IsClosed = true
-			if err := ba.publishBar(subjBars, ba.currentBar); err != nil {
-				ba.log.Error("failed to publish finalized candle", "subject", subjBars, "err", err)
+			st = &barState{
+				bar: models.Bar{
+					Exchange:  ba.exchange,
+					Symbol:    ba.symbol,
+					Open:      ba.lastClose,
+					High:      ba.lastClose,
+					Low:       ba.lastClose,
+					Close:     ba.lastClose,
+					StartTime: ba.nextStart,
+					EndTime:   ba.nextStart.Add(tf),
+				},
+				flat: true,
 			}
 		}
 
-		ba.currentBar = &models.Bar{
-			Symbol:    ba.symbol,
-			Open:      price,
-			High:      price,
-			Low:       price,
-			Close:     price,
-			Volume:    quantity,
-			StartTime: tickBucket,
-			IsClosed:  false,
+		st.bar.IsClosed = true
+		ba.lastClose = st.bar.Close
+		ba.closed[ba.nextStart] = st
+
+		if err := ba.publishBar(subjBars, &st.bar); err != nil {
+			ba.log.Error("failed to publish finalized candle", "subject", subjBars, "err", err)
 		}
-	} else {
-		// Update the current candle.
-		if price > ba.currentBar.High {
-			ba.currentBar.High = price
+	}
+
+	// Closed bars leave the late window.
+	horizon := ba.nextStart.Add(-time.Duration(ba.lateWindow) * tf)
+	for start := range ba.closed {
+		if start.Before(horizon) {
+			delete(ba.closed, start)
 		}
+	}
 
-		if price < ba.currentBar.Low {
-			ba.currentBar.Low = price
+	if ba.amended > 0 || ba.dropped > 0 {
+		ba.log.Warn("late trades", "amended", ba.amended, "dropped", ba.dropped)
+		ba.amended, ba.dropped = 0, 0
+	}
+}
+
+// carryClose revises the flat bars closed after the amended bar of start to
+// carry its close, and continues later flat bars from the newest closed bar.
+// The caller must hold mu.
+func (ba *BarAggregator) carryClose(start time.Time) {
+	tf := time.Duration(ba.tf)
+	subjBars := c.BarsSubj(ba.exchange, ba.symbol, ba.tf)
+	prev := ba.closed[start].bar.Close
+
+	for t := start.Add(tf); t.Before(ba.nextStart); t = t.Add(tf) {
+		st, ok := ba.closed[t]
+		if !ok || !st.flat || st.bar.Close.Equal(prev) {
+			break
 		}
 
-		ba.currentBar.Close = price
-		ba.currentBar.Volume += quantity
+		st.bar.Open, st.bar.High, st.bar.Low, st.bar.Close = prev, prev, prev, prev
+		st.bar.Revision++
+
+		if err := ba.publishBar(subjBars, &st.bar); err != nil {
+			ba.log.Error("failed to publish revised flat candle", "subject", subjBars, "err", err)
+		}
 	}
 
-	if err := ba.publishBar(subjBars, ba.currentBar); err != nil {
-		ba.log.Error("failed to publish candle", "subject", subjBars, "err", err)
-		return err
+	if last, ok := ba.closed[ba.nextStart.Add(-tf)]; ok {
+		ba.lastClose = last.bar.Close
 	}
+}
 
-	return nil
+// oldestOpen returns the start of the oldest open bar not after cutoff, or
+// cutoff. The caller must hold mu.
+func (ba *BarAggregator) oldestOpen(cutoff time.Time) time.Time {
+	oldest := cutoff
+	for start := range ba.bars {
+		if start.Before(oldest) {
+			oldest = start
+		}
+	}
+
+	return oldest
 }
 
+// publishBar publishes the bar, closed bars and their revisions on the
+// closed bars subject as well.
 func (ba *BarAggregator) publishBar(subj string, candle *models.Bar) error {
 	data, err := json.Marshal(candle)
 	if err != nil {
 		return err
 	}
 
-	return ba.nc.Publish(subj, data)
+	if err := ba.nc.Publish(subj, data); err != nil {
+		return err
+	}
+
+	if !candle.IsClosed {
+		return nil
+	}
+
+	return ba.nc.PublishMsg(c.NewClosedBarMsg(candle, ba.tf, data))
 }
@@ -0,0 +1,281 @@
+package aggregators
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/internal/natstest"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+// t0 is the start of the first bar of the tests.
+var t0 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// tradeMsg builds the tick message of a btcusdt trade.
+func tradeMsg(t *testing.T, id int, price, qty string, side models.Side, at time.Time) *nats.Msg {
+	t.Helper()
+
+	trade := models.Trade{
+		Exchange: "binancef", Symbol: "btcusdt", TradeID: strconv.Itoa(id),
+		Price: decimal.RequireFromString(price), Quantity: decimal.RequireFromString(qty), Side: side,
+		ExchangeTime: at,
+	}
+
+	msg, err := c.NewTradeMsg(c.TicksSubj(trade.Exchange, trade.Symbol), &trade)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+// published runs fn and returns the messages published on subj meanwhile.
+func published(t *testing.T, nc *nats.Conn, subj string, fn func()) [][]byte {
+	t.Helper()
+
+	ch := make(chan *nats.Msg, 256)
+	sub, err := nc.ChanSubscribe(subj, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	fn()
+
+	// The end marker arrives after everything published before it.
+	if err := nc.Publish(subj, []byte("end")); err != nil {
+		t.Fatal(err)
+	}
+
+	var out [][]byte
+	for {
+		select {
+		case msg := <-ch:
+			if string(msg.Data) == "end" {
+				return out
+			}
+
+			out = append(out, msg.Data)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("end marker not received after %d messages", len(out))
+		}
+	}
+}
+
+// barStrings summarizes the bar messages as "<start> <o>/<h>/<l>/<c> v<volume> r<revision>".
+func barStrings(t *testing.T, msgs [][]byte) []string {
+	t.Helper()
+
+	out := make([]string, 0, len(msgs))
+	for _, data := range msgs {
+		var bar models.Bar
+		if err := json.Unmarshal(data, &bar); err != nil {
+			t.Fatal(err)
+		}
+
+		s := fmt.Sprintf("%s %s/%s/%s/%s v%s r%d", bar.StartTime.UTC().Format("15:04"),
+			bar.Open, bar.High, bar.Low, bar.Close, bar.Volume, bar.Revision)
+		if bar.IsClosed {
+			s += " closed"
+		}
+
+		out = append(out, s)
+	}
+
+	return out
+}
+
+func equalStrings(t *testing.T, got, want []string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages %q, want %d %q", len(got), got, len(want), want)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("message %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+// barStep is a trade at an offset from t0, or the closing of the due bars at
+// the offset when price is empty.
+type barStep struct {
+	at    time.Duration
+	price string
+}
+
+func TestBarAggregator(t *testing.T) {
+	tests := []struct {
+		name       string
+		grace      time.Duration
+		lateWindow int
+		steps      []barStep
+		want       []string
+	}{
+		{
+			name: "trades update the open bar",
+			steps: []barStep{
+				{at: 10 * time.Second, price: "100"},
+				{at: 20 * time.Second, price: "102"},
+				{at: 30 * time.Second, price: "99"},
+				// Out of order trades replace the open only when earlier.
+				{at: 5 * time.Second, price: "98"},
+			},
+			want: []string{
+				"00:00 100/100/100/100 v1 r0",
+				"00:00 100/102/100/102 v2 r0",
+				"00:00 100/102/99/99 v3 r0",
+				"00:00 98/102/98/99 v4 r0",
+			},
+		},
+		{
+			name:  "grace keeps the bar open for late trades",
+			grace: 2 * time.Second,
+			steps: []barStep{
+				{at: 10 * time.Second, price: "100"},
+				{at: time.Minute + time.Second},
+				{at: 50 * time.Second, price: "101"},
+				{at: time.Minute + 3*time.Second},
+			},
+			want: []string{
+				"00:00 100/100/100/100 v1 r0",
+				"00:00 100/101/100/101 v2 r0",
+				"00:00 100/101/100/101 v2 r0 closed",
+			},
+		},
+		{
+			name: "intervals without trades close flat",
+			steps: []barStep{
+				{at: 10 * time.Second, price: "100"},
+				{at: 3 * time.Minute},
+			},
+			want: []string{
+				"00:00 100/100/100/100 v1 r0",
+				"00:00 100/100/100/100 v1 r0 closed",
+				"00:01 100/100/100/100 v0 r0 closed",
+				"00:02 100/100/100/100 v0 r0 closed",
+			},
+		},
+		{
+			name: "amended closes carry into flat bars",
+			steps: []barStep{
+				{at: 10 * time.Second, price: "100"},
+				{at: 3 * time.Minute},
+				{at: 20 * time.Second, price: "103"},
+				{at: 4 * time.Minute},
+			},
+			want: []string{
+				"00:00 100/100/100/100 v1 r0",
+				"00:00 100/100/100/100 v1 r0 closed",
+				"00:01 100/100/100/100 v0 r0 closed",
+				"00:02 100/100/100/100 v0 r0 closed",
+				"00:00 100/103/100/103 v2 r1 closed",
+				"00:01 103/103/103/103 v0 r1 closed",
+				"00:02 103/103/103/103 v0 r1 closed",
+				"00:03 103/103/103/103 v0 r0 closed",
+			},
+		},
+		{
+			name:       "trades older than the late window are dropped",
+			lateWindow: 1,
+			steps: []barStep{
+				{at: 10 * time.Second, price: "100"},
+				{at: 3 * time.Minute},
+				{at: 20 * time.Second, price: "103"},
+				{at: 2*time.Minute + 10*time.Second, price: "104"},
+				{at: 4 * time.Minute},
+			},
+			want: []string{
+				"00:00 100/100/100/100 v1 r0",
+				"00:00 100/100/100/100 v1 r0 closed",
+				"00:01 100/100/100/100 v0 r0 closed",
+				"00:02 100/100/100/100 v0 r0 closed",
+				// A trade in a flat bar replaces its prices.
+				"00:02 104/104/104/104 v1 r1 closed",
+				"00:03 104/104/104/104 v0 r0 closed",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := natstest.Connect(t)
+			ba := NewBarAggregator(context.Background(), nc, "binancef", "btcusdt", models.M1).SetGrace(tt.grace)
+			if tt.lateWindow > 0 {
+				ba.SetLateWindow(tt.lateWindow)
+			}
+
+			msgs := published(t, nc, c.BarsSubj("binancef", "btcusdt", models.M1), func() {
+				for i, step := range tt.steps {
+					if step.price == "" {
+						ba.closeDue(t0.Add(step.at))
+						continue
+					}
+
+					if err := ba.Handle(tradeMsg(t, i, step.price, "1", models.SideBuy, t0.Add(step.at))); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+
+			equalStrings(t, barStrings(t, msgs), tt.want)
+		})
+	}
+}
+
+func TestBarAggregatorCloser(t *testing.T) {
+	nc := natstest.Connect(t)
+	tf := models.Timeframe(time.Second)
+
+	closed := make(chan *nats.Msg, 16)
+	if _, err := nc.ChanSubscribe(c.ClosedBarsSubj("binancef", "btcusdt", tf), closed); err != nil {
+		t.Fatal(err)
+	}
+
+	ba := NewBarAggregator(context.Background(), nc, "binancef", "btcusdt", tf).SetGrace(50 * time.Millisecond)
+	if err := ba.Spawn(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ba.Stop() })
+
+	now := time.Now()
+	if err := nc.PublishMsg(tradeMsg(t, 1, "100", "1", models.SideBuy, now)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The traded bar and the flat bar after it are closed by the clock.
+	var got [][]byte
+	for len(got) < 2 {
+		select {
+		case msg := <-closed:
+			got = append(got, msg.Data)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d closed bars, want 2", len(got))
+		}
+	}
+
+	for i, want := range []string{"v1", "v0"} {
+		var bar models.Bar
+		if err := json.Unmarshal(got[i], &bar); err != nil {
+			t.Fatal(err)
+		}
+
+		start := now.UTC().Truncate(time.Second).Add(time.Duration(i) * time.Second)
+		if !bar.IsClosed || !bar.StartTime.Equal(start) || "v"+bar.Volume.String() != want || !bar.Close.Equal(decimal.NewFromInt(100)) {
+			t.Errorf("closed bar %d: %+v", i, bar)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package aggregators
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/consumers"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+// haCandle is the open and close of a closed Heikin-Ashi candle.
+type haCandle struct {
+	start       time.Time
+	open, close decimal.Decimal
+}
+
+// HeikinAshiAggregator derives Heikin-Ashi candles from the bars of a
+// timeframe. Open bars are published as partial candles, revisions of the
+// last closed bar are derived again.
+type HeikinAshiAggregator struct {
+	ctx      context.Context
+	nc       *nats.Conn
+	log      *slog.Logger
+	exchange string
+	symbol   string
+	tf       models.Timeframe
+	consumer *consumers.Consumer
+
+	// last and prev are the last two closed candles.
+	last, prev *haCandle
+}
+
+func NewHeikinAshiAggregator(ctx context.Context, nc *nats.Conn, exchange, symbol string, tf models.Timeframe) *HeikinAshiAggregator {
+	agg := &HeikinAshiAggregator{
+		ctx:      ctx,
+		nc:       nc,
+		exchange: exchange,
+		symbol:   symbol,
+		tf:       tf,
+		log:      slog.With("service", "HeikinAshiAggregator", "exchange", exchange, "symbol", symbol, "timeframe", tf.String()),
+		consumer: consumers.NewConsumer(ctx, nc),
+	}
+
+	agg.consumer.
+		SetConcurrency(1).
+		SetLogger(agg.log).
+		Subscribe(c.BarsSubj(agg.exchange, agg.symbol, agg.tf), agg)
+
+	return agg
+}
+
+func (ha *HeikinAshiAggregator) Spawn() error {
+	return ha.consumer.Start()
+}
+
+func (ha *HeikinAshiAggregator) Stop() error {
+	return ha.consumer.Stop()
+}
+
+func (ha *HeikinAshiAggregator) Handle(msg *nats.Msg) error {
+	var bar models.Bar
+	if err := json.Unmarshal(msg.Data, &bar); err != nil {
+		ha.log.Error("failed to parse bar", "err", err, "data", string(msg.Data))
+		return err
+	}
+
+	if bar.Exchange != ha.exchange || strings.ToLower(bar.Symbol) != ha.symbol {
+		return nil
+	}
+
+	// The candle follows the last closed one, or the one before when the
+	// last is revised.
+	prev := ha.last
+	if prev != nil && !bar.StartTime.After(prev.start) {
+		if !bar.StartTime.Equal(prev.start) {
+			return nil
+		}
+
+		prev = ha.prev
+	}
+
+	two, four := decimal.NewFromInt(2), decimal.NewFromInt(4)
+
+	candle := bar
+	candle.Close = decimal.Sum(bar.Open, bar.High, bar.Low, bar.Close).Div(four)
+	candle.Open = bar.Open.Add(bar.Close).Div(two)
+	if prev != nil {
+		candle.Open = prev.open.Add(prev.close).Div(two)
+	}
+
+	candle.High = decimal.Max(bar.High, candle.Open, candle.Close)
+	candle.Low = decimal.Min(bar.Low, candle.Open, candle.Close)
+
+	if bar.IsClosed {
+		closed := &haCandle{start: bar.StartTime, open: candle.Open, close: candle.Close}
+		if prev == ha.last {
+			ha.prev = ha.last
+		}
+
+		ha.last = closed
+	}
+
+	subj := c.HeikinAshiSubj(ha.exchange, ha.symbol, ha.tf)
+	if err := ha.publishBar(subj, &candle); err != nil {
+		ha.log.Error("failed to publish candle", "subject", subj, "err", err)
+		return err
+	}
+
+	return nil
+}
+
+func (ha *HeikinAshiAggregator) publishBar(subj string, candle *models.Bar) error {
+	data, err := json.Marshal(candle)
+	if err != nil {
+		return err
+	}
+
+	return ha.nc.Publish(subj, data)
+}
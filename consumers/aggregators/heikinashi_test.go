@@ -0,0 +1,79 @@
+package aggregators
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/internal/natstest"
+	"github.com/11me/calef/models"
+)
+
+func TestHeikinAshiAggregator(t *testing.T) {
+	m1 := func(at time.Duration, ohlc string, closed bool, revision int) models.Bar {
+		return testBar(at, models.M1, ohlc, "1", closed, revision)
+	}
+
+	tests := []struct {
+		name string
+		bars []models.Bar
+		want []string
+	}{
+		{
+			name: "candles open at the middle of the previous candle",
+			bars: []models.Bar{
+				m1(0, "100/110/90/104", true, 0),
+				m1(time.Minute, "104/108/102/106", false, 0),
+			},
+			want: []string{
+				"00:00 102/110/90/101 v1 r0 closed",
+				"00:01 101.5/108/101.5/105 v1 r0",
+			},
+		},
+		{
+			name: "revisions of the last closed bar are derived again",
+			bars: []models.Bar{
+				m1(0, "100/110/90/104", true, 0),
+				m1(time.Minute, "104/108/102/106", true, 0),
+				m1(time.Minute, "104/112/102/110", true, 1),
+				m1(2*time.Minute, "110/110/110/110", false, 0),
+			},
+			want: []string{
+				"00:00 102/110/90/101 v1 r0 closed",
+				"00:01 101.5/108/101.5/105 v1 r0 closed",
+				"00:01 101.5/112/101.5/107 v1 r1 closed",
+				"00:02 104.25/110/104.25/110 v1 r0",
+			},
+		},
+		{
+			name: "bars before the last closed one are ignored",
+			bars: []models.Bar{
+				m1(0, "100/110/90/104", true, 0),
+				m1(time.Minute, "104/108/102/106", true, 0),
+				m1(0, "100/120/90/104", true, 1),
+			},
+			want: []string{
+				"00:00 102/110/90/101 v1 r0 closed",
+				"00:01 101.5/108/101.5/105 v1 r0 closed",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := natstest.Connect(t)
+			ha := NewHeikinAshiAggregator(context.Background(), nc, "binancef", "btcusdt", models.M1)
+
+			msgs := published(t, nc, c.HeikinAshiSubj("binancef", "btcusdt", models.M1), func() {
+				for _, bar := range tt.bars {
+					if err := ha.Handle(barMsg(t, c.BarsSubj("binancef", "btcusdt", models.M1), bar)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+
+			equalStrings(t, barStrings(t, msgs), tt.want)
+		})
+	}
+}
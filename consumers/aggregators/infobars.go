@@ -0,0 +1,200 @@
+package aggregators
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"strings"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/consumers"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+// imbalanceSpan is the number of bars the expectations of imbalance bars are
+// averaged over.
+const imbalanceSpan = 10
+
+// InfoBarAggregator builds information-driven bars from trades: tick, volume,
+// dollar, tick imbalance and range bars. A bar starts with its first trade and
+// is closed by the trade reaching the threshold.
+type InfoBarAggregator struct {
+	ctx      context.Context
+	nc       *nats.Conn
+	log      *slog.Logger
+	exchange string
+	symbol   string
+	spec     models.BarSpec
+	consumer *consumers.Consumer
+	// threshold is the exact threshold of the spec.
+	threshold decimal.Decimal
+
+	current *models.Bar
+	// size is the trades, quantity or value of the current bar.
+	size decimal.Decimal
+
+	// Tick imbalance bars close once |theta| exceeds the expected trades per
+	// bar times the expected imbalance per trade.
+	theta        float64
+	ticks        float64
+	lastPrice    decimal.Decimal
+	lastSign     float64
+	expTicks     float64
+	expImbalance float64
+	warm         bool
+}
+
+func NewInfoBarAggregator(ctx context.Context, nc *nats.Conn, exchange, symbol string, spec models.BarSpec) *InfoBarAggregator {
+	agg := &InfoBarAggregator{
+		ctx:      ctx,
+		nc:       nc,
+		exchange: exchange,
+		symbol:   symbol,
+		spec:     spec,
+		log:      slog.With("service", "InfoBarAggregator", "exchange", exchange, "symbol", symbol, "bars", spec.String()),
+		consumer: consumers.NewConsumer(ctx, nc),
+		expTicks: spec.Threshold,
+
+		threshold: decimal.NewFromFloat(spec.Threshold),
+	}
+
+	agg.consumer.
+		SetConcurrency(1).
+		SetLogger(agg.log).
+		Subscribe(c.TicksSubj(agg.exchange, agg.symbol), agg)
+
+	return agg
+}
+
+func (ia *InfoBarAggregator) Spawn() error {
+	return ia.consumer.Start()
+}
+
+func (ia *InfoBarAggregator) Stop() error {
+	return ia.consumer.Stop()
+}
+
+func (ia *InfoBarAggregator) Handle(msg *nats.Msg) error {
+	trade, err := c.DecodeTrade(msg)
+	if err != nil {
+		ia.log.Error("failed to parse tick", "err", err, "data", string(msg.Data))
+		return err
+	}
+
+	if trade.Exchange != ia.exchange || strings.ToLower(trade.Symbol) != ia.symbol {
+		return nil
+	}
+
+	price, quantity := trade.Price, trade.Quantity
+
+	if ia.current == nil {
+		ia.current = &models.Bar{
+			Exchange:     ia.exchange,
+			Symbol:       ia.symbol,
+			Open:         price,
+			High:         price,
+			Low:          price,
+			FirstTradeID: trade.TradeID,
+			StartTime:    trade.ExchangeTime,
+		}
+	}
+
+	bar := ia.current
+	bar.High = decimal.Max(bar.High, price)
+	bar.Low = decimal.Min(bar.Low, price)
+	bar.Close = price
+	bar.LastTradeID = trade.TradeID
+	bar.EndTime = trade.ExchangeTime
+	bar.AddVolume(&trade)
+
+	bar.IsClosed = ia.add(bar, price, quantity)
+
+	subj := c.InfoBarsSubj(ia.exchange, ia.symbol, ia.spec)
+	if err := ia.publishBar(subj, bar); err != nil {
+		ia.log.Error("failed to publish candle", "subject", subj, "err", err)
+		return err
+	}
+
+	if bar.IsClosed {
+		ia.current = nil
+	}
+
+	return nil
+}
+
+// add accounts the trade and reports whether it closes the bar.
+func (ia *InfoBarAggregator) add(bar *models.Bar, price, quantity decimal.Decimal) bool {
+	switch ia.spec.Type {
+	case models.BarRange:
+		return bar.High.Sub(bar.Low).GreaterThanOrEqual(ia.threshold)
+	case models.BarTick:
+		ia.size = ia.size.Add(decimal.NewFromInt(1))
+	case models.BarVolume:
+		ia.size = ia.size.Add(quantity)
+	case models.BarDollar:
+		ia.size = ia.size.Add(price.Mul(quantity))
+	case models.BarImbalance:
+		return ia.addImbalance(price)
+	}
+
+	if ia.size.LessThan(ia.threshold) {
+		return false
+	}
+
+	ia.size = decimal.Zero
+
+	return true
+}
+
+// addImbalance signs the trade by the tick rule. The first bar closes after
+// the threshold trades, later ones once the imbalance exceeds expectation.
+func (ia *InfoBarAggregator) addImbalance(price decimal.Decimal) bool {
+	sign := ia.lastSign
+	switch {
+	case ia.lastPrice.IsZero():
+	case price.GreaterThan(ia.lastPrice):
+		sign = 1
+	case price.LessThan(ia.lastPrice):
+		sign = -1
+	}
+
+	ia.lastPrice, ia.lastSign = price, sign
+	ia.theta += sign
+	ia.ticks++
+
+	if !ia.warm {
+		if ia.ticks < ia.spec.Threshold {
+			return false
+		}
+
+		ia.warm = true
+		ia.expImbalance = ia.theta / ia.ticks
+	} else {
+		// A balanced flow is expected to drift by sqrt(ticks), smaller thresholds
+		// would close bars on noise.
+		threshold := max(ia.expTicks*math.Abs(ia.expImbalance), math.Sqrt(ia.expTicks))
+		if math.Abs(ia.theta) < threshold {
+			return false
+		}
+
+		alpha := 2.0 / (imbalanceSpan + 1)
+		ia.expTicks += alpha * (ia.ticks - ia.expTicks)
+		ia.expImbalance += alpha * (ia.theta/ia.ticks - ia.expImbalance)
+	}
+
+	ia.theta, ia.ticks = 0, 0
+
+	return true
+}
+
+func (ia *InfoBarAggregator) publishBar(subj string, candle *models.Bar) error {
+	data, err := json.Marshal(candle)
+	if err != nil {
+		return err
+	}
+
+	return ia.nc.Publish(subj, data)
+}
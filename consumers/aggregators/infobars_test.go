@@ -0,0 +1,105 @@
+package aggregators
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/internal/natstest"
+	"github.com/11me/calef/models"
+)
+
+// tradeStep is a trade, the trades are a minute apart.
+type tradeStep struct {
+	price string
+	qty   string
+}
+
+func TestInfoBarAggregator(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   models.BarSpec
+		trades []tradeStep
+		want   []string
+	}{
+		{
+			name:   "tick bars close every threshold trades",
+			spec:   models.BarSpec{Type: models.BarTick, Threshold: 2},
+			trades: []tradeStep{{"100", "1"}, {"101", "1"}, {"99", "1"}},
+			want: []string{
+				"00:00 100/100/100/100 v1 r0",
+				"00:00 100/101/100/101 v2 r0 closed",
+				"00:02 99/99/99/99 v1 r0",
+			},
+		},
+		{
+			name:   "volume bars close every threshold quantity",
+			spec:   models.BarSpec{Type: models.BarVolume, Threshold: 3},
+			trades: []tradeStep{{"100", "1"}, {"101", "2"}, {"102", "1"}},
+			want: []string{
+				"00:00 100/100/100/100 v1 r0",
+				"00:00 100/101/100/101 v3 r0 closed",
+				"00:02 102/102/102/102 v1 r0",
+			},
+		},
+		{
+			name:   "dollar bars close every threshold value",
+			spec:   models.BarSpec{Type: models.BarDollar, Threshold: 250},
+			trades: []tradeStep{{"100", "1"}, {"101", "1"}, {"102", "1"}, {"103", "1"}},
+			want: []string{
+				"00:00 100/100/100/100 v1 r0",
+				"00:00 100/101/100/101 v2 r0",
+				"00:00 100/102/100/102 v3 r0 closed",
+				"00:03 103/103/103/103 v1 r0",
+			},
+		},
+		{
+			name:   "range bars close once the range reaches the threshold",
+			spec:   models.BarSpec{Type: models.BarRange, Threshold: 2},
+			trades: []tradeStep{{"100", "1"}, {"101", "1"}, {"98", "1"}, {"99", "1"}},
+			want: []string{
+				"00:00 100/100/100/100 v1 r0",
+				"00:00 100/101/100/101 v2 r0",
+				"00:00 100/101/98/98 v3 r0 closed",
+				"00:03 99/99/99/99 v1 r0",
+			},
+		},
+		{
+			name: "imbalance bars close once the imbalance exceeds expectation",
+			spec: models.BarSpec{Type: models.BarImbalance, Threshold: 3},
+			trades: []tradeStep{
+				{"100", "1"}, {"101", "1"}, {"102", "1"},
+				// The balanced flow keeps the bar open.
+				{"103", "1"}, {"102", "1"}, {"103", "1"}, {"104", "1"},
+			},
+			want: []string{
+				"00:00 100/100/100/100 v1 r0",
+				"00:00 100/101/100/101 v2 r0",
+				"00:00 100/102/100/102 v3 r0 closed",
+				"00:03 103/103/103/103 v1 r0",
+				"00:03 103/103/102/102 v2 r0",
+				"00:03 103/103/102/103 v3 r0",
+				"00:03 103/104/102/104 v4 r0 closed",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := natstest.Connect(t)
+			ia := NewInfoBarAggregator(context.Background(), nc, "binancef", "btcusdt", tt.spec)
+
+			msgs := published(t, nc, c.InfoBarsSubj("binancef", "btcusdt", tt.spec), func() {
+				for i, trade := range tt.trades {
+					at := t0.Add(time.Duration(i) * time.Minute)
+					if err := ia.Handle(tradeMsg(t, i, trade.price, trade.qty, models.SideBuy, at)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+
+			equalStrings(t, barStrings(t, msgs), tt.want)
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package aggregators
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/consumers"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+)
+
+// KlineBarSource republishes exchange klines as bars, it replaces
+// BarAggregator when bars are sourced from the exchange.
+type KlineBarSource struct {
+	ctx      context.Context
+	nc       *nats.Conn
+	log      *slog.Logger
+	exchange string
+	symbol   string
+	tf       models.Timeframe
+	consumer *consumers.Consumer
+}
+
+func NewKlineBarSource(ctx context.Context, nc *nats.Conn, exchange, symbol string, tf models.Timeframe) *KlineBarSource {
+	src := &KlineBarSource{
+		ctx:      ctx,
+		nc:       nc,
+		exchange: exchange,
+		symbol:   symbol,
+		tf:       tf,
+		log:      slog.With("service", "KlineBarSource", "exchange", exchange, "symbol", symbol, "timeframe", tf.String()),
+		consumer: consumers.NewConsumer(ctx, nc),
+	}
+
+	src.consumer.
+		SetConcurrency(1).
+		SetLogger(src.log).
+		Subscribe(c.KlinesSubj(src.exchange, src.symbol, src.tf), src)
+
+	return src
+}
+
+func (ks *KlineBarSource) Spawn() error {
+	return ks.consumer.Start()
+}
+
+func (ks *KlineBarSource) Stop() error {
+	return ks.consumer.Stop()
+}
+
+func (ks *KlineBarSource) Handle(msg *nats.Msg) error {
+	var kline models.Kline
+	if err := json.Unmarshal(msg.Data, &kline); err != nil {
+		ks.log.Error("failed to parse kline", "err", err, "data", string(msg.Data))
+		return err
+	}
+
+	if kline.Exchange != ks.exchange || strings.ToLower(kline.Symbol) != ks.symbol || kline.Timeframe != ks.tf {
+		return nil
+	}
+
+	data, err := json.Marshal(&kline.Bar)
+	if err != nil {
+		return err
+	}
+
+	subj := c.BarsSubj(ks.exchange, ks.symbol, ks.tf)
+	if err := ks.nc.Publish(subj, data); err != nil {
+		ks.log.Error("failed to publish kline bar", "subject", subj, "err", err)
+		return err
+	}
+
+	if !kline.IsClosed {
+		return nil
+	}
+
+	closed := c.NewClosedBarMsg(&kline.Bar, ks.tf, data)
+	if err := ks.nc.PublishMsg(closed); err != nil {
+		ks.log.Error("failed to publish closed kline bar", "subject", closed.Subject, "err", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package aggregators
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/internal/natstest"
+	"github.com/11me/calef/models"
+)
+
+func TestKlineBarSource(t *testing.T) {
+	tests := []struct {
+		name       string
+		tf         models.Timeframe
+		closed     bool
+		wantBars   []string
+		wantClosed []string
+	}{
+		{
+			name:     "open klines are published as bars",
+			tf:       models.M1,
+			wantBars: []string{"00:00 100/101/99/100 v1 r0"},
+		},
+		{
+			name:       "closed klines are published as closed bars as well",
+			tf:         models.M1,
+			closed:     true,
+			wantBars:   []string{"00:00 100/101/99/100 v1 r0 closed"},
+			wantClosed: []string{"00:00 100/101/99/100 v1 r0 closed"},
+		},
+		{
+			name:   "klines of other timeframes are ignored",
+			tf:     models.Timeframe(5 * time.Minute),
+			closed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := natstest.Connect(t)
+			ks := NewKlineBarSource(context.Background(), nc, "binancef", "btcusdt", models.M1)
+
+			msg := klineMsg(t, testBar(0, tt.tf, "100/101/99/100", "1", tt.closed, 0), tt.tf)
+			// The kline is delivered on the subscribed subject whatever its timeframe.
+			msg.Subject = c.KlinesSubj("binancef", "btcusdt", models.M1)
+
+			var closed [][]byte
+			bars := published(t, nc, c.BarsSubj("binancef", "btcusdt", models.M1), func() {
+				closed = published(t, nc, c.ClosedBarsSubj("binancef", "btcusdt", models.M1), func() {
+					if err := ks.Handle(msg); err != nil {
+						t.Fatal(err)
+					}
+				})
+			})
+
+			equalStrings(t, barStrings(t, bars), tt.wantBars)
+			equalStrings(t, barStrings(t, closed), tt.wantClosed)
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package aggregators
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/consumers"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+// QuoteAggregator builds bars of the mid price and spread from best bid/ask
+// quotes.
+type QuoteAggregator struct {
+	ctx        context.Context
+	nc         *nats.Conn
+	log        *slog.Logger
+	exchange   string
+	symbol     string
+	tf         models.Timeframe
+	consumer   *consumers.Consumer
+	currentBar *models.QuoteBar
+
+	// The time-weighted spread of the current bar is the spread held since
+	// lastTime integrated over the bar.
+	lastTime     time.Time
+	lastSpread   decimal.Decimal
+	spreadArea   decimal.Decimal
+	spreadPeriod time.Duration
+}
+
+func NewQuoteAggregator(ctx context.Context, nc *nats.Conn, exchange, symbol string, tf models.Timeframe) *QuoteAggregator {
+	agg := &QuoteAggregator{
+		ctx:      ctx,
+		nc:       nc,
+		exchange: exchange,
+		symbol:   symbol,
+		tf:       tf,
+		log:      slog.With("service", "QuoteAggregator", "exchange", exchange, "symbol", symbol, "timeframe", tf.String()),
+		consumer: consumers.NewConsumer(ctx, nc),
+	}
+
+	agg.consumer.
+		SetConcurrency(1).
+		SetLogger(agg.log).
+		Subscribe(c.QuotesSubj(agg.exchange, agg.symbol), agg)
+
+	return agg
+}
+
+func (qa *QuoteAggregator) Spawn() error {
+	return qa.consumer.Start()
+}
+
+func (qa *QuoteAggregator) Stop() error {
+	return qa.consumer.Stop()
+}
+
+func (qa *QuoteAggregator) Handle(msg *nats.Msg) error {
+	var quote models.Quote
+	if err := json.Unmarshal(msg.Data, &quote); err != nil {
+		qa.log.Error("failed to parse quote", "err", err, "data", string(msg.Data))
+		return err
+	}
+
+	if quote.Exchange != qa.exchange || strings.ToLower(quote.Symbol) != qa.symbol {
+		return nil
+	}
+
+	// Crossed or one-sided books don't have a meaningful mid.
+	if !quote.BidPrice.IsPositive() || !quote.AskPrice.IsPositive() || quote.AskPrice.LessThan(quote.BidPrice) {
+		return nil
+	}
+
+	quoteTime := quote.Time()
+	if quoteTime.Before(qa.lastTime) {
+		quoteTime = qa.lastTime
+	}
+
+	mid, spread := quote.Mid(), quote.Spread()
+	bucket := quoteTime.Truncate(time.Duration(qa.tf))
+
+	subjBars := c.QuoteBarsSubj(qa.exchange, qa.symbol, qa.tf)
+
+	if qa.currentBar == nil || bucket.After(qa.currentBar.StartTime) {
+		if qa.currentBar != nil {
+			qa.accumulate(qa.currentBar.StartTime.Add(time.Duration(qa.tf)))
+			qa.currentBar.TWSpread = qa.twSpread()
+			qa.currentBar.IsClosed = true
+
+			if err := qa.publishBar(subjBars, qa.currentBar); err != nil {
+				qa.log.Error("failed to publish finalized quote bar", "subject", subjBars, "err", err)
+			}
+
+			// The last spread is held from the start of the new bar.
+			qa.lastTime = bucket
+		} else {
+			qa.lastTime = quoteTime
+		}
+
+		qa.spreadArea, qa.spreadPeriod = decimal.Zero, 0
+
+		qa.currentBar = &models.QuoteBar{
+			Exchange:    qa.exchange,
+			Symbol:      qa.symbol,
+			Open:        mid,
+			High:        mid,
+			Low:         mid,
+			Close:       mid,
+			SpreadOpen:  spread,
+			SpreadHigh:  spread,
+			SpreadLow:   spread,
+			SpreadClose: spread,
+			StartTime:   bucket,
+		}
+	}
+
+	qa.accumulate(quoteTime)
+	qa.lastSpread = spread
+
+	bar := qa.currentBar
+	bar.High = decimal.Max(bar.High, mid)
+	bar.Low = decimal.Min(bar.Low, mid)
+	bar.Close = mid
+	bar.SpreadHigh = decimal.Max(bar.SpreadHigh, spread)
+	bar.SpreadLow = decimal.Min(bar.SpreadLow, spread)
+	bar.SpreadClose = spread
+	bar.Quotes++
+	bar.TWSpread = qa.twSpread()
+
+	if err := qa.publishBar(subjBars, bar); err != nil {
+		qa.log.Error("failed to publish quote bar", "subject", subjBars, "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// accumulate adds the last spread held until t to the current bar.
+func (qa *QuoteAggregator) accumulate(t time.Time) {
+	if qa.lastTime.IsZero() || !t.After(qa.lastTime) {
+		return
+	}
+
+	held := t.Sub(qa.lastTime)
+	qa.spreadArea = qa.spreadArea.Add(qa.lastSpread.Mul(decimal.NewFromInt(int64(held))))
+	qa.spreadPeriod += held
+	qa.lastTime = t
+}
+
+// twSpread is the time-weighted spread so far, the last spread until any time
+// has passed.
+func (qa *QuoteAggregator) twSpread() decimal.Decimal {
+	if qa.spreadPeriod <= 0 {
+		return qa.lastSpread
+	}
+
+	return qa.spreadArea.Div(decimal.NewFromInt(int64(qa.spreadPeriod)))
+}
+
+func (qa *QuoteAggregator) publishBar(subj string, bar *models.QuoteBar) error {
+	data, err := json.Marshal(bar)
+	if err != nil {
+		return err
+	}
+
+	return qa.nc.Publish(subj, data)
+}
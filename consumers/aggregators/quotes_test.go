@@ -0,0 +1,130 @@
+package aggregators
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/internal/natstest"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+// quoteStep is a best bid and ask at an offset from t0.
+type quoteStep struct {
+	at       time.Duration
+	bid, ask string
+}
+
+func quoteMsg(t *testing.T, step quoteStep) *nats.Msg {
+	t.Helper()
+
+	quote := models.Quote{
+		Exchange: "binancef", Symbol: "btcusdt",
+		BidPrice: decimal.RequireFromString(step.bid), BidQty: decimal.NewFromInt(1),
+		AskPrice: decimal.RequireFromString(step.ask), AskQty: decimal.NewFromInt(1),
+		ExchangeTime: t0.Add(step.at),
+	}
+
+	data, err := json.Marshal(quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &nats.Msg{Subject: c.QuotesSubj(quote.Exchange, quote.Symbol), Data: data}
+}
+
+// quoteBarStrings summarizes the quote bars as
+// "<start> <o>/<h>/<l>/<c> s<o>/<h>/<l>/<c> tw<spread> q<quotes>".
+func quoteBarStrings(t *testing.T, msgs [][]byte) []string {
+	t.Helper()
+
+	out := make([]string, 0, len(msgs))
+	for _, data := range msgs {
+		var bar models.QuoteBar
+		if err := json.Unmarshal(data, &bar); err != nil {
+			t.Fatal(err)
+		}
+
+		s := fmt.Sprintf("%s %s/%s/%s/%s s%s/%s/%s/%s tw%s q%d", bar.StartTime.UTC().Format("15:04"),
+			bar.Open, bar.High, bar.Low, bar.Close,
+			bar.SpreadOpen, bar.SpreadHigh, bar.SpreadLow, bar.SpreadClose, bar.TWSpread, bar.Quotes)
+		if bar.IsClosed {
+			s += " closed"
+		}
+
+		out = append(out, s)
+	}
+
+	return out
+}
+
+func TestQuoteAggregator(t *testing.T) {
+	tests := []struct {
+		name   string
+		quotes []quoteStep
+		want   []string
+	}{
+		{
+			name: "quotes update the mid and spread",
+			quotes: []quoteStep{
+				{at: 0, bid: "99", ask: "101"},
+				{at: 20 * time.Second, bid: "101", ask: "102"},
+				{at: 40 * time.Second, bid: "98.5", ask: "101.5"},
+			},
+			want: []string{
+				"00:00 100/100/100/100 s2/2/2/2 tw2 q1",
+				"00:00 100/101.5/100/101.5 s2/2/1/1 tw2 q2",
+				"00:00 100/101.5/100/100 s2/3/1/3 tw1.5 q3",
+			},
+		},
+		{
+			name: "the next bar closes the bar and holds its last spread",
+			quotes: []quoteStep{
+				{at: 0, bid: "99", ask: "101"},
+				{at: 20 * time.Second, bid: "101", ask: "102"},
+				{at: 40 * time.Second, bid: "98.5", ask: "101.5"},
+				{at: time.Minute + 10*time.Second, bid: "100", ask: "100"},
+			},
+			want: []string{
+				"00:00 100/100/100/100 s2/2/2/2 tw2 q1",
+				"00:00 100/101.5/100/101.5 s2/2/1/1 tw2 q2",
+				"00:00 100/101.5/100/100 s2/3/1/3 tw1.5 q3",
+				"00:00 100/101.5/100/100 s2/3/1/3 tw2 q3 closed",
+				"00:01 100/100/100/100 s0/0/0/0 tw3 q1",
+			},
+		},
+		{
+			name: "crossed and one-sided quotes are ignored",
+			quotes: []quoteStep{
+				{at: 0, bid: "99", ask: "101"},
+				{at: 10 * time.Second, bid: "102", ask: "101"},
+				{at: 20 * time.Second, bid: "0", ask: "101"},
+			},
+			want: []string{
+				"00:00 100/100/100/100 s2/2/2/2 tw2 q1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := natstest.Connect(t)
+			qa := NewQuoteAggregator(context.Background(), nc, "binancef", "btcusdt", models.M1)
+
+			msgs := published(t, nc, c.QuoteBarsSubj("binancef", "btcusdt", models.M1), func() {
+				for _, quote := range tt.quotes {
+					if err := qa.Handle(quoteMsg(t, quote)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+
+			equalStrings(t, quoteBarStrings(t, msgs), tt.want)
+		})
+	}
+}
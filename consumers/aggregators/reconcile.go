@@ -0,0 +1,209 @@
+package aggregators
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/consumers"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+// reconcileWindow is the number of bars a closed bar waits for its
+// counterpart before it is reported missing.
+const reconcileWindow = 3
+
+// BarReconciler compares closed trade-built bars with closed exchange klines
+// and publishes discrepancies, e.g. caused by dropped ticks.
+type BarReconciler struct {
+	ctx      context.Context
+	nc       *nats.Conn
+	log      *slog.Logger
+	exchange string
+	symbol   string
+	tf       models.Timeframe
+	consumer *consumers.Consumer
+
+	bars   map[time.Time]*models.Bar
+	klines map[time.Time]*models.Bar
+	latest time.Time
+}
+
+func NewBarReconciler(ctx context.Context, nc *nats.Conn, exchange, symbol string, tf models.Timeframe) *BarReconciler {
+	r := &BarReconciler{
+		ctx:      ctx,
+		nc:       nc,
+		exchange: exchange,
+		symbol:   symbol,
+		tf:       tf,
+		log:      slog.With("service", "BarReconciler", "exchange", exchange, "symbol", symbol, "timeframe", tf.String()),
+		consumer: consumers.NewConsumer(ctx, nc),
+		bars:     make(map[time.Time]*models.Bar),
+		klines:   make(map[time.Time]*models.Bar),
+	}
+
+	r.consumer.
+		SetConcurrency(1).
+		SetLogger(r.log).
+		Subscribe(c.ClosedBarsSubj(exchange, symbol, tf), consumers.HandlerFunc(r.handleBar)).
+		Subscribe(c.KlinesSubj(exchange, symbol, tf), consumers.HandlerFunc(r.handleKline))
+
+	return r
+}
+
+func (r *BarReconciler) Spawn() error {
+	return r.consumer.Start()
+}
+
+func (r *BarReconciler) Stop() error {
+	return r.consumer.Stop()
+}
+
+func (r *BarReconciler) handleBar(msg *nats.Msg) error {
+	var bar models.Bar
+	if err := json.Unmarshal(msg.Data, &bar); err != nil {
+		r.log.Error("failed to parse bar", "err", err, "data", string(msg.Data))
+		return err
+	}
+
+	if bar.Exchange != r.exchange || strings.ToLower(bar.Symbol) != r.symbol {
+		return nil
+	}
+
+	r.observe(&bar, false)
+
+	return nil
+}
+
+func (r *BarReconciler) handleKline(msg *nats.Msg) error {
+	var kline models.Kline
+	if err := json.Unmarshal(msg.Data, &kline); err != nil {
+		r.log.Error("failed to parse kline", "err", err, "data", string(msg.Data))
+		return err
+	}
+
+	if !kline.IsClosed || kline.Exchange != r.exchange || strings.ToLower(kline.Symbol) != r.symbol {
+		return nil
+	}
+
+	r.observe(&kline.Bar, true)
+
+	return nil
+}
+
+// observe compares a closed bar with its counterpart. Bars are kept until
+// they fall out of the window, revisions of trade bars are compared again.
+func (r *BarReconciler) observe(bar *models.Bar, isKline bool) {
+	start := bar.StartTime.UTC()
+
+	// Revisions of bars out of the window were already reconciled.
+	if start.Before(r.latest.Add(-reconcileWindow * time.Duration(r.tf))) {
+		return
+	}
+
+	own, other := r.bars, r.klines
+	if isKline {
+		own, other = r.klines, r.bars
+	}
+
+	own[start] = bar
+
+	if counterpart, ok := other[start]; ok {
+		trade, kline := bar, counterpart
+		if isKline {
+			trade, kline = counterpart, bar
+		}
+
+		if fields := diffBars(trade, kline); len(fields) > 0 {
+			r.publish(start, fields, trade, kline)
+		}
+	}
+
+	if start.After(r.latest) {
+		r.latest = start
+	}
+
+	r.expire()
+}
+
+// expire drops bars out of the window and reports those whose counterpart
+// didn't arrive.
+func (r *BarReconciler) expire() {
+	cutoff := r.latest.Add(-reconcileWindow * time.Duration(r.tf))
+
+	for start, bar := range r.bars {
+		if !start.Before(cutoff) {
+			continue
+		}
+
+		_, matched := r.klines[start]
+		delete(r.bars, start)
+		delete(r.klines, start)
+
+		if !matched {
+			r.publish(start, []string{"kline"}, bar, nil)
+		}
+	}
+
+	// Klines left out of the window have no bar.
+	for start, kline := range r.klines {
+		if start.Before(cutoff) {
+			delete(r.klines, start)
+			r.publish(start, []string{"bar"}, nil, kline)
+		}
+	}
+}
+
+func (r *BarReconciler) publish(start time.Time, fields []string, bar, kline *models.Bar) {
+	r.log.Warn("bar differs from exchange kline", "start", start, "fields", fields)
+
+	data, err := json.Marshal(models.BarDiscrepancy{
+		Exchange:  r.exchange,
+		Symbol:    r.symbol,
+		Timeframe: r.tf,
+		StartTime: start,
+		Fields:    fields,
+		Bar:       bar,
+		Kline:     kline,
+		Time:      time.Now(),
+	})
+	if err != nil {
+		r.log.Error("failed to marshal bar discrepancy", "err", err)
+		return
+	}
+
+	subj := c.BarEventsSubj(r.exchange)
+	if err := r.nc.Publish(subj, data); err != nil {
+		r.log.Error("failed to publish bar discrepancy", "subject", subj, "err", err)
+	}
+}
+
+// diffBars returns the names of the fields that differ, decimals are
+// compared exactly.
+func diffBars(bar, kline *models.Bar) []string {
+	var fields []string
+
+	for _, f := range []struct {
+		name string
+		a, b decimal.Decimal
+	}{
+		{"open", bar.Open, kline.Open},
+		{"high", bar.High, kline.High},
+		{"low", bar.Low, kline.Low},
+		{"close", bar.Close, kline.Close},
+		{"volume", bar.Volume, kline.Volume},
+		{"quoteVolume", bar.QuoteVolume, kline.QuoteVolume},
+		{"buyVolume", bar.BuyVolume, kline.BuyVolume},
+	} {
+		if !f.a.Equal(f.b) {
+			fields = append(fields, f.name)
+		}
+	}
+
+	return fields
+}
@@ -0,0 +1,126 @@
+package aggregators
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/internal/natstest"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+)
+
+// reconcileStep is a closed bar, or a kline of the exchange.
+type reconcileStep struct {
+	kline bool
+	bar   models.Bar
+}
+
+func klineMsg(t *testing.T, bar models.Bar, tf models.Timeframe) *nats.Msg {
+	t.Helper()
+
+	data, err := json.Marshal(models.Kline{Bar: bar, Timeframe: tf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &nats.Msg{Subject: c.KlinesSubj(bar.Exchange, bar.Symbol, tf), Data: data}
+}
+
+func TestBarReconciler(t *testing.T) {
+	bar := func(at time.Duration, ohlc, volume string, revision int) reconcileStep {
+		return reconcileStep{bar: testBar(at, models.M1, ohlc, volume, true, revision)}
+	}
+	kline := func(at time.Duration, ohlc, volume string, closed bool) reconcileStep {
+		return reconcileStep{kline: true, bar: testBar(at, models.M1, ohlc, volume, closed, 0)}
+	}
+
+	tests := []struct {
+		name  string
+		steps []reconcileStep
+		want  []string
+	}{
+		{
+			name: "matching bars aren't reported",
+			steps: []reconcileStep{
+				bar(0, "100/101/99/100", "1", 0),
+				kline(0, "100/101/99/100", "1", true),
+			},
+		},
+		{
+			name: "differing fields are reported",
+			steps: []reconcileStep{
+				kline(0, "100/102/99/101", "1", true),
+				bar(0, "100/101/99/100", "1", 0),
+			},
+			want: []string{"00:00 high,close"},
+		},
+		{
+			name: "revised bars are compared again",
+			steps: []reconcileStep{
+				bar(0, "100/101/99/100", "1", 0),
+				kline(0, "100/102/99/100", "2", true),
+				bar(0, "100/102/99/100", "2", 1),
+				bar(0, "100/102/99/99", "2", 2),
+			},
+			want: []string{"00:00 high,volume", "00:00 close"},
+		},
+		{
+			name: "missing counterparts are reported out of the window",
+			steps: []reconcileStep{
+				bar(0, "100/101/99/100", "1", 0),
+				kline(time.Minute, "100/101/99/100", "1", true),
+				bar(4*time.Minute, "100/101/99/100", "1", 0),
+				kline(4*time.Minute, "100/101/99/100", "1", true),
+				bar(5*time.Minute, "100/101/99/100", "1", 0),
+			},
+			want: []string{"00:00 kline", "00:01 bar"},
+		},
+		{
+			name: "open klines are ignored",
+			steps: []reconcileStep{
+				kline(0, "100/101/99/100", "1", false),
+				bar(0, "100/101/99/100", "1", 0),
+				bar(4*time.Minute, "100/101/99/100", "1", 0),
+			},
+			want: []string{"00:00 kline"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := natstest.Connect(t)
+			r := NewBarReconciler(context.Background(), nc, "binancef", "btcusdt", models.M1)
+
+			msgs := published(t, nc, c.BarEventsSubj("binancef"), func() {
+				for _, step := range tt.steps {
+					var err error
+					if step.kline {
+						err = r.handleKline(klineMsg(t, step.bar, models.M1))
+					} else {
+						err = r.handleBar(barMsg(t, c.ClosedBarsSubj("binancef", "btcusdt", models.M1), step.bar))
+					}
+
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+
+			got := make([]string, 0, len(msgs))
+			for _, data := range msgs {
+				var d models.BarDiscrepancy
+				if err := json.Unmarshal(data, &d); err != nil {
+					t.Fatal(err)
+				}
+
+				got = append(got, d.StartTime.UTC().Format("15:04")+" "+strings.Join(d.Fields, ","))
+			}
+
+			equalStrings(t, got, tt.want)
+		})
+	}
+}
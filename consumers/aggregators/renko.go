@@ -0,0 +1,135 @@
+package aggregators
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/consumers"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+// RenkoAggregator builds Renko bricks of a fixed size from trades. A brick is
+// added above the top or below the bottom of the last brick, so a reversal
+// needs the price to move two bricks from the last close. Only completed
+// bricks are published, a trade may complete several.
+type RenkoAggregator struct {
+	ctx      context.Context
+	nc       *nats.Conn
+	log      *slog.Logger
+	exchange string
+	symbol   string
+	spec     models.BarSpec
+	consumer *consumers.Consumer
+
+	top, bottom decimal.Decimal
+	// flow holds the volume, trade ids and times of the trades since the
+	// last brick.
+	flow *models.Bar
+}
+
+func NewRenkoAggregator(ctx context.Context, nc *nats.Conn, exchange, symbol string, spec models.BarSpec) *RenkoAggregator {
+	agg := &RenkoAggregator{
+		ctx:      ctx,
+		nc:       nc,
+		exchange: exchange,
+		symbol:   symbol,
+		spec:     spec,
+		log:      slog.With("service", "RenkoAggregator", "exchange", exchange, "symbol", symbol, "bars", spec.String()),
+		consumer: consumers.NewConsumer(ctx, nc),
+	}
+
+	agg.consumer.
+		SetConcurrency(1).
+		SetLogger(agg.log).
+		Subscribe(c.TicksSubj(agg.exchange, agg.symbol), agg)
+
+	return agg
+}
+
+func (ra *RenkoAggregator) Spawn() error {
+	return ra.consumer.Start()
+}
+
+func (ra *RenkoAggregator) Stop() error {
+	return ra.consumer.Stop()
+}
+
+func (ra *RenkoAggregator) Handle(msg *nats.Msg) error {
+	trade, err := c.DecodeTrade(msg)
+	if err != nil {
+		ra.log.Error("failed to parse tick", "err", err, "data", string(msg.Data))
+		return err
+	}
+
+	if trade.Exchange != ra.exchange || strings.ToLower(trade.Symbol) != ra.symbol {
+		return nil
+	}
+
+	price, size := trade.Price, decimal.NewFromFloat(ra.spec.Threshold)
+
+	if ra.flow == nil {
+		// Bricks are aligned to multiples of the size.
+		ra.bottom = price.Div(size).Floor().Mul(size)
+		ra.top = ra.bottom
+		ra.flow = &models.Bar{StartTime: trade.ExchangeTime}
+	}
+
+	if ra.flow.FirstTradeID == "" {
+		ra.flow.FirstTradeID = trade.TradeID
+	}
+
+	ra.flow.AddVolume(&trade)
+	ra.flow.LastTradeID = trade.TradeID
+	ra.flow.EndTime = trade.ExchangeTime
+
+	subj := c.InfoBarsSubj(ra.exchange, ra.symbol, ra.spec)
+
+	for {
+		var brick models.Bar
+
+		switch {
+		case price.GreaterThanOrEqual(ra.top.Add(size)):
+			brick = ra.brick(ra.top, ra.top.Add(size))
+		case price.LessThanOrEqual(ra.bottom.Sub(size)):
+			brick = ra.brick(ra.bottom, ra.bottom.Sub(size))
+		default:
+			return nil
+		}
+
+		ra.top, ra.bottom = brick.High, brick.Low
+
+		if err := ra.publishBar(subj, &brick); err != nil {
+			ra.log.Error("failed to publish brick", "subject", subj, "err", err)
+			return err
+		}
+
+		// Following bricks of the same trade start with it.
+		ra.flow = &models.Bar{StartTime: trade.ExchangeTime, EndTime: trade.ExchangeTime}
+	}
+}
+
+// brick completes a brick with the trades since the last one.
+func (ra *RenkoAggregator) brick(open, close decimal.Decimal) models.Bar {
+	brick := *ra.flow
+	brick.Exchange = ra.exchange
+	brick.Symbol = ra.symbol
+	brick.Open, brick.Close = open, close
+	brick.High, brick.Low = decimal.Max(open, close), decimal.Min(open, close)
+	brick.IsClosed = true
+
+	return brick
+}
+
+func (ra *RenkoAggregator) publishBar(subj string, candle *models.Bar) error {
+	data, err := json.Marshal(candle)
+	if err != nil {
+		return err
+	}
+
+	return ra.nc.Publish(subj, data)
+}
@@ -0,0 +1,71 @@
+package aggregators
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/internal/natstest"
+	"github.com/11me/calef/models"
+)
+
+func TestRenkoAggregator(t *testing.T) {
+	tests := []struct {
+		name   string
+		prices []string
+		want   []string
+	}{
+		// A brick starts with the trade completing the previous one.
+		{
+			name:   "bricks are aligned to the size",
+			prices: []string{"103", "108", "112", "125"},
+			want: []string{
+				"00:00 100/110/100/110 v3 r0 closed",
+				"00:02 110/120/110/120 v1 r0 closed",
+			},
+		},
+		{
+			name:   "a reversal needs two bricks",
+			prices: []string{"103", "112", "101", "95", "89"},
+			want: []string{
+				"00:00 100/110/100/110 v2 r0 closed",
+				"00:01 100/100/90/90 v3 r0 closed",
+			},
+		},
+		{
+			name:   "a trade completes several bricks",
+			prices: []string{"103", "131", "95"},
+			want: []string{
+				"00:00 100/110/100/110 v2 r0 closed",
+				"00:01 110/120/110/120 v0 r0 closed",
+				"00:01 120/130/120/130 v0 r0 closed",
+				"00:01 120/120/110/110 v1 r0 closed",
+				"00:02 110/110/100/100 v0 r0 closed",
+			},
+		},
+		{
+			name:   "no brick is published before it completes",
+			prices: []string{"103", "109", "91"},
+		},
+	}
+
+	spec := models.BarSpec{Type: models.BarRenko, Threshold: 10}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := natstest.Connect(t)
+			ra := NewRenkoAggregator(context.Background(), nc, "binancef", "btcusdt", spec)
+
+			msgs := published(t, nc, c.InfoBarsSubj("binancef", "btcusdt", spec), func() {
+				for i, price := range tt.prices {
+					at := t0.Add(time.Duration(i) * time.Minute)
+					if err := ra.Handle(tradeMsg(t, i, price, "1", models.SideBuy, at)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+
+			equalStrings(t, barStrings(t, msgs), tt.want)
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package aggregators
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/consumers"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+// rollupState holds the base bars of a higher timeframe bar by start.
+type rollupState struct {
+	bars     map[time.Time]models.Bar
+	closed   bool
+	revision int
+}
+
+// BarRollup builds bars of a higher timeframe from the bars of the base
+// timeframe, so only the base aggregator consumes ticks. Every base update is
+// rolled up into a live partial bar, the bar is closed with its last base bar
+// and amended when a base bar is revised afterwards.
+type BarRollup struct {
+	ctx      context.Context
+	nc       *nats.Conn
+	log      *slog.Logger
+	exchange string
+	symbol   string
+	tf       models.Timeframe
+	base     models.Timeframe
+	consumer *consumers.Consumer
+	// lateWindow is the number of closed bars amended by revised base bars.
+	lateWindow int
+
+	buckets map[time.Time]*rollupState
+	latest  time.Time
+	// partial is the first bucket when it misses base bars from before the
+	// rollup started, its bars aren't published.
+	partial time.Time
+}
+
+func NewBarRollup(ctx context.Context, nc *nats.Conn, exchange, symbol string, tf, base models.Timeframe) *BarRollup {
+	r := &BarRollup{
+		ctx:        ctx,
+		nc:         nc,
+		exchange:   exchange,
+		symbol:     symbol,
+		tf:         tf,
+		base:       base,
+		log:        slog.With("service", "BarRollup", "exchange", exchange, "symbol", symbol, "timeframe", tf.String(), "base", base.String()),
+		consumer:   consumers.NewConsumer(ctx, nc),
+		lateWindow: DefaultLateWindow,
+		buckets:    make(map[time.Time]*rollupState),
+	}
+
+	r.consumer.
+		SetConcurrency(1).
+		SetLogger(r.log).
+		Subscribe(c.BarsSubj(exchange, symbol, base), r)
+
+	return r
+}
+
+// SetLateWindow sets the number of closed bars amended by revised base bars.
+func (r *BarRollup) SetLateWindow(n int) *BarRollup {
+	if n >= 0 {
+		r.lateWindow = n
+	}
+
+	return r
+}
+
+// SetSeed continues the open bar from closed base bars, e.g. the base
+// history after a restart. Bars of other buckets are ignored.
+func (r *BarRollup) SetSeed(bars []models.Bar) *BarRollup {
+	if len(bars) == 0 {
+		return r
+	}
+
+	bucket := bars[len(bars)-1].StartTime.UTC().Truncate(time.Duration(r.tf))
+	for _, bar := range bars {
+		if bar.StartTime.UTC().Truncate(time.Duration(r.tf)).Equal(bucket) {
+			r.add(bar)
+		}
+	}
+
+	return r
+}
+
+func (r *BarRollup) Spawn() error {
+	return r.consumer.Start()
+}
+
+func (r *BarRollup) Stop() error {
+	return r.consumer.Stop()
+}
+
+func (r *BarRollup) Handle(msg *nats.Msg) error {
+	var bar models.Bar
+	if err := json.Unmarshal(msg.Data, &bar); err != nil {
+		r.log.Error("failed to parse bar", "err", err, "data", string(msg.Data))
+		return err
+	}
+
+	if bar.Exchange != r.exchange || strings.ToLower(bar.Symbol) != r.symbol {
+		return nil
+	}
+
+	if r.latest.IsZero() {
+		// Without a seed the first bucket is complete only when it starts
+		// with the first base bar.
+		if bucket := bar.StartTime.UTC().Truncate(time.Duration(r.tf)); !bar.StartTime.Equal(bucket) {
+			r.log.Info("skipping partial first bar, the base history isn't seeded", "start", bucket)
+			r.partial = bucket
+		}
+	}
+
+	st := r.add(bar)
+	if st == nil {
+		r.log.Debug("dropping base bar older than the late window", "start", bar.StartTime)
+		return nil
+	}
+
+	rolled := r.rollup(st)
+	if rolled.StartTime.Equal(r.partial) {
+		return nil
+	}
+
+	subj := c.BarsSubj(r.exchange, r.symbol, r.tf)
+	if err := r.publishBar(subj, &rolled); err != nil {
+		r.log.Error("failed to publish rolled up candle", "subject", subj, "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// add stores the base bar in its bucket and returns the bucket, or nil when
+// the bucket left the late window.
+func (r *BarRollup) add(bar models.Bar) *rollupState {
+	tf := time.Duration(r.tf)
+	start := bar.StartTime.UTC()
+	bucket := start.Truncate(tf)
+
+	if bucket.Before(r.latest.Add(-time.Duration(r.lateWindow) * tf)) {
+		return nil
+	}
+
+	st, ok := r.buckets[bucket]
+	if !ok {
+		st = &rollupState{bars: make(map[time.Time]models.Bar)}
+		r.buckets[bucket] = st
+	}
+
+	if st.closed {
+		st.revision++
+	}
+
+	bar.StartTime = start
+	st.bars[start] = bar
+
+	// The bucket closes with its last base bar.
+	if bar.IsClosed && start.Add(time.Duration(r.base)).Equal(bucket.Add(tf)) {
+		st.closed = true
+	}
+
+	if bucket.After(r.latest) {
+		r.latest = bucket
+
+		horizon := r.latest.Add(-time.Duration(r.lateWindow) * tf)
+		for b := range r.buckets {
+			if b.Before(horizon) {
+				delete(r.buckets, b)
+			}
+		}
+	}
+
+	return st
+}
+
+// rollup folds the base bars of the bucket into one bar.
+func (r *BarRollup) rollup(st *rollupState) models.Bar {
+	starts := make([]time.Time, 0, len(st.bars))
+	for start := range st.bars {
+		starts = append(starts, start)
+	}
+
+	slices.SortFunc(starts, func(a, b time.Time) int { return a.Compare(b) })
+
+	first := st.bars[starts[0]]
+	bucket := first.StartTime.Truncate(time.Duration(r.tf))
+	rolled := models.Bar{
+		Exchange:  r.exchange,
+		Symbol:    r.symbol,
+		Open:      first.Open,
+		High:      first.High,
+		Low:       first.Low,
+		StartTime: bucket,
+		EndTime:   bucket.Add(time.Duration(r.tf)),
+		IsClosed:  st.closed,
+		Revision:  st.revision,
+	}
+
+	for _, start := range starts {
+		bar := st.bars[start]
+		rolled.High = decimal.Max(rolled.High, bar.High)
+		rolled.Low = decimal.Min(rolled.Low, bar.Low)
+		rolled.Close = bar.Close
+		rolled.MergeVolume(&bar)
+
+		if rolled.FirstTradeID == "" {
+			rolled.FirstTradeID = bar.FirstTradeID
+		}
+
+		if bar.LastTradeID != "" {
+			rolled.LastTradeID = bar.LastTradeID
+		}
+	}
+
+	return rolled
+}
+
+// publishBar publishes the bar, closed bars and their revisions on the
+// closed bars subject as well.
+func (r *BarRollup) publishBar(subj string, candle *models.Bar) error {
+	data, err := json.Marshal(candle)
+	if err != nil {
+		return err
+	}
+
+	if err := r.nc.Publish(subj, data); err != nil {
+		return err
+	}
+
+	if !candle.IsClosed {
+		return nil
+	}
+
+	return r.nc.PublishMsg(c.NewClosedBarMsg(candle, r.tf, data))
+}
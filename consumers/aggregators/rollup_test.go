@@ -0,0 +1,147 @@
+package aggregators
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/internal/natstest"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+// testBar builds a btcusdt bar starting at an offset from t0 with the
+// "<o>/<h>/<l>/<c>" prices.
+func testBar(at time.Duration, tf models.Timeframe, ohlc, volume string, closed bool, revision int) models.Bar {
+	prices := strings.Split(ohlc, "/")
+	start := t0.Add(at)
+
+	return models.Bar{
+		Exchange: "binancef", Symbol: "btcusdt",
+		Open: decimal.RequireFromString(prices[0]), High: decimal.RequireFromString(prices[1]),
+		Low: decimal.RequireFromString(prices[2]), Close: decimal.RequireFromString(prices[3]),
+		Volume:    decimal.RequireFromString(volume),
+		StartTime: start, EndTime: start.Add(time.Duration(tf)),
+		IsClosed: closed, Revision: revision,
+	}
+}
+
+func barMsg(t *testing.T, subj string, bar models.Bar) *nats.Msg {
+	t.Helper()
+
+	data, err := json.Marshal(bar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &nats.Msg{Subject: subj, Data: data}
+}
+
+func TestBarRollup(t *testing.T) {
+	tf := models.Timeframe(3 * time.Minute)
+	m1 := func(at time.Duration, ohlc, volume string, closed bool, revision int) models.Bar {
+		return testBar(at, models.M1, ohlc, volume, closed, revision)
+	}
+
+	tests := []struct {
+		name       string
+		seed       []models.Bar
+		lateWindow int
+		bars       []models.Bar
+		want       []string
+	}{
+		{
+			name: "base bars roll up and close with the last one",
+			bars: []models.Bar{
+				m1(0, "100/101/99/100", "1", true, 0),
+				m1(time.Minute, "100/103/100/102", "1", false, 0),
+				m1(time.Minute, "100/103/100/102", "1", true, 0),
+				m1(2*time.Minute, "102/102/98/99", "2", true, 0),
+			},
+			want: []string{
+				"00:00 100/101/99/100 v1 r0",
+				"00:00 100/103/99/102 v2 r0",
+				"00:00 100/103/99/102 v2 r0",
+				"00:00 100/103/98/99 v4 r0 closed",
+			},
+		},
+		{
+			name: "revised base bars amend the closed bar",
+			bars: []models.Bar{
+				m1(0, "100/101/99/100", "1", true, 0),
+				m1(time.Minute, "100/103/100/102", "1", true, 0),
+				m1(2*time.Minute, "102/102/98/99", "2", true, 0),
+				m1(time.Minute, "100/104/100/102", "2", true, 1),
+			},
+			want: []string{
+				"00:00 100/101/99/100 v1 r0",
+				"00:00 100/103/99/102 v2 r0",
+				"00:00 100/103/98/99 v4 r0 closed",
+				"00:00 100/104/98/99 v5 r1 closed",
+			},
+		},
+		{
+			name: "partial first bar is skipped",
+			bars: []models.Bar{
+				m1(time.Minute, "100/101/99/100", "1", true, 0),
+				m1(2*time.Minute, "100/102/100/101", "1", true, 0),
+				m1(3*time.Minute, "101/101/97/98", "1", false, 0),
+			},
+			want: []string{
+				"00:03 101/101/97/98 v1 r0",
+			},
+		},
+		{
+			name: "seed continues the first bar",
+			seed: []models.Bar{
+				m1(-time.Minute, "90/90/90/90", "9", true, 0),
+				m1(0, "100/101/99/100", "1", true, 0),
+			},
+			bars: []models.Bar{
+				m1(time.Minute, "100/103/100/102", "1", false, 0),
+			},
+			want: []string{
+				"00:00 100/103/99/102 v2 r0",
+			},
+		},
+		{
+			name:       "base bars older than the late window are dropped",
+			lateWindow: 1,
+			bars: []models.Bar{
+				m1(0, "100/101/99/100", "1", true, 0),
+				m1(6*time.Minute, "100/100/100/100", "1", false, 0),
+				m1(0, "100/105/99/100", "1", true, 1),
+				m1(3*time.Minute, "100/100/100/100", "1", false, 0),
+			},
+			want: []string{
+				"00:00 100/101/99/100 v1 r0",
+				"00:06 100/100/100/100 v1 r0",
+				"00:03 100/100/100/100 v1 r0",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := natstest.Connect(t)
+			r := NewBarRollup(context.Background(), nc, "binancef", "btcusdt", tf, models.M1).SetSeed(tt.seed)
+			if tt.lateWindow > 0 {
+				r.SetLateWindow(tt.lateWindow)
+			}
+
+			msgs := published(t, nc, c.BarsSubj("binancef", "btcusdt", tf), func() {
+				for _, bar := range tt.bars {
+					if err := r.Handle(barMsg(t, c.BarsSubj("binancef", "btcusdt", models.M1), bar)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+
+			equalStrings(t, barStrings(t, msgs), tt.want)
+		})
+	}
+}
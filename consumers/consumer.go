@@ -8,6 +8,7 @@ import (
 	"sync"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 type Handler interface {
@@ -32,6 +33,10 @@ type Consumer struct {
 	waitHandlers sync.WaitGroup
 	sem          chan struct{}
 	done         chan struct{}
+
+	// durable binds the handlers to durable JetStream consumers when set.
+	durable  *Durable
+	consumes []jetstream.ConsumeContext
 }
 
 func NewConsumer(ctx context.Context, nc *nats.Conn) *Consumer {
@@ -58,6 +63,9 @@ func (c *Consumer) Subscribe(subject string, h Handler) *Consumer {
 
 func (c *Consumer) SetLogger(log *slog.Logger) *Consumer { c.log = log; return c }
 
+// SetConcurrency limits the handlers running at once over all subjects. With
+// a limit of one the handlers run one at a time, so state shared by them
+// needs no locking.
 func (c *Consumer) SetConcurrency(concrrency uint32) *Consumer {
 	if concrrency > 0 {
 		c.sem = make(chan struct{}, concrrency)
@@ -66,29 +74,22 @@ func (c *Consumer) SetConcurrency(concrrency uint32) *Consumer {
 	return c
 }
 
+// SetDurable binds the handlers to durable JetStream consumers instead of
+// core subscriptions.
+func (c *Consumer) SetDurable(d *Durable) *Consumer {
+	c.durable = d
+	return c
+}
+
 func (c *Consumer) Start() error {
+	if c.durable != nil {
+		return c.startDurable()
+	}
+
 	for subj, entry := range c.handlers {
 		e := entry
 		sub, err := c.nc.Subscribe(subj, func(msg *nats.Msg) {
-			if c.sem != nil {
-				c.sem <- struct{}{}
-				defer func() { <-c.sem }()
-			}
-
-			select {
-			case <-c.done:
-				c.log.Debug(fmt.Sprintf("shutting down consumer on %s", e.subj))
-				return
-			default:
-			}
-
-			c.waitHandlers.Add(1)
-			defer c.waitHandlers.Done()
-
-			if err := e.handler.Handle(msg); err != nil {
-				c.log.Error("failed to handle message", "subject", e.subj, "err", err)
-				return
-			}
+			c.handle(e, msg)
 		})
 		if err != nil {
 			return fmt.Errorf("failed to subscribe to %s: %w", subj, err)
@@ -100,6 +101,32 @@ func (c *Consumer) Start() error {
 	return nil
 }
 
+// handle runs the handler within the concurrency limit. It reports whether
+// the handler ran, it doesn't once the consumer stops, and its error.
+func (c *Consumer) handle(e *handlerEntry, msg *nats.Msg) (bool, error) {
+	if c.sem != nil {
+		c.sem <- struct{}{}
+		defer func() { <-c.sem }()
+	}
+
+	select {
+	case <-c.done:
+		c.log.Debug(fmt.Sprintf("shutting down consumer on %s", e.subj))
+		return false, nil
+	default:
+	}
+
+	c.waitHandlers.Add(1)
+	defer c.waitHandlers.Done()
+
+	if err := e.handler.Handle(msg); err != nil {
+		c.log.Error("failed to handle message", "subject", e.subj, "err", err)
+		return true, err
+	}
+
+	return true, nil
+}
+
 func (c *Consumer) Stop() error {
 	select {
 	case <-c.done:
@@ -108,6 +135,11 @@ func (c *Consumer) Stop() error {
 		close(c.done)
 	}
 
+	for _, cc := range c.consumes {
+		cc.Stop()
+		<-cc.Closed()
+	}
+
 	c.waitHandlers.Wait()
 
 	var drainErr error
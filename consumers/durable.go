@@ -0,0 +1,217 @@
+package consumers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// DeadLetterErrorHeader carries the handler error of a dead-lettered message.
+	DeadLetterErrorHeader = "Calef-Error"
+	// DeadLetterSubjectHeader carries the original subject of a dead-lettered message.
+	DeadLetterSubjectHeader = "Calef-Subject"
+
+	// DefaultMaxDeliver limits the deliveries of a message by default.
+	DefaultMaxDeliver = 5
+
+	// pullBatch bounds the messages pulled ahead of the handler.
+	pullBatch = 64
+)
+
+// Durable binds a Consumer to durable JetStream consumers, one per subscribed
+// subject, so messages published while it was down are delivered once it is
+// back. Handlers are unchanged: messages are acked when the handler succeeds
+// and redelivered when it fails. Consumers of the same name share the
+// messages, e.g. the instances of a scaled out service.
+//
+// Only pull consumers are bound, the jetstream package doesn't manage push
+// consumers. They are consumed continuously, so messages are handled as they
+// arrive like on a push consumer, and sharing them by name replaces the
+// deliver group of a push consumer.
+type Durable struct {
+	// Name prefixes the durable consumer names, the subject is appended.
+	Name string
+	// Stream binds the consumers to the stream, it is looked up by subject
+	// when empty.
+	Stream string
+	// AckWait is how long a delivery waits for its ack before it is
+	// redelivered, zero is the server default.
+	AckWait time.Duration
+	// MaxDeliver limits the deliveries of a message, zero is
+	// DefaultMaxDeliver and negative is unlimited.
+	MaxDeliver int
+	// Backoff delays the redelivery of a failed message by its delivery, the
+	// last delay repeats. Empty redelivers immediately.
+	Backoff []time.Duration
+	// DeadLetterSubj receives messages whose last delivery failed, with the
+	// error and original subject in headers.
+	DeadLetterSubj string
+}
+
+// permanentError is a handler error redelivery can't fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks the handler error as permanent, e.g. a message that can't
+// be decoded. Durable consumers dead-letter such messages at once instead of
+// redelivering them.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err: err}
+}
+
+// consumerName returns the durable name of the subject, durable names can't
+// contain dots or wildcards.
+func (d *Durable) consumerName(subj string) string {
+	r := strings.NewReplacer(".", "_", "*", "any", ">", "all")
+	return r.Replace(d.Name + "." + subj)
+}
+
+// maxDeliver returns the deliveries limit, -1 is unlimited.
+func (d *Durable) maxDeliver() int {
+	switch {
+	case d.MaxDeliver == 0:
+		return DefaultMaxDeliver
+	case d.MaxDeliver < 0:
+		return -1
+	default:
+		return d.MaxDeliver
+	}
+}
+
+// delay returns the redelivery delay of a message failed on its delivery.
+func (d *Durable) delay(delivered int) time.Duration {
+	if len(d.Backoff) == 0 {
+		return 0
+	}
+
+	return d.Backoff[min(max(delivered, 1), len(d.Backoff))-1]
+}
+
+func (d *Durable) config(subj string) jetstream.ConsumerConfig {
+	return jetstream.ConsumerConfig{
+		Durable:       d.consumerName(subj),
+		FilterSubject: subj,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		// A new durable starts with new messages, an existing one resumes.
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+		AckWait:       d.AckWait,
+		MaxDeliver:    d.maxDeliver(),
+	}
+}
+
+func (c *Consumer) startDurable() error {
+	js, err := jetstream.New(c.nc)
+	if err != nil {
+		return fmt.Errorf("failed to create jetstream context: %w", err)
+	}
+
+	for subj, entry := range c.handlers {
+		e := entry
+
+		stream := c.durable.Stream
+		if stream == "" {
+			stream, err = js.StreamNameBySubject(c.ctx, subj)
+			if err != nil {
+				return fmt.Errorf("failed to find stream of %s: %w", subj, err)
+			}
+		}
+
+		cons, err := js.CreateOrUpdateConsumer(c.ctx, stream, c.durable.config(subj))
+		if err != nil {
+			return fmt.Errorf("failed to create consumer of %s: %w", subj, err)
+		}
+
+		cc, err := cons.Consume(func(m jetstream.Msg) {
+			msg := &nats.Msg{Subject: m.Subject(), Reply: m.Reply(), Header: m.Headers(), Data: m.Data()}
+			if ran, err := c.handle(e, msg); ran {
+				c.ack(e, m, err)
+			}
+		},
+			jetstream.PullMaxMessages(pullBatch),
+			jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+				c.log.Warn("failed to consume messages", "subject", e.subj, "err", err)
+			}),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to consume %s: %w", subj, err)
+		}
+
+		c.consumes = append(c.consumes, cc)
+	}
+
+	return nil
+}
+
+// ack acknowledges the message by the handler result. Failed messages are
+// redelivered after the backoff of their delivery, the last delivery and
+// permanent failures are dead-lettered.
+func (c *Consumer) ack(e *handlerEntry, msg jetstream.Msg, handleErr error) {
+	if handleErr == nil {
+		if err := msg.Ack(); err != nil {
+			c.log.Error("failed to ack message", "subject", e.subj, "err", err)
+		}
+
+		return
+	}
+
+	delivered := 1
+	if meta, err := msg.Metadata(); err == nil {
+		delivered = int(meta.NumDelivered)
+	}
+
+	var permanent *permanentError
+	if limit := c.durable.maxDeliver(); errors.As(handleErr, &permanent) || limit > 0 && delivered >= limit {
+		c.deadLetter(e, msg, handleErr)
+
+		if err := msg.TermWithReason(handleErr.Error()); err != nil {
+			c.log.Error("failed to terminate message", "subject", e.subj, "err", err)
+		}
+
+		return
+	}
+
+	var err error
+	if delay := c.durable.delay(delivered); delay > 0 {
+		err = msg.NakWithDelay(delay)
+	} else {
+		err = msg.Nak()
+	}
+
+	if err != nil {
+		c.log.Error("failed to nak message", "subject", e.subj, "err", err)
+	}
+}
+
+func (c *Consumer) deadLetter(e *handlerEntry, msg jetstream.Msg, handleErr error) {
+	if c.durable.DeadLetterSubj == "" {
+		c.log.Warn("dropping message after the last delivery", "subject", msg.Subject(), "err", handleErr)
+		return
+	}
+
+	out := nats.NewMsg(c.durable.DeadLetterSubj)
+	out.Data = msg.Data()
+
+	for k, v := range msg.Headers() {
+		out.Header[k] = v
+	}
+
+	// The message id would be deduplicated against the original.
+	out.Header.Del(nats.MsgIdHdr)
+	out.Header.Set(DeadLetterErrorHeader, handleErr.Error())
+	out.Header.Set(DeadLetterSubjectHeader, msg.Subject())
+
+	if err := c.nc.PublishMsg(out); err != nil {
+		c.log.Error("failed to dead-letter message", "subject", e.subj, "deadLetter", out.Subject, "err", err)
+	}
+}
@@ -0,0 +1,183 @@
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/11me/calef/config"
+	"github.com/11me/calef/models"
+)
+
+// Adapter hides venue specifics of public market data streams.
+type Adapter interface {
+	// Name returns the venue name, it is used as the subject prefix.
+	Name() string
+
+	// URL returns the websocket endpoint to dial.
+	URL() string
+
+	// SubscribeMessages returns the messages to send in order to receive
+	// the streams. The id is echoed back by venues that acknowledge
+	// requests. Channels the venue doesn't provide yield ErrUnsupportedChannel.
+	SubscribeMessages(id uint64, streams []Stream) ([]any, error)
+
+	// UnsubscribeMessages returns the messages to send in order to stop
+	// receiving the streams.
+	UnsubscribeMessages(id uint64, streams []Stream) ([]any, error)
+
+	// Normalize decodes a raw websocket frame.
+	Normalize(data []byte) (Frame, error)
+}
+
+// Frame is a decoded websocket frame. Frames of no interest (heartbeats etc.)
+// are empty.
+type Frame struct {
+	Trades []models.Trade
+	Depth  []models.DepthUpdate
+	Quotes []models.Quote
+	Marks  []models.MarkPrice
+	// Liquidations are forced orders of liquidated positions.
+	Liquidations []models.Liquidation
+	Klines       []models.Kline
+	// Ack is set when the frame is a response to a (un)subscribe request.
+	Ack *Ack
+}
+
+// Ack is a venue response to a (un)subscribe request.
+type Ack struct {
+	ID  uint64
+	Err error
+}
+
+// Acknowledger is implemented by adapters whose venue answers every
+// (un)subscribe message with an Ack carrying the request id.
+type Acknowledger interface {
+	Acknowledges() bool
+}
+
+// Opener is implemented by adapters whose venue expects messages once per
+// connection before any subscription, e.g. to connection-wide channels.
+type Opener interface {
+	OpenMessages() []any
+}
+
+// Pinger is implemented by adapters whose venue expects application level
+// heartbeats on an otherwise idle connection.
+type Pinger interface {
+	// PingMessage returns the text frame to send and how often to send it.
+	PingMessage() ([]byte, time.Duration)
+}
+
+// Limits are per connection limits of a venue, zero means unlimited.
+type Limits struct {
+	// MaxStreams is the number of symbols a single connection may stream.
+	MaxStreams int
+	// MaxMessagesPerSecond limits messages sent to the venue.
+	MaxMessagesPerSecond int
+	// MaxLifetime is the age at which the venue force-closes a connection.
+	MaxLifetime time.Duration
+}
+
+// Limiter is implemented by adapters whose venue limits connections.
+type Limiter interface {
+	Limits() Limits
+}
+
+// Sequencer is implemented by adapters whose trade ids are consecutive
+// integers per symbol, which allows dropping duplicates and detecting gaps.
+type Sequencer interface {
+	Seq(trade *models.Trade) (int64, error)
+}
+
+// Backfiller is implemented by adapters able to fetch missed trades over REST.
+type Backfiller interface {
+	// Backfill returns trades of the symbol with sequence numbers in [from, to].
+	Backfill(ctx context.Context, symbol string, from, to int64) ([]models.Trade, error)
+}
+
+// DepthSnapshotter is implemented by adapters able to fetch an order book
+// snapshot that depth diffs are applied to.
+type DepthSnapshotter interface {
+	DepthSnapshot(ctx context.Context, symbol string) (models.OrderBook, error)
+}
+
+// OpenInterestFetcher is implemented by adapters able to fetch the open
+// interest of a symbol, open interest streams are polled with it.
+type OpenInterestFetcher interface {
+	OpenInterest(ctx context.Context, symbol string) (models.OpenInterest, error)
+}
+
+// KlineFetcher is implemented by adapters able to fetch the latest klines of
+// a symbol, oldest first. The last one may still be open.
+type KlineFetcher interface {
+	Klines(ctx context.Context, symbol string, tf models.Timeframe, limit int) ([]models.Kline, error)
+}
+
+type AdapterFactory func(conf *config.Exchange) Adapter
+
+var (
+	adaptersMu sync.RWMutex
+	adapters   = make(map[string]AdapterFactory)
+)
+
+// Register makes an adapter available by name. It panics if the name is
+// registered twice.
+func Register(name string, factory AdapterFactory) {
+	adaptersMu.Lock()
+	defer adaptersMu.Unlock()
+
+	if _, exists := adapters[name]; exists {
+		panic("exchange: adapter registered twice: " + name)
+	}
+
+	adapters[name] = factory
+}
+
+// NewAdapter creates a registered adapter by name.
+func NewAdapter(name string, conf *config.Exchange) (Adapter, error) {
+	adaptersMu.RLock()
+	factory, ok := adapters[name]
+	adaptersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown exchange %q, available: %v", name, Adapters())
+	}
+
+	return factory(conf), nil
+}
+
+// endpoint returns the configured override for the adapter or the default URL.
+func endpoint(conf *config.Exchange, name, defaultURL string) string {
+	if u, ok := conf.URLs[name]; ok && u != "" {
+		return u
+	}
+
+	return defaultURL
+}
+
+// restEndpoint returns the configured REST override for the adapter or the default URL.
+func restEndpoint(conf *config.Exchange, name, defaultURL string) string {
+	if u, ok := conf.RestURLs[name]; ok && u != "" {
+		return u
+	}
+
+	return defaultURL
+}
+
+// Adapters returns sorted names of the registered adapters.
+func Adapters() []string {
+	adaptersMu.RLock()
+	defer adaptersMu.RUnlock()
+
+	names := make([]string, 0, len(adapters))
+	for name := range adapters {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,32 @@
+package exchange
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	backoffMin = 500 * time.Millisecond
+	backoffMax = 30 * time.Second
+)
+
+// backoff yields exponentially growing delays with jitter, so that
+// connections don't retry in lockstep.
+type backoff struct {
+	attempt int
+}
+
+// next returns a random delay in [d/2, d) where d doubles every attempt up
+// to backoffMax.
+func (b *backoff) next() time.Duration {
+	d := backoffMax
+	if b.attempt < 16 {
+		d = min(backoffMin<<b.attempt, backoffMax)
+	}
+
+	b.attempt++
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+func (b *backoff) reset() { b.attempt = 0 }
@@ -3,176 +3,705 @@ package exchange
 import (
 	"context"
 	"fmt"
-	"log/slog"
-	"math/rand"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/11me/calef/common"
 	"github.com/11me/calef/config"
-	"github.com/gorilla/websocket"
-	"github.com/nats-io/nats.go"
+	"github.com/11me/calef/models"
+	"github.com/shopspring/decimal"
 	"github.com/valyala/fastjson"
 )
 
 const (
-	binanceWsBaseUrl = "wss://stream.binance.com:9443/ws"
+	binanceWsBaseUrl      = "wss://stream.binance.com:9443/ws"
+	binanceUSDMWsBaseUrl  = "wss://fstream.binance.com/ws"
+	binanceCOINMWsBaseUrl = "wss://dstream.binance.com/ws"
+
+	binanceRestBaseUrl      = "https://api.binance.com"
+	binanceUSDMRestBaseUrl  = "https://fapi.binance.com"
+	binanceCOINMRestBaseUrl = "https://dapi.binance.com"
+
+	// binanceAggTradesLimit is the maximum page size of the aggTrades endpoint.
+	binanceAggTradesLimit = 1000
+	// binanceMaxBackfillPages bounds a single backfill.
+	binanceMaxBackfillPages = 10
+	// binanceDepthLimit is the number of levels per side of a depth snapshot.
+	binanceDepthLimit = 1000
+	// binanceKlinesLimit is the maximum page size of the klines endpoint.
+	binanceKlinesLimit = 1000
+
+	// binanceMaxLifetime is the age at which binance disconnects a connection.
+	binanceMaxLifetime = 24 * time.Hour
 )
 
-type BinanceConsumer struct {
-	ctx     context.Context
-	conf    *config.Config
-	log     *slog.Logger
-	nc      *nats.Conn
-	conn    *websocket.Conn
-	symbols []string
-	errCh   chan error
+// binanceIntervals are the kline intervals binance streams.
+var binanceIntervals = map[string]bool{
+	"1s": true, "1m": true, "3m": true, "5m": true, "15m": true, "30m": true,
+	"1h": true, "2h": true, "4h": true, "6h": true, "8h": true, "12h": true,
+	"1d": true, "3d": true, "1w": true,
 }
 
-func NewBinanceConsumer(ctx context.Context, nc *nats.Conn) *BinanceConsumer {
-	return &BinanceConsumer{
-		ctx:   ctx,
-		nc:    nc,
-		log:   slog.With("service", "BinanceConsumer"),
-		errCh: make(chan error),
+// BinanceMarket selects the binance market to stream from.
+type BinanceMarket int
+
+const (
+	BinanceSpot BinanceMarket = iota
+	// BinanceUSDM is the USD-M (USDT margined) futures market.
+	BinanceUSDM
+	// BinanceCOINM is the COIN-M (coin margined) futures market.
+	BinanceCOINM
+)
+
+// Name returns the subject prefix of the market.
+func (m BinanceMarket) Name() string {
+	switch m {
+	case BinanceUSDM:
+		return common.BinanceFutures
+	case BinanceCOINM:
+		return common.BinanceCoinFutures
+	default:
+		return common.BinanceSpot
 	}
+}
 
+func (m BinanceMarket) wsBaseUrl() string {
+	switch m {
+	case BinanceUSDM:
+		return binanceUSDMWsBaseUrl
+	case BinanceCOINM:
+		return binanceCOINMWsBaseUrl
+	default:
+		return binanceWsBaseUrl
+	}
 }
 
-func (c *BinanceConsumer) Start() error {
-	c.log.Info("starting binance consumer")
+func (m BinanceMarket) restBaseUrl() string {
+	switch m {
+	case BinanceUSDM:
+		return binanceUSDMRestBaseUrl
+	case BinanceCOINM:
+		return binanceCOINMRestBaseUrl
+	default:
+		return binanceRestBaseUrl
+	}
+}
 
-	conn, err := c.connect()
-	if err != nil {
-		return err
+// restPrefix returns the path prefix of the market REST API.
+func (m BinanceMarket) restPrefix() string {
+	switch m {
+	case BinanceUSDM:
+		return "/fapi/v1"
+	case BinanceCOINM:
+		return "/dapi/v1"
+	default:
+		return "/api/v3"
+	}
+}
+
+func (m BinanceMarket) limits() Limits {
+	switch m {
+	case BinanceUSDM:
+		return Limits{MaxStreams: 1024, MaxMessagesPerSecond: 10, MaxLifetime: binanceMaxLifetime}
+	case BinanceCOINM:
+		return Limits{MaxStreams: 200, MaxMessagesPerSecond: 10, MaxLifetime: binanceMaxLifetime}
+	default:
+		return Limits{MaxStreams: 1024, MaxMessagesPerSecond: 5, MaxLifetime: binanceMaxLifetime}
+	}
+}
+
+func init() {
+	for _, market := range []BinanceMarket{BinanceSpot, BinanceUSDM, BinanceCOINM} {
+		Register(market.Name(), func(conf *config.Exchange) Adapter {
+			a := NewBinanceAdapter(market)
+			a.BaseURL = endpoint(conf, market.Name(), a.BaseURL)
+			a.RestURL = restEndpoint(conf, market.Name(), a.RestURL)
+
+			return a
+		})
+	}
+}
+
+// BinanceAdapter streams aggregated trades from a binance market.
+type BinanceAdapter struct {
+	// BaseURL is the websocket endpoint, it can be replaced to point
+	// to a local server.
+	BaseURL string
+	// RestURL is the REST endpoint, it can be replaced to point
+	// to a local server.
+	RestURL string
+	Market  BinanceMarket
+	client  *http.Client
+}
+
+func NewBinanceAdapter(market BinanceMarket) *BinanceAdapter {
+	return &BinanceAdapter{
+		BaseURL: market.wsBaseUrl(),
+		RestURL: market.restBaseUrl(),
+		Market:  market,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (a *BinanceAdapter) Name() string { return a.Market.Name() }
+
+func (a *BinanceAdapter) URL() string { return a.BaseURL }
+
+func (a *BinanceAdapter) Acknowledges() bool { return true }
+
+func (a *BinanceAdapter) Limits() Limits { return a.Market.limits() }
+
+func (a *BinanceAdapter) SubscribeMessages(id uint64, streams []Stream) ([]any, error) {
+	return a.request("SUBSCRIBE", id, streams)
+}
+
+func (a *BinanceAdapter) UnsubscribeMessages(id uint64, streams []Stream) ([]any, error) {
+	return a.request("UNSUBSCRIBE", id, streams)
+}
+
+func (a *BinanceAdapter) request(method string, id uint64, streams []Stream) ([]any, error) {
+	params := make([]string, 0, len(streams))
+	for _, stream := range streams {
+		name, err := a.streamName(stream)
+		if err != nil {
+			return nil, err
+		}
+
+		params = append(params, name)
 	}
 
-	c.conn = conn
+	return []any{map[string]any{
+		"method": method,
+		"params": params,
+		"id":     id,
+	}}, nil
+}
 
-	c.log.Info("connected to binance")
+func (a *BinanceAdapter) streamName(stream Stream) (string, error) {
+	symbol := strings.ToLower(stream.Symbol)
+
+	switch stream.Channel {
+	case ChannelTrades:
+		return symbol + "@aggTrade", nil
+	case ChannelDepth:
+		return symbol + "@depth@100ms", nil
+	case ChannelQuotes:
+		return symbol + "@bookTicker", nil
+	case ChannelMarkPrice:
+		if a.Market == BinanceSpot {
+			break
+		}
+
+		return symbol + "@markPrice@1s", nil
+	case ChannelLiquidations:
+		if a.Market == BinanceSpot {
+			break
+		}
 
-	go c.reconnect()
-	go c.readTicks()
+		return symbol + "@forceOrder", nil
+	case ChannelKlines:
+		interval := stream.Timeframe.String()
+		if !binanceIntervals[interval] {
+			return "", fmt.Errorf("%s klines of %s: %w", a.Name(), interval, ErrUnsupportedChannel)
+		}
 
-	// TODO: wait all goroutines to finish.
-	select {
-	case <-c.ctx.Done():
-		return nil
+		return symbol + "@kline_" + interval, nil
 	}
+
+	return "", fmt.Errorf("%s %s: %w", a.Name(), stream.Channel, ErrUnsupportedChannel)
 }
 
-func (c *BinanceConsumer) connect() (*websocket.Conn, error) {
-	c.log.Info(fmt.Sprintf("connecting to binance %q", binanceWsBaseUrl))
+func (a *BinanceAdapter) Normalize(data []byte) (Frame, error) {
+	parser := fastjson.Parser{}
 
-	conn, _, err := websocket.DefaultDialer.DialContext(c.ctx, binanceWsBaseUrl, nil)
+	val, err := parser.ParseBytes(data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial binance: %w", err)
+		return Frame{}, err
 	}
 
-	params := make([]string, 0, len(c.symbols))
-	for _, symbol := range c.symbols {
-		params = append(params, symbol+"@aggTrade")
+	// Response for (un)subscription: {"result":null,"id":1} or
+	// {"error":{"code":2,"msg":"..."},"id":1}.
+	if val.Exists("id") {
+		ack := &Ack{ID: val.GetUint64("id")}
+		if val.Exists("error") {
+			ack.Err = fmt.Errorf("binance request failed: %s (code %d)", val.GetStringBytes("error", "msg"), val.GetInt("error", "code"))
+		}
+
+		return Frame{Ack: ack}, nil
 	}
 
-	if len(params) > 0 {
-		err := conn.WriteJSON(map[string]any{
-			"method": "SUBSCRIBE",
-			"params": params,
-		})
+	switch string(val.GetStringBytes("e")) {
+	case "aggTrade":
+		trade, err := a.trade(string(val.GetStringBytes("s")), val)
+		if err != nil {
+			return Frame{}, err
+		}
+
+		return Frame{Trades: []models.Trade{trade}}, nil
+	case "depthUpdate":
+		update, err := a.depthUpdate(val)
 		if err != nil {
-			return nil, fmt.Errorf("failed to subscribe to tickers on binance: %w", err)
+			return Frame{}, err
 		}
+
+		return Frame{Depth: []models.DepthUpdate{update}}, nil
+	case "bookTicker":
+		return a.quoteFrame(val)
+	case "markPriceUpdate":
+		mark, err := a.markPrice(val)
+		if err != nil {
+			return Frame{}, err
+		}
+
+		return Frame{Marks: []models.MarkPrice{mark}}, nil
+	case "kline":
+		kline, err := a.kline(val)
+		if err != nil {
+			return Frame{}, err
+		}
+
+		return Frame{Klines: []models.Kline{kline}}, nil
+	case "forceOrder":
+		liquidation, err := a.liquidation(val)
+		if err != nil {
+			return Frame{}, err
+		}
+
+		return Frame{Liquidations: []models.Liquidation{liquidation}}, nil
+	case "":
+		// Spot book tickers carry no event type.
+		if val.Exists("u") && val.Exists("b") && val.Exists("a") {
+			return a.quoteFrame(val)
+		}
+
+		return Frame{}, nil
+	default:
+		return Frame{}, nil
 	}
+}
 
-	return conn, nil
+func (a *BinanceAdapter) quoteFrame(val *fastjson.Value) (Frame, error) {
+	quote, err := a.quote(val)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	return Frame{Quotes: []models.Quote{quote}}, nil
 }
 
-func (c *BinanceConsumer) reconnect() {
-	for {
-		err := <-c.errCh
+func (a *BinanceAdapter) quote(val *fastjson.Value) (models.Quote, error) {
+	values, err := binanceDecimals(val, "b", "B", "a", "A")
+	if err != nil {
+		return models.Quote{}, fmt.Errorf("failed to parse book ticker: %w", err)
+	}
 
-		if err == nil {
-			// App shutdown, errCh was closed.
-			select {
-			case <-c.ctx.Done():
-				return
-			default: // Proceed reconnection loop.
-			}
-		}
+	quote := models.Quote{
+		Exchange: a.Name(),
+		Symbol:   strings.ToLower(string(val.GetStringBytes("s"))),
+		BidPrice: values[0],
+		BidQty:   values[1],
+		AskPrice: values[2],
+		AskQty:   values[3],
+		UpdateID: val.GetInt64("u"),
+	}
 
-		c.log.Error(fmt.Sprintf("binance connection was closed with error: %v, reconnection", err))
+	// Only futures book tickers carry the event time.
+	if val.Exists("E") {
+		quote.ExchangeTime = time.UnixMilli(val.GetInt64("E"))
+	}
 
-		var conn *websocket.Conn
+	return quote, nil
+}
 
-		for {
-			var connErr error
+func (a *BinanceAdapter) depthUpdate(val *fastjson.Value) (models.DepthUpdate, error) {
+	bids, err := binanceLevels(val.GetArray("b"))
+	if err != nil {
+		return models.DepthUpdate{}, err
+	}
 
-			conn, connErr = c.connect()
-			if connErr != nil {
-				timeout := time.Second * time.Duration(1+rand.Intn(3))
-				c.log.Error(fmt.Sprintf("error reconnection to binance: %v, next retry in %v", connErr, timeout))
+	asks, err := binanceLevels(val.GetArray("a"))
+	if err != nil {
+		return models.DepthUpdate{}, err
+	}
 
-				select {
-				case <-c.ctx.Done():
-					return
-				case <-time.After(timeout):
-				}
+	return models.DepthUpdate{
+		Exchange:      a.Name(),
+		Symbol:        strings.ToLower(string(val.GetStringBytes("s"))),
+		FirstUpdateID: val.GetInt64("U"),
+		FinalUpdateID: val.GetInt64("u"),
+		// Only futures streams carry "pu".
+		PrevFinalUpdateID: val.GetInt64("pu"),
+		Bids:              bids,
+		Asks:              asks,
+		ExchangeTime:      time.UnixMilli(val.GetInt64("E")),
+	}, nil
+}
 
-				continue
-			}
+func (a *BinanceAdapter) markPrice(val *fastjson.Value) (models.MarkPrice, error) {
+	values, err := binanceDecimals(val, "p", "i", "r")
+	if err != nil {
+		return models.MarkPrice{}, fmt.Errorf("failed to parse mark price: %w", err)
+	}
 
-			// Success.
-			break
-		}
+	return models.MarkPrice{
+		Exchange:        a.Name(),
+		Symbol:          strings.ToLower(string(val.GetStringBytes("s"))),
+		MarkPrice:       values[0],
+		IndexPrice:      values[1],
+		FundingRate:     values[2],
+		NextFundingTime: time.UnixMilli(val.GetInt64("T")),
+		ExchangeTime:    time.UnixMilli(val.GetInt64("E")),
+	}, nil
+}
+
+func (a *BinanceAdapter) liquidation(val *fastjson.Value) (models.Liquidation, error) {
+	order := val.Get("o")
+	if order == nil {
+		return models.Liquidation{}, fmt.Errorf("force order without order: %s", val)
+	}
+
+	values, err := binanceDecimals(order, "p", "ap", "q")
+	if err != nil {
+		return models.Liquidation{}, fmt.Errorf("failed to parse force order: %w", err)
+	}
+
+	side := models.SideBuy
+	if string(order.GetStringBytes("S")) == "SELL" {
+		side = models.SideSell
+	}
+
+	return models.Liquidation{
+		Exchange:     a.Name(),
+		Symbol:       strings.ToLower(string(order.GetStringBytes("s"))),
+		Side:         side,
+		Price:        values[0],
+		AvgPrice:     values[1],
+		Quantity:     values[2],
+		Status:       string(order.GetStringBytes("X")),
+		ExchangeTime: time.UnixMilli(order.GetInt64("T")),
+	}, nil
+}
+
+func (a *BinanceAdapter) kline(val *fastjson.Value) (models.Kline, error) {
+	k := val.Get("k")
+	if k == nil {
+		return models.Kline{}, fmt.Errorf("kline event without kline: %s", val)
+	}
+
+	tf, err := models.ParseTimeframe(string(k.GetStringBytes("i")))
+	if err != nil {
+		return models.Kline{}, fmt.Errorf("failed to parse kline interval: %w", err)
+	}
+
+	values, err := binanceDecimals(k, "o", "h", "l", "c", "v", "q", "V")
+	if err != nil {
+		return models.Kline{}, fmt.Errorf("failed to parse kline: %w", err)
+	}
 
-		c.conn = conn
+	bar := models.Bar{
+		Exchange:    a.Name(),
+		Symbol:      strings.ToLower(string(k.GetStringBytes("s"))),
+		Open:        values[0],
+		High:        values[1],
+		Low:         values[2],
+		Close:       values[3],
+		Volume:      values[4],
+		QuoteVolume: values[5],
+		BuyVolume:   values[6],
+		SellVolume:  values[4].Sub(values[6]),
+		Trades:      k.GetInt64("n"),
+		IsClosed:    k.GetBool("x"),
+		StartTime:   time.UnixMilli(k.GetInt64("t")),
+		// The close time is the last millisecond of the interval.
+		EndTime: time.UnixMilli(k.GetInt64("T") + 1),
+	}
 
-		c.log.Info("Succesfully reconnected to binance")
+	// Trade ids are -1 without trades.
+	if bar.Trades > 0 {
+		bar.FirstTradeID = strconv.FormatInt(k.GetInt64("f"), 10)
+		bar.LastTradeID = strconv.FormatInt(k.GetInt64("L"), 10)
+	}
+
+	bar.UpdateVWAP()
+
+	return models.Kline{Bar: bar, Timeframe: tf}, nil
+}
 
-		go c.readTicks()
+// binanceDecimals parses the string encoded decimal fields of val exactly.
+func binanceDecimals(val *fastjson.Value, fields ...string) ([]decimal.Decimal, error) {
+	values := make([]decimal.Decimal, len(fields))
+
+	for i, field := range fields {
+		v, err := decimal.NewFromString(string(val.GetStringBytes(field)))
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", field, err)
+		}
+
+		values[i] = v
 	}
+
+	return values, nil
 }
 
-func (c *BinanceConsumer) readTicks() {
-	for {
-		select {
-		case <-c.ctx.Done():
-			return
-		default:
+// binanceLevels parses [["price","qty"], ...] price levels.
+func binanceLevels(items []*fastjson.Value) ([]models.PriceLevel, error) {
+	levels := make([]models.PriceLevel, 0, len(items))
+
+	for _, item := range items {
+		pair := item.GetArray()
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid price level %s", item)
 		}
 
-		_, msg, err := c.conn.ReadMessage()
+		price, err := decimal.NewFromString(string(pair[0].GetStringBytes()))
 		if err != nil {
-			c.log.Error(fmt.Sprintf("error reading message for symbol: %v", err))
-			c.errCh <- err
+			return nil, fmt.Errorf("failed to parse level price: %w", err)
+		}
 
-			return
+		quantity, err := decimal.NewFromString(string(pair[1].GetStringBytes()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse level quantity: %w", err)
 		}
 
-		parser := fastjson.Parser{}
+		levels = append(levels, models.PriceLevel{Price: price, Quantity: quantity})
+	}
+
+	return levels, nil
+}
+
+// trade converts an aggregated trade, the stream and the REST API share field names.
+func (a *BinanceAdapter) trade(symbol string, val *fastjson.Value) (models.Trade, error) {
+	price, err := decimal.NewFromString(string(val.GetStringBytes("p")))
+	if err != nil {
+		return models.Trade{}, fmt.Errorf("failed to parse price: %w", err)
+	}
+
+	quantity, err := decimal.NewFromString(string(val.GetStringBytes("q")))
+	if err != nil {
+		return models.Trade{}, fmt.Errorf("failed to parse quantity: %w", err)
+	}
+
+	// "m" is set when the buyer is the maker, i.e. the seller was the aggressor.
+	side := models.SideBuy
+	if val.GetBool("m") {
+		side = models.SideSell
+	}
+
+	return models.Trade{
+		Exchange:     a.Name(),
+		Symbol:       strings.ToLower(symbol),
+		Price:        price,
+		Quantity:     quantity,
+		Side:         side,
+		TradeID:      strconv.FormatInt(val.GetInt64("a"), 10),
+		ExchangeTime: time.UnixMilli(val.GetInt64("T")),
+	}, nil
+}
+
+func (a *BinanceAdapter) Seq(trade *models.Trade) (int64, error) {
+	return strconv.ParseInt(trade.TradeID, 10, 64)
+}
+
+func (a *BinanceAdapter) Backfill(ctx context.Context, symbol string, from, to int64) ([]models.Trade, error) {
+	var trades []models.Trade
+
+	for page := 0; page < binanceMaxBackfillPages && from <= to; page++ {
+		query := url.Values{}
+		query.Set("symbol", strings.ToUpper(symbol))
+		query.Set("fromId", strconv.FormatInt(from, 10))
+		query.Set("limit", strconv.Itoa(binanceAggTradesLimit))
 
-		val, err := parser.ParseBytes(msg)
+		val, err := a.get(ctx, "/aggTrades", query)
 		if err != nil {
-			c.log.Error("failed to parse json", "value", string(msg), "err", err)
+			return trades, err
+		}
 
-			continue
+		items := val.GetArray()
+		if len(items) == 0 {
+			break
 		}
 
-		res := val.Get("result")
-		if res != nil {
-			// Ignore response for subscription.
-			continue
+		for _, item := range items {
+			id := item.GetInt64("a")
+			if id > to {
+				return trades, nil
+			}
+
+			trade, err := a.trade(symbol, item)
+			if err != nil {
+				return trades, err
+			}
+
+			trades = append(trades, trade)
+			from = id + 1
 		}
+	}
 
-		symbol := val.Get("s")
-		subj := common.BinanceTicksSubj(string(symbol.GetStringBytes()))
+	if from <= to {
+		return trades, fmt.Errorf("backfill stopped at trade %d of %d", from, to)
+	}
 
-		err = c.nc.Publish(subj, msg)
-		if err != nil {
-			c.log.Error("failed to publish message to subject", "subject", subj, "err", err)
+	return trades, nil
+}
+
+func (a *BinanceAdapter) DepthSnapshot(ctx context.Context, symbol string) (models.OrderBook, error) {
+	query := url.Values{}
+	query.Set("symbol", strings.ToUpper(symbol))
+	query.Set("limit", strconv.Itoa(binanceDepthLimit))
+
+	val, err := a.get(ctx, "/depth", query)
+	if err != nil {
+		return models.OrderBook{}, err
+	}
+
+	bids, err := binanceLevels(val.GetArray("bids"))
+	if err != nil {
+		return models.OrderBook{}, err
+	}
+
+	asks, err := binanceLevels(val.GetArray("asks"))
+	if err != nil {
+		return models.OrderBook{}, err
+	}
+
+	book := models.OrderBook{
+		Exchange:     a.Name(),
+		Symbol:       strings.ToLower(symbol),
+		LastUpdateID: val.GetInt64("lastUpdateId"),
+		Bids:         bids,
+		Asks:         asks,
+	}
+
+	// Only futures snapshots carry the event time.
+	if ms := val.GetInt64("E"); ms > 0 {
+		book.ExchangeTime = time.UnixMilli(ms)
+	}
+
+	return book, nil
+}
+
+// OpenInterest fetches the open interest of a futures symbol.
+func (a *BinanceAdapter) OpenInterest(ctx context.Context, symbol string) (models.OpenInterest, error) {
+	if a.Market == BinanceSpot {
+		return models.OpenInterest{}, fmt.Errorf("%s %s: %w", a.Name(), ChannelOpenInterest, ErrUnsupportedChannel)
+	}
+
+	query := url.Values{}
+	query.Set("symbol", strings.ToUpper(symbol))
+
+	val, err := a.get(ctx, "/openInterest", query)
+	if err != nil {
+		return models.OpenInterest{}, err
+	}
+
+	values, err := binanceDecimals(val, "openInterest")
+	if err != nil {
+		return models.OpenInterest{}, fmt.Errorf("failed to parse open interest: %w", err)
+	}
+
+	return models.OpenInterest{
+		Exchange:     a.Name(),
+		Symbol:       strings.ToLower(symbol),
+		OpenInterest: values[0],
+		ExchangeTime: time.UnixMilli(val.GetInt64("time")),
+	}, nil
+}
+
+// Klines fetches the latest klines of the symbol, at most binanceKlinesLimit.
+func (a *BinanceAdapter) Klines(ctx context.Context, symbol string, tf models.Timeframe, limit int) ([]models.Kline, error) {
+	interval := tf.String()
+	if !binanceIntervals[interval] {
+		return nil, fmt.Errorf("%s klines of %s: %w", a.Name(), interval, ErrUnsupportedChannel)
+	}
+
+	query := url.Values{}
+	query.Set("symbol", strings.ToUpper(symbol))
+	query.Set("interval", interval)
+	query.Set("limit", strconv.Itoa(min(limit, binanceKlinesLimit)))
+
+	val, err := a.get(ctx, "/klines", query)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	items := val.GetArray()
+	klines := make([]models.Kline, 0, len(items))
+
+	// [openTime, "open", "high", "low", "close", "volume", closeTime,
+	// "quoteVolume", trades, "takerBuyVolume", "takerBuyQuoteVolume", ...]
+	for _, item := range items {
+		fields := item.GetArray()
+		if len(fields) < 10 {
+			return nil, fmt.Errorf("invalid kline %s", item)
+		}
+
+		var values [7]decimal.Decimal
+		for i, field := range []int{1, 2, 3, 4, 5, 7, 9} {
+			v, err := decimal.NewFromString(string(fields[field].GetStringBytes()))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse kline: %w", err)
+			}
+
+			values[i] = v
 		}
+
+		closeTime := time.UnixMilli(fields[6].GetInt64())
+
+		bar := models.Bar{
+			Exchange:    a.Name(),
+			Symbol:      strings.ToLower(symbol),
+			Open:        values[0],
+			High:        values[1],
+			Low:         values[2],
+			Close:       values[3],
+			Volume:      values[4],
+			QuoteVolume: values[5],
+			BuyVolume:   values[6],
+			SellVolume:  values[4].Sub(values[6]),
+			Trades:      fields[8].GetInt64(),
+			IsClosed:    closeTime.Before(now),
+			StartTime:   time.UnixMilli(fields[0].GetInt64()),
+			EndTime:     closeTime.Add(time.Millisecond),
+		}
+
+		bar.UpdateVWAP()
+
+		klines = append(klines, models.Kline{Bar: bar, Timeframe: tf})
 	}
+
+	return klines, nil
 }
 
-func (c *BinanceConsumer) SubscribeTicks(symbols ...string) {
-	c.symbols = append(c.symbols, symbols...)
+// get requests a market REST endpoint and parses the JSON response.
+func (a *BinanceAdapter) get(ctx context.Context, path string, query url.Values) (*fastjson.Value, error) {
+	u := a.RestURL + a.Market.restPrefix() + path + "?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", path, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("binance %s responded %d: %s", path, resp.StatusCode, body)
+	}
+
+	parser := fastjson.Parser{}
+
+	return parser.ParseBytes(body)
 }
@@ -0,0 +1,214 @@
+package exchange
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/11me/calef/common"
+	"github.com/11me/calef/models"
+	"github.com/gorilla/websocket"
+)
+
+// binanceAck answers binance (un)subscribe requests.
+func binanceAck(t *testing.T, conn *websocket.Conn) bool {
+	var req struct {
+		ID uint64 `json:"id"`
+	}
+	if !readJSON(t, conn, &req) {
+		return false
+	}
+
+	return conn.WriteJSON(map[string]any{"result": nil, "id": req.ID}) == nil
+}
+
+func TestBinanceBackfillGap(t *testing.T) {
+	recorded := frames(t, "binance_backfill.txt")
+
+	server := newStandIn(t, func(n int, conn *websocket.Conn) {
+		if !binanceAck(t, conn) {
+			return
+		}
+
+		// 101 and 100 are redelivered, 102-104 are missed.
+		for _, name := range []string{"trade-100", "trade-101", "trade-101", "trade-105", "trade-100"} {
+			conn.WriteMessage(websocket.TextMessage, []byte(recorded[name]))
+		}
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+
+	queries := make(chan string, 4)
+	rest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fapi/v1/aggTrades" {
+			http.NotFound(w, r)
+			return
+		}
+
+		queries <- r.URL.RawQuery
+		w.Write([]byte(recorded["aggtrades"]))
+	}))
+	t.Cleanup(rest.Close)
+
+	adapter := NewBinanceAdapter(BinanceUSDM)
+	adapter.BaseURL = server.wsURL()
+	adapter.RestURL = rest.URL
+
+	c, nc := newTestConsumer(t, adapter)
+	c.SetBackfill(true)
+
+	ticks := collect(t, nc, common.TicksSubj(adapter.Name(), "btcusdt"))
+	gaps := collect(t, nc, common.GapEventsSubj(adapter.Name()))
+
+	if err := c.Acquire(TradeStreams("btcusdt")...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Live trades go first, the backfill follows in order up to the trade
+	// revealing the gap.
+	for _, want := range []string{"100", "101", "105", "102", "103", "104"} {
+		trade, err := common.DecodeTrade(next(t, ticks))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if trade.TradeID != want {
+			t.Fatalf("got trade %s, want %s", trade.TradeID, want)
+		}
+	}
+
+	if q := <-queries; q != "fromId=102&limit=1000&symbol=BTCUSDT" {
+		t.Errorf("unexpected backfill query %q", q)
+	}
+
+	var gap models.GapEvent
+	if err := json.Unmarshal(next(t, gaps).Data, &gap); err != nil {
+		t.Fatal(err)
+	}
+
+	if gap.Symbol != "btcusdt" || gap.FromTradeID != 102 || gap.ToTradeID != 104 || gap.Backfilled != 3 || gap.Error != "" {
+		t.Errorf("unexpected gap event %+v", gap)
+	}
+
+	select {
+	case msg := <-ticks:
+		t.Fatalf("unexpected trade %s", msg.Data)
+	default:
+	}
+}
+
+func TestBinanceDepthSync(t *testing.T) {
+	recorded := frames(t, "binance_depth.txt")
+	resync := make(chan struct{})
+
+	server := newStandIn(t, func(n int, conn *websocket.Conn) {
+		if !binanceAck(t, conn) {
+			return
+		}
+
+		for _, name := range []string{"diff-95", "diff-101", "diff-104"} {
+			conn.WriteMessage(websocket.TextMessage, []byte(recorded[name]))
+		}
+
+		// diff-110 skips updates, the book is synced again from the second
+		// snapshot.
+		select {
+		case <-resync:
+		case <-time.After(5 * time.Second):
+			return
+		}
+
+		for _, name := range []string{"diff-110", "diff-113"} {
+			conn.WriteMessage(websocket.TextMessage, []byte(recorded[name]))
+		}
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+
+	var snapshots atomic.Int32
+	rest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fapi/v1/depth" || r.URL.RawQuery != "limit=1000&symbol=BTCUSDT" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if snapshots.Add(1) == 1 {
+			w.Write([]byte(recorded["snapshot-1"]))
+			return
+		}
+
+		w.Write([]byte(recorded["snapshot-2"]))
+	}))
+	t.Cleanup(rest.Close)
+
+	adapter := NewBinanceAdapter(BinanceUSDM)
+	adapter.BaseURL = server.wsURL()
+	adapter.RestURL = rest.URL
+
+	c, nc := newTestConsumer(t, adapter)
+	books := collect(t, nc, common.DepthSubj(adapter.Name(), "btcusdt"))
+
+	if err := c.Acquire(Stream{Channel: ChannelDepth, Symbol: "btcusdt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// book returns the first published book at the update.
+	book := func(updateID int64) models.OrderBook {
+		t.Helper()
+
+		for {
+			var book models.OrderBook
+			if err := json.Unmarshal(next(t, books).Data, &book); err != nil {
+				t.Fatal(err)
+			}
+
+			if book.LastUpdateID == updateID {
+				return book
+			}
+		}
+	}
+
+	// diff-95 is older than the snapshot, diff-101 bridges it.
+	got := book(104)
+	if want := levels("67012.5", "1", "67012.3", "0.4"); !equalLevels(got.Bids, want) {
+		t.Errorf("got bids %v, want %v", got.Bids, want)
+	}
+
+	if want := levels("67012.7", "3", "67012.8", "0.7"); !equalLevels(got.Asks, want) {
+		t.Errorf("got asks %v, want %v", got.Asks, want)
+	}
+
+	close(resync)
+
+	got = book(113)
+	if want := levels("67012.2", "0.3", "67012.1", "1"); !equalLevels(got.Bids, want) {
+		t.Errorf("got bids %v, want %v", got.Bids, want)
+	}
+
+	if want := levels("67012.9", "1"); !equalLevels(got.Asks, want) {
+		t.Errorf("got asks %v, want %v", got.Asks, want)
+	}
+
+	if n := snapshots.Load(); n != 2 {
+		t.Errorf("fetched %d snapshots, want 2", n)
+	}
+}
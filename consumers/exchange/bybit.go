@@ -0,0 +1,163 @@
+package exchange
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/11me/calef/config"
+	"github.com/11me/calef/models"
+	"github.com/shopspring/decimal"
+	"github.com/valyala/fastjson"
+)
+
+const (
+	bybitName      = "bybit"
+	bybitWsBaseUrl = "wss://stream.bybit.com/v5/public/linear"
+
+	// bybitMaxArgs is the maximum number of topics in one subscribe request.
+	bybitMaxArgs = 10
+	// bybitPingInterval is recommended by bybit to keep the connection alive.
+	bybitPingInterval = 20 * time.Second
+
+	bybitTradeTopic = "publicTrade."
+)
+
+func init() {
+	Register(bybitName, func(conf *config.Exchange) Adapter {
+		a := NewBybitAdapter()
+		a.BaseURL = endpoint(conf, bybitName, a.BaseURL)
+
+		return a
+	})
+}
+
+// BybitAdapter streams public trades of bybit v5 linear perpetuals.
+type BybitAdapter struct {
+	// BaseURL is the websocket endpoint, it can be replaced to point
+	// to a local server.
+	BaseURL string
+}
+
+func NewBybitAdapter() *BybitAdapter {
+	return &BybitAdapter{BaseURL: bybitWsBaseUrl}
+}
+
+func (a *BybitAdapter) Name() string { return bybitName }
+
+func (a *BybitAdapter) URL() string { return a.BaseURL }
+
+func (a *BybitAdapter) Acknowledges() bool { return true }
+
+func (a *BybitAdapter) SubscribeMessages(id uint64, streams []Stream) ([]any, error) {
+	symbols, err := tradeSymbols(a.Name(), streams)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.requests("subscribe", id, symbols), nil
+}
+
+func (a *BybitAdapter) UnsubscribeMessages(id uint64, streams []Stream) ([]any, error) {
+	symbols, err := tradeSymbols(a.Name(), streams)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.requests("unsubscribe", id, symbols), nil
+}
+
+// requests splits topics in chunks, all of them carry the same request id.
+func (a *BybitAdapter) requests(op string, id uint64, symbols []string) []any {
+	msgs := make([]any, 0, len(symbols)/bybitMaxArgs+1)
+
+	for start := 0; start < len(symbols); start += bybitMaxArgs {
+		end := min(start+bybitMaxArgs, len(symbols))
+
+		args := make([]string, 0, end-start)
+		for _, symbol := range symbols[start:end] {
+			args = append(args, bybitTradeTopic+strings.ToUpper(symbol))
+		}
+
+		msgs = append(msgs, map[string]any{
+			"req_id": strconv.FormatUint(id, 10),
+			"op":     op,
+			"args":   args,
+		})
+	}
+
+	return msgs
+}
+
+func (a *BybitAdapter) PingMessage() ([]byte, time.Duration) {
+	return []byte(`{"op":"ping"}`), bybitPingInterval
+}
+
+func (a *BybitAdapter) Normalize(data []byte) (Frame, error) {
+	parser := fastjson.Parser{}
+
+	val, err := parser.ParseBytes(data)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	// Responses to subscribe and ping requests.
+	if val.Exists("op") {
+		var reqErr error
+		if val.Exists("success") && !val.GetBool("success") {
+			reqErr = fmt.Errorf("bybit %s request failed: %s", val.GetStringBytes("op"), val.GetStringBytes("ret_msg"))
+		}
+
+		switch string(val.GetStringBytes("op")) {
+		case "subscribe", "unsubscribe":
+			id, err := strconv.ParseUint(string(val.GetStringBytes("req_id")), 10, 64)
+			if err != nil {
+				return Frame{}, fmt.Errorf("failed to parse request id: %w", err)
+			}
+
+			return Frame{Ack: &Ack{ID: id, Err: reqErr}}, nil
+		}
+
+		return Frame{}, reqErr
+	}
+
+	if !strings.HasPrefix(string(val.GetStringBytes("topic")), bybitTradeTopic) {
+		return Frame{}, nil
+	}
+
+	items := val.GetArray("data")
+	trades := make([]models.Trade, 0, len(items))
+
+	for _, item := range items {
+		price, err := decimal.NewFromString(string(item.GetStringBytes("p")))
+		if err != nil {
+			return Frame{}, fmt.Errorf("failed to parse price: %w", err)
+		}
+
+		quantity, err := decimal.NewFromString(string(item.GetStringBytes("v")))
+		if err != nil {
+			return Frame{}, fmt.Errorf("failed to parse quantity: %w", err)
+		}
+
+		side := models.SideUnknown
+		switch string(item.GetStringBytes("S")) {
+		case "Buy":
+			side = models.SideBuy
+		case "Sell":
+			side = models.SideSell
+		}
+
+		trades = append(trades, models.Trade{
+			Exchange:     a.Name(),
+			Symbol:       strings.ToLower(string(item.GetStringBytes("s"))),
+			Price:        price,
+			Quantity:     quantity,
+			Side:         side,
+			TradeID:      string(item.GetStringBytes("i")),
+			ExchangeTime: time.UnixMilli(item.GetInt64("T")),
+		})
+	}
+
+	return Frame{Trades: trades}, nil
+}
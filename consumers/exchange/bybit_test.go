@@ -0,0 +1,132 @@
+package exchange
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/11me/calef/models"
+	"github.com/gorilla/websocket"
+	"github.com/shopspring/decimal"
+)
+
+type bybitRequest struct {
+	ReqID string   `json:"req_id"`
+	Op    string   `json:"op"`
+	Args  []string `json:"args"`
+}
+
+func TestBybitReplay(t *testing.T) {
+	recorded := frames(t, "bybit.txt")
+
+	// ack answers the request with the recorded ack.
+	ack := func(conn *websocket.Conn, req bybitRequest) {
+		frame := strings.Replace(recorded["subscribe-ack"], `"req_id":"1"`, `"req_id":"`+req.ReqID+`"`, 1)
+		conn.WriteMessage(websocket.TextMessage, []byte(frame))
+	}
+
+	requests := make(chan bybitRequest, 4)
+
+	server := newStandIn(t, func(n int, conn *websocket.Conn) {
+		var req bybitRequest
+		if !readJSON(t, conn, &req) {
+			return
+		}
+
+		requests <- req
+		ack(conn, req)
+
+		if n > 1 {
+			conn.WriteMessage(websocket.TextMessage, []byte(recorded["trades-btc-2"]))
+
+			// Hold the connection until the consumer stops.
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte(recorded["pong"]))
+		conn.WriteMessage(websocket.TextMessage, []byte(recorded["trades-btc"]))
+
+		// A runtime subscribe is acked on the open connection.
+		if !readJSON(t, conn, &req) {
+			return
+		}
+
+		requests <- req
+		ack(conn, req)
+		conn.WriteMessage(websocket.TextMessage, []byte(recorded["trades-eth"]))
+
+		// Drop the connection to make the consumer reconnect.
+	})
+
+	adapter := NewBybitAdapter()
+	adapter.BaseURL = server.wsURL()
+
+	c, nc := newTestConsumer(t, adapter)
+	btc := collect(t, nc, "bybit.ticks.btcusdt")
+	eth := collect(t, nc, "bybit.ticks.ethusdt")
+
+	if err := c.Acquire(TradeStreams("BTCUSDT")...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if req := <-requests; req.Op != "subscribe" || !slices.Equal(req.Args, []string{"publicTrade.BTCUSDT"}) {
+		t.Fatalf("unexpected subscribe request %+v", req)
+	}
+
+	want := []models.Trade{
+		{Price: decimal.RequireFromString("67012.50"), Quantity: decimal.RequireFromString("0.015"), Side: models.SideBuy, TradeID: "4f7a1e2b-8c3d-5b9e-a1f0-2d6c8e4b7a91", ExchangeTime: time.UnixMilli(1729152000229)},
+		{Price: decimal.RequireFromString("67012.40"), Quantity: decimal.RequireFromString("0.302"), Side: models.SideSell, TradeID: "9b2c4d6e-1a3f-5c7e-b8d0-4e6f8a1c3b52", ExchangeTime: time.UnixMilli(1729152000229)},
+	}
+	for _, w := range want {
+		assertTrade(t, next(t, btc), "bybit", "btcusdt", w)
+	}
+
+	if err := c.Acquire(TradeStreams("ethusdt")...); err != nil {
+		t.Fatalf("runtime subscribe: %v", err)
+	}
+
+	if req := <-requests; !slices.Equal(req.Args, []string{"publicTrade.ETHUSDT"}) {
+		t.Fatalf("unexpected subscribe request %+v", req)
+	}
+
+	assertTrade(t, next(t, eth), "bybit", "ethusdt", models.Trade{
+		Price: decimal.RequireFromString("2614.37"), Quantity: decimal.RequireFromString("1.25"), Side: models.SideBuy,
+		TradeID: "c3e5a7b9-2d4f-6a8c-9e1b-3f5d7b9a1c63", ExchangeTime: time.UnixMilli(1729152001015),
+	})
+
+	// The reconnected consumer subscribes to both symbols again.
+	req := <-requests
+	slices.Sort(req.Args)
+	if !slices.Equal(req.Args, []string{"publicTrade.BTCUSDT", "publicTrade.ETHUSDT"}) {
+		t.Fatalf("unexpected resubscribe request %+v", req)
+	}
+
+	assertTrade(t, next(t, btc), "bybit", "btcusdt", models.Trade{
+		Price: decimal.RequireFromString("67011.90"), Quantity: decimal.RequireFromString("0.004"), Side: models.SideSell,
+		TradeID: "e1f3b5d7-4a6c-8e0a-1b3d-5f7a9c1e3b74", ExchangeTime: time.UnixMilli(1729152003541),
+	})
+
+	if h := c.Health(); len(h) != 1 || h[0].Reconnects != 1 {
+		t.Fatalf("expected one reconnect, got %+v", h)
+	}
+}
+
+func TestBybitNormalizeAck(t *testing.T) {
+	frame, err := NewBybitAdapter().Normalize([]byte(`{"success":false,"ret_msg":"error:handler not found,topic:publicTrade.XXXUSDT","conn_id":"cs8hf1sdaugnn8mqvfn0-4aoz0","req_id":"7","op":"subscribe"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frame.Ack == nil || frame.Ack.ID != 7 || frame.Ack.Err == nil {
+		t.Fatalf("expected failed ack of request 7, got %+v", frame.Ack)
+	}
+}
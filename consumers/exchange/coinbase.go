@@ -0,0 +1,149 @@
+package exchange
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/11me/calef/config"
+	"github.com/11me/calef/models"
+	"github.com/shopspring/decimal"
+	"github.com/valyala/fastjson"
+)
+
+const (
+	coinbaseName      = "coinbase"
+	coinbaseWsBaseUrl = "wss://advanced-trade-ws.coinbase.com"
+
+	coinbaseTradesChannel = "market_trades"
+	// coinbaseHeartbeatsChannel keeps the connection open when
+	// subscribed products are illiquid.
+	coinbaseHeartbeatsChannel = "heartbeats"
+)
+
+func init() {
+	Register(coinbaseName, func(conf *config.Exchange) Adapter {
+		a := NewCoinbaseAdapter()
+		a.BaseURL = endpoint(conf, coinbaseName, a.BaseURL)
+
+		return a
+	})
+}
+
+// CoinbaseAdapter streams public trades of coinbase advanced trade spot products.
+type CoinbaseAdapter struct {
+	// BaseURL is the websocket endpoint, it can be replaced to point
+	// to a local server.
+	BaseURL string
+}
+
+func NewCoinbaseAdapter() *CoinbaseAdapter {
+	return &CoinbaseAdapter{BaseURL: coinbaseWsBaseUrl}
+}
+
+func (a *CoinbaseAdapter) Name() string { return coinbaseName }
+
+func (a *CoinbaseAdapter) URL() string { return a.BaseURL }
+
+func (a *CoinbaseAdapter) SubscribeMessages(_ uint64, streams []Stream) ([]any, error) {
+	symbols, err := tradeSymbols(a.Name(), streams)
+	if err != nil {
+		return nil, err
+	}
+
+	return []any{a.request("subscribe", symbols)}, nil
+}
+
+// OpenMessages subscribes the connection to heartbeats once, they are not
+// bound to products.
+func (a *CoinbaseAdapter) OpenMessages() []any {
+	return []any{map[string]any{
+		"type":    "subscribe",
+		"channel": coinbaseHeartbeatsChannel,
+	}}
+}
+
+func (a *CoinbaseAdapter) UnsubscribeMessages(_ uint64, streams []Stream) ([]any, error) {
+	symbols, err := tradeSymbols(a.Name(), streams)
+	if err != nil {
+		return nil, err
+	}
+
+	return []any{a.request("unsubscribe", symbols)}, nil
+}
+
+func (a *CoinbaseAdapter) request(typ string, symbols []string) map[string]any {
+	products := make([]string, 0, len(symbols))
+	for _, symbol := range symbols {
+		products = append(products, dashedSymbol(symbol))
+	}
+
+	return map[string]any{
+		"type":        typ,
+		"channel":     coinbaseTradesChannel,
+		"product_ids": products,
+	}
+}
+
+func (a *CoinbaseAdapter) Normalize(data []byte) (Frame, error) {
+	parser := fastjson.Parser{}
+
+	val, err := parser.ParseBytes(data)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	if string(val.GetStringBytes("type")) == "error" {
+		return Frame{}, fmt.Errorf("coinbase request failed: %s", val.GetStringBytes("message"))
+	}
+
+	if string(val.GetStringBytes("channel")) != coinbaseTradesChannel {
+		return Frame{}, nil
+	}
+
+	var trades []models.Trade
+
+	for _, event := range val.GetArray("events") {
+		// Every (re)subscribe is answered with a snapshot of recent trades,
+		// they were published already or predate the subscription.
+		if string(event.GetStringBytes("type")) != "update" {
+			continue
+		}
+
+		for _, item := range event.GetArray("trades") {
+			price, err := decimal.NewFromString(string(item.GetStringBytes("price")))
+			if err != nil {
+				return Frame{}, fmt.Errorf("failed to parse price: %w", err)
+			}
+
+			quantity, err := decimal.NewFromString(string(item.GetStringBytes("size")))
+			if err != nil {
+				return Frame{}, fmt.Errorf("failed to parse quantity: %w", err)
+			}
+
+			ts, err := time.Parse(time.RFC3339Nano, string(item.GetStringBytes("time")))
+			if err != nil {
+				return Frame{}, fmt.Errorf("failed to parse time: %w", err)
+			}
+
+			side := models.SideUnknown
+			switch string(item.GetStringBytes("side")) {
+			case "BUY":
+				side = models.SideBuy
+			case "SELL":
+				side = models.SideSell
+			}
+
+			trades = append(trades, models.Trade{
+				Exchange:     a.Name(),
+				Symbol:       joinedSymbol(string(item.GetStringBytes("product_id"))),
+				Price:        price,
+				Quantity:     quantity,
+				Side:         side,
+				TradeID:      string(item.GetStringBytes("trade_id")),
+				ExchangeTime: ts,
+			})
+		}
+	}
+
+	return Frame{Trades: trades}, nil
+}
@@ -0,0 +1,126 @@
+package exchange
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/11me/calef/models"
+	"github.com/gorilla/websocket"
+	"github.com/shopspring/decimal"
+)
+
+type coinbaseRequest struct {
+	Type       string   `json:"type"`
+	Channel    string   `json:"channel"`
+	ProductIDs []string `json:"product_ids"`
+}
+
+func TestCoinbaseReplay(t *testing.T) {
+	recorded := frames(t, "coinbase.txt")
+	requests := make(chan coinbaseRequest, 4)
+
+	server := newStandIn(t, func(n int, conn *websocket.Conn) {
+		for i := 0; ; i++ {
+			var req coinbaseRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+
+			requests <- req
+
+			// Answer the trades subscription of the connection.
+			if i == 1 {
+				for _, name := range []string{"subscriptions", "snapshot", "heartbeats", "update"} {
+					conn.WriteMessage(websocket.TextMessage, []byte(recorded[name]))
+				}
+			}
+		}
+	})
+
+	adapter := NewCoinbaseAdapter()
+	adapter.BaseURL = server.wsURL()
+
+	c, nc := newTestConsumer(t, adapter)
+	ticks := collect(t, nc, "coinbase.ticks.btcusdt")
+
+	if err := c.Acquire(TradeStreams("btcusdt")...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if req := <-requests; req.Type != "subscribe" || req.Channel != "heartbeats" {
+		t.Fatalf("expected heartbeats subscription first, got %+v", req)
+	}
+
+	if req := <-requests; req.Channel != "market_trades" || !slices.Equal(req.ProductIDs, []string{"BTC-USDT"}) {
+		t.Fatalf("unexpected trades subscription %+v", req)
+	}
+
+	// The snapshot is skipped, the update is published.
+	assertTrade(t, next(t, ticks), "coinbase", "btcusdt", models.Trade{
+		Price: decimal.RequireFromString("67012.5"), Quantity: decimal.RequireFromString("0.00012"), Side: models.SideBuy,
+		TradeID: "71320312", ExchangeTime: time.Date(2024, 10, 17, 8, 0, 2, 329714000, time.UTC),
+	})
+
+	select {
+	case msg := <-ticks:
+		t.Fatalf("unexpected trade %s", msg.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Heartbeats aren't subscribed again with more products.
+	if err := c.Acquire(TradeStreams("ethusdt")...); err != nil {
+		t.Fatal(err)
+	}
+
+	if req := <-requests; req.Channel != "market_trades" || !slices.Equal(req.ProductIDs, []string{"ETH-USDT"}) {
+		t.Fatalf("unexpected runtime subscription %+v", req)
+	}
+
+	select {
+	case req := <-requests:
+		t.Fatalf("unexpected request %+v", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCoinbaseNormalize(t *testing.T) {
+	recorded := frames(t, "coinbase.txt")
+	adapter := NewCoinbaseAdapter()
+
+	for _, name := range []string{"subscriptions", "heartbeats", "snapshot"} {
+		frame, err := adapter.Normalize([]byte(recorded[name]))
+		if err != nil || len(frame.Trades) > 0 {
+			t.Errorf("%s: expected empty frame, got %+v, %v", name, frame, err)
+		}
+	}
+
+	if _, err := adapter.Normalize([]byte(`{"type":"error","message":"failure to subscribe"}`)); err == nil {
+		t.Error("expected error frame to fail")
+	}
+}
+
+func TestSymbolMapping(t *testing.T) {
+	tests := []struct {
+		joined, dashed string
+	}{
+		{"btcusdt", "BTC-USDT"},
+		{"ethbtc", "ETH-BTC"},
+		{"solfdusd", "SOL-FDUSD"},
+		{"btcusd", "BTC-USD"},
+	}
+
+	for _, tt := range tests {
+		if got := dashedSymbol(tt.joined); got != tt.dashed {
+			t.Errorf("dashedSymbol(%q) = %q, want %q", tt.joined, got, tt.dashed)
+		}
+
+		if got := joinedSymbol(tt.dashed); got != tt.joined {
+			t.Errorf("joinedSymbol(%q) = %q, want %q", tt.dashed, got, tt.joined)
+		}
+	}
+}
@@ -0,0 +1,624 @@
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/11me/calef/common"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+)
+
+// ackTimeout bounds waiting for a venue to acknowledge a (un)subscribe request.
+const ackTimeout = 10 * time.Second
+
+var ErrAckTimeout = errors.New("request was not acknowledged in time")
+
+// Keepalive configures connection liveness checks, zero values disable them.
+type Keepalive struct {
+	// PingInterval is how often websocket pings are sent.
+	PingInterval time.Duration
+	// ReadTimeout closes a connection that received nothing, pongs included.
+	ReadTimeout time.Duration
+	// StaleTimeout reconnects when no market data arrives on a connection.
+	StaleTimeout time.Duration
+	// RotateBefore replaces a connection this long before the venue closes it.
+	RotateBefore time.Duration
+}
+
+var DefaultKeepalive = Keepalive{
+	PingInterval: 30 * time.Second,
+	ReadTimeout:  90 * time.Second,
+	StaleTimeout: 5 * time.Minute,
+	RotateBefore: 30 * time.Minute,
+}
+
+// DefaultOpenInterestInterval is how often open interest is polled.
+const DefaultOpenInterestInterval = 15 * time.Second
+
+// pendingRequest awaits acks for all messages sent with one request id.
+type pendingRequest struct {
+	remaining int
+	done      chan error
+}
+
+// Consumer streams trades from a venue through its adapter and publishes
+// them on the ticks subjects. Symbols are reference counted, a symbol is
+// streamed as long as somebody acquired it. Symbols are spread over a pool of
+// connections (shards) to stay within the venue limits.
+type Consumer struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	log       *slog.Logger
+	nc        *nats.Conn
+	adapter   Adapter
+	limits    Limits
+	keepalive Keepalive
+	nextID    atomic.Uint64
+	seq       *sequenceTracker
+	backfill  bool
+	books     *orderBooks
+	// depthLevels is the number of book levels published per side.
+	depthLevels          int
+	openInterestInterval time.Duration
+
+	mu       sync.Mutex
+	started  bool
+	refs     map[Stream]int
+	shards   []*shard
+	assigned map[Stream]*shard
+	// polls cancels pollers of streams fetched over REST.
+	polls map[Stream]context.CancelFunc
+}
+
+func NewConsumer(ctx context.Context, nc *nats.Conn, adapter Adapter) *Consumer {
+	ctx, cancel := context.WithCancel(ctx)
+
+	c := &Consumer{
+		ctx:       ctx,
+		cancel:    cancel,
+		nc:        nc,
+		adapter:   adapter,
+		log:       slog.With("service", "ExchangeConsumer", "exchange", adapter.Name()),
+		keepalive: DefaultKeepalive,
+		books:     newOrderBooks(adapter.Name()),
+		refs:      make(map[Stream]int),
+		assigned:  make(map[Stream]*shard),
+		polls:     make(map[Stream]context.CancelFunc),
+
+		openInterestInterval: DefaultOpenInterestInterval,
+	}
+
+	if limiter, ok := adapter.(Limiter); ok {
+		c.limits = limiter.Limits()
+	}
+
+	if _, ok := adapter.(Sequencer); ok {
+		c.seq = newSequenceTracker()
+	}
+
+	return c
+}
+
+// SetStreamsPerConn lowers the number of symbols per connection.
+func (c *Consumer) SetStreamsPerConn(n int) *Consumer {
+	if n > 0 && (c.limits.MaxStreams == 0 || n < c.limits.MaxStreams) {
+		c.limits.MaxStreams = n
+	}
+
+	return c
+}
+
+func (c *Consumer) SetKeepalive(k Keepalive) *Consumer { c.keepalive = k; return c }
+
+// SetBackfill enables fetching missed trades when the adapter supports it.
+func (c *Consumer) SetBackfill(enabled bool) *Consumer { c.backfill = enabled; return c }
+
+// SetDepthLevels sets the number of order book levels published per side,
+// zero publishes the whole book.
+func (c *Consumer) SetDepthLevels(n int) *Consumer { c.depthLevels = n; return c }
+
+// SetOpenInterestInterval sets how often open interest streams are polled.
+func (c *Consumer) SetOpenInterestInterval(d time.Duration) *Consumer {
+	if d > 0 {
+		c.openInterestInterval = d
+	}
+
+	return c
+}
+
+// Klines fetches the latest klines of the symbol over REST.
+func (c *Consumer) Klines(ctx context.Context, symbol string, tf models.Timeframe, limit int) ([]models.Kline, error) {
+	fetcher, ok := c.adapter.(KlineFetcher)
+	if !ok {
+		return nil, fmt.Errorf("%s klines: %w", c.adapter.Name(), ErrUnsupportedChannel)
+	}
+
+	return fetcher.Klines(ctx, normalizeSymbol(symbol), tf, limit)
+}
+
+// Name returns the name of the underlying adapter.
+func (c *Consumer) Name() string { return c.adapter.Name() }
+
+// Start connects all connections of the pool one by one and returns once
+// each was dialed. Failed connections don't fail Start, they are retried in
+// background until Stop.
+func (c *Consumer) Start() error {
+	c.log.Info("starting exchange consumer")
+
+	c.mu.Lock()
+	c.started = true
+	shards := append([]*shard(nil), c.shards...)
+
+	for stream := range c.refs {
+		if stream.Channel == ChannelOpenInterest {
+			c.startPoll(stream)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, s := range shards {
+		s.start()
+	}
+
+	return nil
+}
+
+// Stop closes all connections and waits for every goroutine of the
+// consumer. It returns errors of connections that were down at the time.
+func (c *Consumer) Stop() error {
+	c.cancel()
+
+	c.mu.Lock()
+	shards := append([]*shard(nil), c.shards...)
+	c.mu.Unlock()
+
+	var ee error
+	for _, s := range shards {
+		if err := s.stop(); err != nil {
+			ee = errors.Join(ee, err)
+		}
+	}
+
+	c.wg.Wait()
+
+	c.log.Debug("stopped")
+
+	return ee
+}
+
+// goroutine runs fn accounted by Stop.
+func (c *Consumer) goroutine(fn func()) {
+	c.wg.Add(1)
+
+	go func() {
+		defer c.wg.Done()
+		fn()
+	}()
+}
+
+func (c *Consumer) publishEvent(event models.ConnEvent) {
+	event.Exchange = c.adapter.Name()
+	event.Time = time.Now()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		c.log.Error("failed to marshal connection event", "err", err)
+		return
+	}
+
+	subj := common.ConnEventsSubj(c.adapter.Name())
+	if err := c.nc.Publish(subj, data); err != nil {
+		c.log.Error("failed to publish connection event", "subject", subj, "err", err)
+	}
+}
+
+// handleTrade drops duplicates and reports gaps of sequenced venues before
+// publishing the trade.
+func (c *Consumer) handleTrade(trade *models.Trade) {
+	if c.seq == nil {
+		c.publishTrade(trade)
+		return
+	}
+
+	seq, err := c.adapter.(Sequencer).Seq(trade)
+	if err != nil {
+		c.log.Error("failed to get trade sequence", "symbol", trade.Symbol, "tradeId", trade.TradeID, "err", err)
+		c.publishTrade(trade)
+
+		return
+	}
+
+	verdict, from, to := c.seq.observe(trade.Symbol, seq)
+	switch verdict {
+	case seqDuplicate:
+		return
+	case seqGap:
+		c.log.Warn(fmt.Sprintf("missed trades %d-%d", from, to), "symbol", trade.Symbol)
+		c.goroutine(func() { c.fillGap(trade.Symbol, from, to) })
+	}
+
+	c.publishTrade(trade)
+}
+
+// fillGap fetches the missed trades when backfill is enabled and reports the gap.
+// Backfilled trades are published after the live ones that revealed the gap.
+func (c *Consumer) fillGap(symbol string, from, to int64) {
+	event := models.GapEvent{
+		Exchange:    c.adapter.Name(),
+		Symbol:      symbol,
+		FromTradeID: from,
+		ToTradeID:   to,
+	}
+
+	if backfiller, ok := c.adapter.(Backfiller); ok && c.backfill {
+		trades, err := backfiller.Backfill(c.ctx, symbol, from, to)
+		if err != nil {
+			c.log.Error("failed to backfill trades", "symbol", symbol, "err", err)
+			event.Error = err.Error()
+		}
+
+		receivedAt := time.Now()
+		for i := range trades {
+			trades[i].ReceiveTime = receivedAt
+			c.publishTrade(&trades[i])
+		}
+
+		event.Backfilled = len(trades)
+	}
+
+	event.Time = time.Now()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		c.log.Error("failed to marshal gap event", "err", err)
+		return
+	}
+
+	subj := common.GapEventsSubj(c.adapter.Name())
+	if err := c.nc.Publish(subj, data); err != nil {
+		c.log.Error("failed to publish gap event", "subject", subj, "err", err)
+	}
+}
+
+// handleDepth maintains the local order book of the diff symbol and
+// publishes its top levels.
+func (c *Consumer) handleDepth(update models.DepthUpdate) {
+	book := c.books.get(update.Symbol)
+
+	changed, needSnapshot := book.apply(update)
+	if needSnapshot {
+		c.goroutine(func() { c.syncBook(book) })
+	}
+
+	if changed {
+		c.publishBook(book)
+	}
+}
+
+// syncBook loads a snapshot into the book, it is retried with the next diff
+// on failure.
+func (c *Consumer) syncBook(book *orderBook) {
+	snapshotter, ok := c.adapter.(DepthSnapshotter)
+	if !ok {
+		c.log.Error("adapter can't fetch order book snapshots", "symbol", book.symbol)
+		return
+	}
+
+	c.log.Info("syncing order book", "symbol", book.symbol)
+
+	snapshot, err := snapshotter.DepthSnapshot(c.ctx, book.symbol)
+	if err != nil {
+		c.log.Error("failed to fetch order book snapshot", "symbol", book.symbol, "err", err)
+
+		select {
+		case <-c.ctx.Done():
+		case <-time.After(bookResyncDelay):
+		}
+
+		book.abort()
+
+		return
+	}
+
+	if !book.load(snapshot) {
+		c.log.Warn("order book snapshot is behind the diff stream, resyncing", "symbol", book.symbol)
+		book.abort()
+
+		return
+	}
+
+	c.publishBook(book)
+}
+
+func (c *Consumer) publishBook(book *orderBook) {
+	subj := common.DepthSubj(c.adapter.Name(), book.symbol)
+
+	data, err := json.Marshal(book.top(c.depthLevels))
+	if err != nil {
+		c.log.Error("failed to marshal order book", "err", err)
+		return
+	}
+
+	if err := c.nc.Publish(subj, data); err != nil {
+		c.log.Error("failed to publish order book", "subject", subj, "err", err)
+	}
+}
+
+func (c *Consumer) publishMarkPrice(mark *models.MarkPrice) {
+	c.publish(common.MarkPriceSubj(c.adapter.Name(), mark.Symbol), mark)
+}
+
+func (c *Consumer) publishLiquidation(liquidation *models.Liquidation) {
+	c.publish(common.LiquidationsSubj(c.adapter.Name(), liquidation.Symbol), liquidation)
+}
+
+func (c *Consumer) publishKline(kline *models.Kline) {
+	c.publish(common.KlinesSubj(c.adapter.Name(), kline.Symbol, kline.Timeframe), kline)
+}
+
+// publish publishes v as JSON on subj.
+func (c *Consumer) publish(subj string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		c.log.Error("failed to marshal message", "subject", subj, "err", err)
+		return
+	}
+
+	if err := c.nc.Publish(subj, data); err != nil {
+		c.log.Error("failed to publish message", "subject", subj, "err", err)
+	}
+}
+
+func (c *Consumer) publishQuote(quote *models.Quote) {
+	subj := common.QuotesSubj(c.adapter.Name(), quote.Symbol)
+
+	data, err := json.Marshal(quote)
+	if err != nil {
+		c.log.Error("failed to marshal quote", "err", err)
+		return
+	}
+
+	if err := c.nc.Publish(subj, data); err != nil {
+		c.log.Error("failed to publish quote", "subject", subj, "err", err)
+	}
+}
+
+func (c *Consumer) publishTrade(trade *models.Trade) {
+	subj := common.TicksSubj(c.adapter.Name(), trade.Symbol)
+
+	msg, err := common.NewTradeMsg(subj, trade)
+	if err != nil {
+		c.log.Error("failed to marshal trade", "err", err)
+		return
+	}
+
+	err = c.nc.PublishMsg(msg)
+	if err != nil {
+		c.log.Error("failed to publish message to subject", "subject", subj, "err", err)
+	}
+}
+
+// SubscribeTicks acquires trade streams of the symbols before the consumer
+// is started.
+func (c *Consumer) SubscribeTicks(symbols ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, stream := range TradeStreams(symbols...) {
+		stream.Symbol = normalizeSymbol(stream.Symbol)
+
+		c.refs[stream]++
+		if c.refs[stream] == 1 {
+			c.assign(stream)
+		}
+	}
+}
+
+// Streams returns the streams currently subscribed.
+func (c *Consumer) Streams() []Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	streams := make([]Stream, 0, len(c.refs))
+	for stream := range c.refs {
+		streams = append(streams, stream)
+	}
+
+	return streams
+}
+
+// Health returns the state of every connection of the pool.
+func (c *Consumer) Health() []ShardHealth {
+	c.mu.Lock()
+	shards := append([]*shard(nil), c.shards...)
+	c.mu.Unlock()
+
+	health := make([]ShardHealth, 0, len(shards))
+	for _, s := range shards {
+		health = append(health, s.health())
+	}
+
+	return health
+}
+
+// Acquire references the streams and subscribes to those not streamed yet on
+// the open connections. When the venue acknowledges requests, Acquire waits
+// for the result. Streams stay referenced even on error, they are
+// subscribed again on reconnect.
+func (c *Consumer) Acquire(streams ...Stream) error {
+	c.mu.Lock()
+
+	var ee error
+
+	added := make(map[*shard][]Stream)
+	for _, stream := range streams {
+		stream.Symbol = normalizeSymbol(stream.Symbol)
+
+		if stream.Channel == ChannelOpenInterest {
+			if _, ok := c.adapter.(OpenInterestFetcher); !ok {
+				ee = errors.Join(ee, fmt.Errorf("%s %s: %w", c.adapter.Name(), stream.Channel, ErrUnsupportedChannel))
+				continue
+			}
+
+			c.refs[stream]++
+			if c.refs[stream] == 1 && c.started {
+				c.startPoll(stream)
+			}
+
+			continue
+		}
+
+		c.refs[stream]++
+		if c.refs[stream] == 1 {
+			s, created := c.assign(stream)
+			if created && c.started {
+				// A new connection subscribes to its streams on connect.
+				c.goroutine(s.start)
+				continue
+			}
+
+			added[s] = append(added[s], stream)
+		}
+	}
+
+	c.mu.Unlock()
+
+	for s, streams := range added {
+		if err := s.request(streams, c.adapter.SubscribeMessages); err != nil {
+			ee = errors.Join(ee, err)
+		}
+	}
+
+	return ee
+}
+
+// Release drops references to the streams and unsubscribes from those
+// nobody references anymore.
+func (c *Consumer) Release(streams ...Stream) error {
+	c.mu.Lock()
+
+	removed := make(map[*shard][]Stream)
+	for _, stream := range streams {
+		stream.Symbol = normalizeSymbol(stream.Symbol)
+
+		if c.refs[stream] == 0 {
+			continue
+		}
+
+		c.refs[stream]--
+		if c.refs[stream] == 0 {
+			delete(c.refs, stream)
+
+			if cancel, ok := c.polls[stream]; ok {
+				cancel()
+				delete(c.polls, stream)
+
+				continue
+			}
+
+			s, ok := c.assigned[stream]
+			if !ok {
+				// A polled stream acquired before Start.
+				continue
+			}
+
+			delete(c.assigned, stream)
+			s.remove(stream)
+
+			c.forget(stream)
+
+			removed[s] = append(removed[s], stream)
+		}
+	}
+
+	c.mu.Unlock()
+
+	var ee error
+	for s, streams := range removed {
+		if err := s.request(streams, c.adapter.UnsubscribeMessages); err != nil {
+			ee = errors.Join(ee, err)
+		}
+	}
+
+	return ee
+}
+
+// startPoll starts polling a stream fetched over REST. The caller must hold mu.
+func (c *Consumer) startPoll(stream Stream) {
+	if _, ok := c.polls[stream]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.polls[stream] = cancel
+
+	c.goroutine(func() { c.pollOpenInterest(ctx, stream.Symbol) })
+}
+
+// pollOpenInterest publishes the open interest of the symbol until ctx is done.
+func (c *Consumer) pollOpenInterest(ctx context.Context, symbol string) {
+	fetcher := c.adapter.(OpenInterestFetcher)
+
+	ticker := time.NewTicker(c.openInterestInterval)
+	defer ticker.Stop()
+
+	for {
+		oi, err := fetcher.OpenInterest(ctx, symbol)
+		switch {
+		case errors.Is(err, ErrUnsupportedChannel):
+			c.log.Error("open interest is not available", "symbol", symbol, "err", err)
+			return
+		case err != nil && ctx.Err() == nil:
+			c.log.Error("failed to fetch open interest", "symbol", symbol, "err", err)
+		case err == nil:
+			c.publish(common.OpenInterestSubj(c.adapter.Name(), symbol), &oi)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// forget drops the state kept for an unsubscribed stream.
+func (c *Consumer) forget(stream Stream) {
+	switch stream.Channel {
+	case ChannelTrades:
+		if c.seq != nil {
+			c.seq.forget(stream.Symbol)
+		}
+	case ChannelDepth:
+		c.books.remove(stream.Symbol)
+	}
+}
+
+// assign places the stream on the first connection with spare capacity, a new
+// connection is added to the pool when all are full. The caller must hold mu.
+func (c *Consumer) assign(stream Stream) (s *shard, created bool) {
+	for _, s := range c.shards {
+		if c.limits.MaxStreams == 0 || s.size() < c.limits.MaxStreams {
+			s.add(stream)
+			c.assigned[stream] = s
+
+			return s, false
+		}
+	}
+
+	s = newShard(c, len(c.shards))
+	s.add(stream)
+
+	c.shards = append(c.shards, s)
+	c.assigned[stream] = s
+
+	return s, true
+}
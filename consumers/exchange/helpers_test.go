@@ -0,0 +1,155 @@
+package exchange
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/11me/calef/common"
+	"github.com/11me/calef/internal/natstest"
+	"github.com/11me/calef/models"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+// standIn is a local websocket server standing in for a venue. serve is
+// called with the connection number, starting with 1, for every connection.
+type standIn struct {
+	*httptest.Server
+	conns atomic.Int32
+}
+
+func newStandIn(t *testing.T, serve func(n int, conn *websocket.Conn)) *standIn {
+	t.Helper()
+
+	s := &standIn{}
+	upgrader := websocket.Upgrader{}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		serve(int(s.conns.Add(1)), conn)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// wsURL returns the websocket URL of the stand-in.
+func (s *standIn) wsURL() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+// frames reads recorded frames, one per line, from testdata.
+func frames(t *testing.T, name string) map[string]string {
+	t.Helper()
+
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		key, frame, ok := strings.Cut(line, " ")
+		if !ok {
+			t.Fatalf("malformed frame %q", line)
+		}
+
+		recorded[key] = frame
+	}
+
+	return recorded
+}
+
+// readJSON reads the next client message into v.
+func readJSON(t *testing.T, conn *websocket.Conn, v any) bool {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(v); err != nil {
+		t.Errorf("failed to read client message: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// collect subscribes to the subject and returns its messages.
+func collect(t *testing.T, nc *nats.Conn, subj string) chan *nats.Msg {
+	t.Helper()
+
+	ch := make(chan *nats.Msg, 256)
+	if _, err := nc.ChanSubscribe(subj, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ch
+}
+
+// next waits for the next message.
+func next(t *testing.T, ch chan *nats.Msg) *nats.Msg {
+	t.Helper()
+
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+// newTestConsumer returns a consumer of the adapter on a local NATS server,
+// it is stopped with the test.
+func newTestConsumer(t *testing.T, adapter Adapter) (*Consumer, *nats.Conn) {
+	t.Helper()
+
+	nc := natstest.Connect(t)
+	c := NewConsumer(context.Background(), nc, adapter).SetKeepalive(Keepalive{})
+	t.Cleanup(func() { c.Stop() })
+
+	return c, nc
+}
+
+// assertTrade checks the published trade and its subject against want, the
+// exchange and symbol are checked separately.
+func assertTrade(t *testing.T, msg *nats.Msg, exchange, symbol string, want models.Trade) {
+	t.Helper()
+
+	if subj := common.TicksSubj(exchange, symbol); msg.Subject != subj {
+		t.Errorf("published on %s, want %s", msg.Subject, subj)
+	}
+
+	got, err := common.DecodeTrade(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Exchange != exchange || got.Symbol != symbol {
+		t.Errorf("trade of %s:%s, want %s:%s", got.Exchange, got.Symbol, exchange, symbol)
+	}
+
+	if !got.Price.Equal(want.Price) || !got.Quantity.Equal(want.Quantity) || got.Side != want.Side ||
+		got.TradeID != want.TradeID || !got.ExchangeTime.Equal(want.ExchangeTime) {
+		t.Errorf("got trade %+v, want %+v", got, want)
+	}
+
+	if got.ReceiveTime.IsZero() {
+		t.Error("receive time is not set")
+	}
+}
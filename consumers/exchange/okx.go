@@ -0,0 +1,152 @@
+package exchange
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/11me/calef/config"
+	"github.com/11me/calef/models"
+	"github.com/shopspring/decimal"
+	"github.com/valyala/fastjson"
+)
+
+const (
+	okxName      = "okx"
+	okxWsBaseUrl = "wss://ws.okx.com:8443/ws/v5/public"
+
+	// okxPingInterval keeps the connection below the 30s idle limit of okx.
+	okxPingInterval = 25 * time.Second
+
+	okxTradesChannel = "trades"
+)
+
+func init() {
+	Register(okxName, func(conf *config.Exchange) Adapter {
+		a := NewOkxAdapter()
+		a.BaseURL = endpoint(conf, okxName, a.BaseURL)
+
+		return a
+	})
+}
+
+// OkxAdapter streams public trades of okx spot instruments.
+type OkxAdapter struct {
+	// BaseURL is the websocket endpoint, it can be replaced to point
+	// to a local server.
+	BaseURL string
+	// PingInterval is how often text pings are sent.
+	PingInterval time.Duration
+}
+
+func NewOkxAdapter() *OkxAdapter {
+	return &OkxAdapter{BaseURL: okxWsBaseUrl, PingInterval: okxPingInterval}
+}
+
+func (a *OkxAdapter) Name() string { return okxName }
+
+func (a *OkxAdapter) URL() string { return a.BaseURL }
+
+func (a *OkxAdapter) SubscribeMessages(_ uint64, streams []Stream) ([]any, error) {
+	symbols, err := tradeSymbols(a.Name(), streams)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.requests("subscribe", symbols), nil
+}
+
+func (a *OkxAdapter) UnsubscribeMessages(_ uint64, streams []Stream) ([]any, error) {
+	symbols, err := tradeSymbols(a.Name(), streams)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.requests("unsubscribe", symbols), nil
+}
+
+func (a *OkxAdapter) requests(op string, symbols []string) []any {
+	args := make([]map[string]string, 0, len(symbols))
+	for _, symbol := range symbols {
+		args = append(args, map[string]string{
+			"channel": okxTradesChannel,
+			"instId":  dashedSymbol(symbol),
+		})
+	}
+
+	return []any{map[string]any{
+		"op":   op,
+		"args": args,
+	}}
+}
+
+func (a *OkxAdapter) PingMessage() ([]byte, time.Duration) {
+	return []byte("ping"), a.PingInterval
+}
+
+func (a *OkxAdapter) Normalize(data []byte) (Frame, error) {
+	// Heartbeat response is a plain text frame.
+	if bytes.Equal(data, []byte("pong")) {
+		return Frame{}, nil
+	}
+
+	parser := fastjson.Parser{}
+
+	val, err := parser.ParseBytes(data)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	if event := string(val.GetStringBytes("event")); event != "" {
+		if event == "error" {
+			return Frame{}, fmt.Errorf("okx request failed: %s (code %s)", val.GetStringBytes("msg"), val.GetStringBytes("code"))
+		}
+
+		return Frame{}, nil
+	}
+
+	if string(val.GetStringBytes("arg", "channel")) != okxTradesChannel {
+		return Frame{}, nil
+	}
+
+	items := val.GetArray("data")
+	trades := make([]models.Trade, 0, len(items))
+
+	for _, item := range items {
+		price, err := decimal.NewFromString(string(item.GetStringBytes("px")))
+		if err != nil {
+			return Frame{}, fmt.Errorf("failed to parse price: %w", err)
+		}
+
+		quantity, err := decimal.NewFromString(string(item.GetStringBytes("sz")))
+		if err != nil {
+			return Frame{}, fmt.Errorf("failed to parse quantity: %w", err)
+		}
+
+		ts, err := strconv.ParseInt(string(item.GetStringBytes("ts")), 10, 64)
+		if err != nil {
+			return Frame{}, fmt.Errorf("failed to parse timestamp: %w", err)
+		}
+
+		side := models.SideUnknown
+		switch string(item.GetStringBytes("side")) {
+		case "buy":
+			side = models.SideBuy
+		case "sell":
+			side = models.SideSell
+		}
+
+		trades = append(trades, models.Trade{
+			Exchange:     a.Name(),
+			Symbol:       joinedSymbol(string(item.GetStringBytes("instId"))),
+			Price:        price,
+			Quantity:     quantity,
+			Side:         side,
+			TradeID:      string(item.GetStringBytes("tradeId")),
+			ExchangeTime: time.UnixMilli(ts),
+		})
+	}
+
+	return Frame{Trades: trades}, nil
+}
@@ -0,0 +1,112 @@
+package exchange
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/11me/calef/models"
+	"github.com/gorilla/websocket"
+	"github.com/shopspring/decimal"
+)
+
+func TestOkxSubscribeMessages(t *testing.T) {
+	msgs, err := NewOkxAdapter().SubscribeMessages(1, TradeStreams("btcusdt", "ethbtc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[{"args":[{"channel":"trades","instId":"BTC-USDT"},{"channel":"trades","instId":"ETH-BTC"}],"op":"subscribe"}]`
+	if string(data) != want {
+		t.Fatalf("got %s, want %s", data, want)
+	}
+
+	if _, err := NewOkxAdapter().SubscribeMessages(1, QuoteStreams("btcusdt")); err == nil {
+		t.Fatal("expected unsupported channel error")
+	}
+}
+
+func TestOkxReplay(t *testing.T) {
+	recorded := frames(t, "okx.txt")
+	pings := make(chan string, 1)
+
+	server := newStandIn(t, func(n int, conn *websocket.Conn) {
+		var req map[string]any
+		if !readJSON(t, conn, &req) {
+			return
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte(recorded["subscribe"]))
+
+		// The keepalive is a text ping answered with a text pong.
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Errorf("failed to read ping: %v", err)
+			return
+		}
+
+		pings <- string(msg)
+		conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+		conn.WriteMessage(websocket.TextMessage, []byte(recorded["trades"]))
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+
+	adapter := NewOkxAdapter()
+	adapter.BaseURL = server.wsURL()
+	adapter.PingInterval = 50 * time.Millisecond
+
+	c, nc := newTestConsumer(t, adapter)
+	ticks := collect(t, nc, "okx.ticks.btcusdt")
+
+	if err := c.Acquire(TradeStreams("btcusdt")...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ping := <-pings:
+		if ping != "ping" {
+			t.Fatalf("got ping %q", ping)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ping sent")
+	}
+
+	assertTrade(t, next(t, ticks), "okx", "btcusdt", models.Trade{
+		Price: decimal.RequireFromString("67012.5"), Quantity: decimal.RequireFromString("0.00113"), Side: models.SideBuy,
+		TradeID: "535123891", ExchangeTime: time.UnixMilli(1729152000229),
+	})
+	assertTrade(t, next(t, ticks), "okx", "btcusdt", models.Trade{
+		Price: decimal.RequireFromString("67012.4"), Quantity: decimal.RequireFromString("0.0421"), Side: models.SideSell,
+		TradeID: "535123892", ExchangeTime: time.UnixMilli(1729152000231),
+	})
+}
+
+func TestOkxNormalize(t *testing.T) {
+	recorded := frames(t, "okx.txt")
+	adapter := NewOkxAdapter()
+
+	for _, data := range []string{recorded["subscribe"], "pong"} {
+		frame, err := adapter.Normalize([]byte(data))
+		if err != nil || len(frame.Trades) > 0 {
+			t.Errorf("%s: expected empty frame, got %+v, %v", data, frame, err)
+		}
+	}
+
+	if _, err := adapter.Normalize([]byte(recorded["error"])); err == nil {
+		t.Error("expected error event to fail")
+	}
+}
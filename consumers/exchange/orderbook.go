@@ -0,0 +1,242 @@
+package exchange
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/11me/calef/models"
+)
+
+const (
+	// maxBufferedDiffs bounds diffs buffered while a snapshot is fetched.
+	maxBufferedDiffs = 1000
+	// bookResyncDelay throttles snapshot requests after a failed one.
+	bookResyncDelay = 2 * time.Second
+)
+
+// orderBook is a local copy of a venue order book maintained from a REST
+// snapshot and the depth diff stream.
+type orderBook struct {
+	exchange string
+	symbol   string
+
+	mu sync.Mutex
+	// synced is set once a snapshot is loaded, until then diffs are buffered.
+	synced bool
+	// syncing is set while a snapshot is being fetched.
+	syncing bool
+	buffer  []models.DepthUpdate
+	// awaitingFirst is set until the first diff continuing the snapshot is applied.
+	awaitingFirst bool
+	lastUpdateID  int64
+	exchangeTime  time.Time
+	bids          bookSide
+	asks          bookSide
+}
+
+// bookSide holds the levels of a book side by price. Decimals aren't
+// comparable, levels are keyed by the price string without trailing zeros.
+type bookSide map[string]models.PriceLevel
+
+func newOrderBook(exchange, symbol string) *orderBook {
+	return &orderBook{
+		exchange: exchange,
+		symbol:   symbol,
+		bids:     make(bookSide),
+		asks:     make(bookSide),
+	}
+}
+
+// apply applies a live diff. It returns whether the book changed and whether
+// a snapshot must be fetched, which happens before the first sync and after
+// the stream skipped updates.
+func (b *orderBook) apply(u models.DepthUpdate) (changed, needSnapshot bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.synced {
+		last := b.lastUpdateID
+		if b.step(u) {
+			return b.lastUpdateID != last, false
+		}
+
+		b.reset()
+	}
+
+	if len(b.buffer) >= maxBufferedDiffs {
+		b.buffer = b.buffer[1:]
+	}
+
+	b.buffer = append(b.buffer, u)
+
+	if b.syncing {
+		return false, false
+	}
+
+	b.syncing = true
+
+	return false, true
+}
+
+// load replaces the book with the snapshot and applies buffered diffs. It
+// returns false when the buffered diffs don't continue the snapshot, a newer
+// snapshot is needed then.
+func (b *orderBook) load(snapshot models.OrderBook) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.syncing = false
+
+	clear(b.bids)
+	clear(b.asks)
+
+	applyLevels(b.bids, snapshot.Bids)
+	applyLevels(b.asks, snapshot.Asks)
+
+	b.lastUpdateID = snapshot.LastUpdateID
+	b.exchangeTime = snapshot.ExchangeTime
+	b.awaitingFirst = true
+	b.synced = true
+
+	buffer := b.buffer
+	b.buffer = nil
+
+	for _, u := range buffer {
+		if !b.step(u) {
+			b.reset()
+			return false
+		}
+	}
+
+	return true
+}
+
+// abort marks a failed snapshot request, the next diff requests another one.
+func (b *orderBook) abort() {
+	b.mu.Lock()
+	b.syncing = false
+	b.mu.Unlock()
+}
+
+// step applies a diff to a synced book, it returns false when the diff
+// doesn't continue the book. Diffs already applied, e.g. read from both
+// connections while one is rotated, are skipped. The caller must hold mu.
+func (b *orderBook) step(u models.DepthUpdate) bool {
+	switch {
+	case b.awaitingFirst:
+		if u.FinalUpdateID < b.lastUpdateID {
+			// Already contained in the snapshot.
+			return true
+		}
+
+		if u.FirstUpdateID > b.lastUpdateID+1 {
+			return false
+		}
+
+		b.awaitingFirst = false
+	case u.FinalUpdateID <= b.lastUpdateID:
+		return true
+	case u.PrevFinalUpdateID != 0:
+		if u.PrevFinalUpdateID != b.lastUpdateID {
+			return false
+		}
+	case u.FirstUpdateID != b.lastUpdateID+1:
+		return false
+	}
+
+	applyLevels(b.bids, u.Bids)
+	applyLevels(b.asks, u.Asks)
+
+	b.lastUpdateID = u.FinalUpdateID
+	b.exchangeTime = u.ExchangeTime
+
+	return true
+}
+
+// reset drops the book state, the caller must hold mu.
+func (b *orderBook) reset() {
+	b.synced = false
+	b.awaitingFirst = false
+	clear(b.bids)
+	clear(b.asks)
+}
+
+// top returns the book with at most n levels per side, zero means all levels.
+func (b *orderBook) top(n int) models.OrderBook {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return models.OrderBook{
+		Exchange:     b.exchange,
+		Symbol:       b.symbol,
+		LastUpdateID: b.lastUpdateID,
+		Bids:         topLevels(b.bids, n, true),
+		Asks:         topLevels(b.asks, n, false),
+		ExchangeTime: b.exchangeTime,
+	}
+}
+
+func applyLevels(side bookSide, levels []models.PriceLevel) {
+	for _, l := range levels {
+		if l.Quantity.IsZero() {
+			delete(side, l.Price.String())
+			continue
+		}
+
+		side[l.Price.String()] = l
+	}
+}
+
+func topLevels(side bookSide, n int, desc bool) []models.PriceLevel {
+	levels := slices.Collect(maps.Values(side))
+
+	slices.SortFunc(levels, func(a, b models.PriceLevel) int {
+		if desc {
+			return b.Price.Cmp(a.Price)
+		}
+
+		return a.Price.Cmp(b.Price)
+	})
+
+	if n > 0 && len(levels) > n {
+		levels = levels[:n]
+	}
+
+	return levels
+}
+
+// orderBooks holds the books of a consumer by symbol.
+type orderBooks struct {
+	exchange string
+
+	mu    sync.Mutex
+	books map[string]*orderBook
+}
+
+func newOrderBooks(exchange string) *orderBooks {
+	return &orderBooks{
+		exchange: exchange,
+		books:    make(map[string]*orderBook),
+	}
+}
+
+func (ob *orderBooks) get(symbol string) *orderBook {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	book, ok := ob.books[symbol]
+	if !ok {
+		book = newOrderBook(ob.exchange, symbol)
+		ob.books[symbol] = book
+	}
+
+	return book
+}
+
+func (ob *orderBooks) remove(symbol string) {
+	ob.mu.Lock()
+	delete(ob.books, symbol)
+	ob.mu.Unlock()
+}
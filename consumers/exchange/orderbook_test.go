@@ -0,0 +1,233 @@
+package exchange
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/11me/calef/models"
+	"github.com/shopspring/decimal"
+)
+
+// levels builds price levels from price, quantity pairs.
+func levels(pairs ...string) []models.PriceLevel {
+	out := make([]models.PriceLevel, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		out = append(out, models.PriceLevel{
+			Price:    decimal.RequireFromString(pairs[i]),
+			Quantity: decimal.RequireFromString(pairs[i+1]),
+		})
+	}
+
+	return out
+}
+
+// equalLevels compares price levels by value.
+func equalLevels(a, b []models.PriceLevel) bool {
+	return slices.EqualFunc(a, b, func(x, y models.PriceLevel) bool {
+		return x.Price.Equal(y.Price) && x.Quantity.Equal(y.Quantity)
+	})
+}
+
+func TestOrderBook(t *testing.T) {
+	snapshot := models.OrderBook{
+		LastUpdateID: 100,
+		Bids:         levels("100", "1", "99", "2"),
+		Asks:         levels("101", "1", "102", "3"),
+	}
+
+	tests := []struct {
+		name string
+		// buffered diffs arrive before the snapshot, live diffs after it.
+		buffered []models.DepthUpdate
+		live     []models.DepthUpdate
+		// loaded is whether the buffered diffs continue the snapshot.
+		loaded bool
+		// resync is whether the last live diff requests a snapshot.
+		resync bool
+		// unchanged is whether the last live diff leaves the book as is.
+		unchanged    bool
+		lastUpdateID int64
+		bids, asks   []models.PriceLevel
+	}{
+		{
+			name: "stale diffs are dropped",
+			buffered: []models.DepthUpdate{
+				{FirstUpdateID: 90, FinalUpdateID: 95, PrevFinalUpdateID: 89, Bids: levels("100", "5")},
+				{FirstUpdateID: 96, FinalUpdateID: 101, PrevFinalUpdateID: 95, Bids: levels("99", "0")},
+			},
+			loaded:       true,
+			lastUpdateID: 101,
+			bids:         levels("100", "1"),
+			asks:         levels("101", "1", "102", "3"),
+		},
+		{
+			// Levels are matched by price regardless of trailing zeros.
+			name: "first diff bridges the snapshot",
+			buffered: []models.DepthUpdate{
+				{FirstUpdateID: 98, FinalUpdateID: 101, PrevFinalUpdateID: 97, Bids: levels("98", "4"), Asks: levels("101.00", "0")},
+			},
+			live: []models.DepthUpdate{
+				{FirstUpdateID: 102, FinalUpdateID: 104, PrevFinalUpdateID: 101, Asks: levels("103", "2")},
+			},
+			loaded:       true,
+			lastUpdateID: 104,
+			bids:         levels("100", "1", "99", "2", "98", "4"),
+			asks:         levels("102", "3", "103", "2"),
+		},
+		{
+			name: "first diff after a live snapshot bridges it",
+			live: []models.DepthUpdate{
+				{FirstUpdateID: 95, FinalUpdateID: 99, PrevFinalUpdateID: 94, Bids: levels("100", "5")},
+				{FirstUpdateID: 100, FinalUpdateID: 102, PrevFinalUpdateID: 99, Bids: levels("99", "0")},
+			},
+			loaded:       true,
+			lastUpdateID: 102,
+			bids:         levels("100", "1"),
+			asks:         levels("101", "1", "102", "3"),
+		},
+		{
+			name: "first diff past the snapshot",
+			buffered: []models.DepthUpdate{
+				{FirstUpdateID: 103, FinalUpdateID: 105, PrevFinalUpdateID: 102, Bids: levels("98", "4")},
+			},
+		},
+		{
+			name: "pu mismatch resyncs",
+			buffered: []models.DepthUpdate{
+				{FirstUpdateID: 99, FinalUpdateID: 101, PrevFinalUpdateID: 98},
+			},
+			live: []models.DepthUpdate{
+				{FirstUpdateID: 104, FinalUpdateID: 106, PrevFinalUpdateID: 103, Bids: levels("98", "4")},
+			},
+			loaded: true,
+			resync: true,
+		},
+		{
+			name: "replayed diffs are skipped",
+			buffered: []models.DepthUpdate{
+				{FirstUpdateID: 99, FinalUpdateID: 101, PrevFinalUpdateID: 98},
+			},
+			live: []models.DepthUpdate{
+				{FirstUpdateID: 102, FinalUpdateID: 104, PrevFinalUpdateID: 101, Asks: levels("103", "2")},
+				{FirstUpdateID: 99, FinalUpdateID: 101, PrevFinalUpdateID: 98, Asks: levels("103", "5")},
+				{FirstUpdateID: 102, FinalUpdateID: 104, PrevFinalUpdateID: 101, Asks: levels("103", "2")},
+			},
+			loaded:       true,
+			unchanged:    true,
+			lastUpdateID: 104,
+			bids:         levels("100", "1", "99", "2"),
+			asks:         levels("101", "1", "102", "3", "103", "2"),
+		},
+		{
+			name: "spot diffs continue the update ids",
+			buffered: []models.DepthUpdate{
+				{FirstUpdateID: 99, FinalUpdateID: 101},
+			},
+			live: []models.DepthUpdate{
+				{FirstUpdateID: 102, FinalUpdateID: 103, Asks: levels("102", "0")},
+			},
+			loaded:       true,
+			lastUpdateID: 103,
+			bids:         levels("100", "1", "99", "2"),
+			asks:         levels("101", "1"),
+		},
+		{
+			name: "replayed spot diff is skipped",
+			buffered: []models.DepthUpdate{
+				{FirstUpdateID: 99, FinalUpdateID: 101},
+			},
+			live: []models.DepthUpdate{
+				{FirstUpdateID: 102, FinalUpdateID: 103, Asks: levels("102", "0")},
+				{FirstUpdateID: 102, FinalUpdateID: 103, Asks: levels("102", "0")},
+			},
+			loaded:       true,
+			unchanged:    true,
+			lastUpdateID: 103,
+			bids:         levels("100", "1", "99", "2"),
+			asks:         levels("101", "1"),
+		},
+		{
+			name: "spot diff skipping ids resyncs",
+			buffered: []models.DepthUpdate{
+				{FirstUpdateID: 99, FinalUpdateID: 101},
+			},
+			live: []models.DepthUpdate{
+				{FirstUpdateID: 103, FinalUpdateID: 104},
+			},
+			loaded: true,
+			resync: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newOrderBook("binancef", "btcusdt")
+
+			for i, u := range tt.buffered {
+				if changed, need := b.apply(u); changed || need != (i == 0) {
+					t.Fatalf("buffered diff %d: changed %v, need snapshot %v", i, changed, need)
+				}
+			}
+
+			if loaded := b.load(snapshot); loaded != tt.loaded {
+				t.Fatalf("loaded %v, want %v", loaded, tt.loaded)
+			}
+
+			var changed, need bool
+			for _, u := range tt.live {
+				changed, need = b.apply(u)
+			}
+
+			if need != tt.resync || (len(tt.live) > 0 && changed != (!tt.resync && !tt.unchanged)) {
+				t.Fatalf("changed %v, need snapshot %v, want resync %v", changed, need, tt.resync)
+			}
+
+			if !tt.loaded || tt.resync {
+				if b.synced || len(b.bids) > 0 || len(b.asks) > 0 {
+					t.Fatalf("expected book to be reset, got %+v", b.top(0))
+				}
+
+				return
+			}
+
+			book := b.top(0)
+			if book.LastUpdateID != tt.lastUpdateID {
+				t.Errorf("last update %d, want %d", book.LastUpdateID, tt.lastUpdateID)
+			}
+
+			if !equalLevels(book.Bids, tt.bids) || !equalLevels(book.Asks, tt.asks) {
+				t.Errorf("got bids %v asks %v, want bids %v asks %v", book.Bids, book.Asks, tt.bids, tt.asks)
+			}
+		})
+	}
+}
+
+func TestOrderBookBufferOverflow(t *testing.T) {
+	b := newOrderBook("binancef", "btcusdt")
+
+	for i := range int64(maxBufferedDiffs + 10) {
+		changed, need := b.apply(models.DepthUpdate{FirstUpdateID: i + 1, FinalUpdateID: i + 1, PrevFinalUpdateID: i})
+		if changed || need != (i == 0) {
+			t.Fatalf("diff %d: changed %v, need snapshot %v", i, changed, need)
+		}
+	}
+
+	// The oldest diffs are dropped.
+	if len(b.buffer) != maxBufferedDiffs || b.buffer[0].FirstUpdateID != 11 {
+		t.Fatalf("buffered %d diffs from %d", len(b.buffer), b.buffer[0].FirstUpdateID)
+	}
+
+	// A snapshot older than the buffer can't be continued.
+	if b.load(models.OrderBook{LastUpdateID: 5}) {
+		t.Fatal("expected snapshot behind the buffer to fail")
+	}
+
+	// The next diff requests a newer one.
+	if _, need := b.apply(models.DepthUpdate{FirstUpdateID: 1011, FinalUpdateID: 1011, PrevFinalUpdateID: 1010}); !need {
+		t.Fatal("expected another snapshot request")
+	}
+
+	if !b.load(models.OrderBook{LastUpdateID: 1010}) || b.top(0).LastUpdateID != 1011 {
+		t.Fatalf("expected book at 1011, got %d", b.top(0).LastUpdateID)
+	}
+}
@@ -0,0 +1,53 @@
+package exchange
+
+import (
+	"sync"
+)
+
+type seqVerdict int
+
+const (
+	seqOK seqVerdict = iota
+	seqDuplicate
+	seqGap
+)
+
+// sequenceTracker remembers the last trade id per symbol. Connections
+// overlap during rotation, so it is shared by all of them.
+type sequenceTracker struct {
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+func newSequenceTracker() *sequenceTracker {
+	return &sequenceTracker{last: make(map[string]int64)}
+}
+
+// observe records the id, for a gap it returns the inclusive missed range.
+func (t *sequenceTracker) observe(symbol string, seq int64) (verdict seqVerdict, from, to int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	last, ok := t.last[symbol]
+	switch {
+	case !ok:
+		t.last[symbol] = seq
+		return seqOK, 0, 0
+	case seq <= last:
+		return seqDuplicate, 0, 0
+	case seq > last+1:
+		t.last[symbol] = seq
+		return seqGap, last + 1, seq - 1
+	default:
+		t.last[symbol] = seq
+		return seqOK, 0, 0
+	}
+}
+
+// forget drops the state of an unsubscribed symbol, so that a later
+// subscription doesn't report its downtime as a gap.
+func (t *sequenceTracker) forget(symbol string) {
+	t.mu.Lock()
+	delete(t.last, symbol)
+	t.mu.Unlock()
+}
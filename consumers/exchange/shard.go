@@ -0,0 +1,758 @@
+package exchange
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/11me/calef/models"
+	"github.com/gorilla/websocket"
+)
+
+// rotationOverlap is how long the old and the new connection are read
+// together during rotation.
+const rotationOverlap = 5 * time.Second
+
+// shard is a single websocket connection of a consumer with its own read
+// loop, reconnect state and subset of the consumer streams.
+type shard struct {
+	c     *Consumer
+	id    int
+	log   *slog.Logger
+	errCh chan error
+
+	writeMu   sync.Mutex
+	lastWrite time.Time
+
+	mu            sync.Mutex
+	conn          *websocket.Conn
+	connectedAt   time.Time
+	streams       map[Stream]struct{}
+	pending       map[uint64]*pendingRequest
+	lastErr       error
+	reconnects    int
+	rotations     int
+	lastMessageAt time.Time
+	lastDataAt    time.Time
+	// delivering is set once the current connection delivered data, events
+	// of a connection rotated out are dropped from then on.
+	delivering bool
+}
+
+// ShardHealth is a snapshot of the shard connection state.
+type ShardHealth struct {
+	ID          int       `json:"id"`
+	Connected   bool      `json:"connected"`
+	Streams     int       `json:"streams"`
+	Reconnects  int       `json:"reconnects"`
+	Rotations   int       `json:"rotations"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	LastMessage time.Time `json:"lastMessage"`
+	LastData    time.Time `json:"lastData"`
+}
+
+func newShard(c *Consumer, id int) *shard {
+	return &shard{
+		c:       c,
+		id:      id,
+		log:     c.log.With("shard", id),
+		errCh:   make(chan error, 1),
+		streams: make(map[Stream]struct{}),
+		pending: make(map[uint64]*pendingRequest),
+	}
+}
+
+func (s *shard) start() {
+	s.c.goroutine(s.reconnect)
+	s.c.goroutine(s.watchdog)
+
+	s.c.publishEvent(models.ConnEvent{Shard: s.id, State: models.ConnConnecting})
+
+	conn, streams, err := s.connect()
+	if err != nil {
+		s.fail(err)
+		return
+	}
+
+	s.setConn(conn)
+	s.resync(conn, streams)
+
+	s.log.Info("connected to exchange")
+	s.c.publishEvent(models.ConnEvent{Shard: s.id, State: models.ConnConnected})
+
+	s.c.goroutine(func() { s.readTicks(conn) })
+}
+
+// stop closes the connection, it returns the last connection error when
+// the shard wasn't connected.
+func (s *shard) stop() error {
+	s.mu.Lock()
+	conn := s.conn
+	lastErr := s.lastErr
+	s.mu.Unlock()
+
+	s.setConn(nil)
+
+	s.c.publishEvent(models.ConnEvent{Shard: s.id, State: models.ConnStopped})
+
+	if conn == nil {
+		if lastErr != nil {
+			return fmt.Errorf("shard %d: %w", s.id, lastErr)
+		}
+
+		return nil
+	}
+
+	s.writeMu.Lock()
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	s.writeMu.Unlock()
+
+	return conn.Close()
+}
+
+// fail hands the connection error over to the reconnect loop.
+func (s *shard) fail(err error) {
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+
+	select {
+	case s.errCh <- err:
+	case <-s.c.ctx.Done():
+	}
+}
+
+// connect dials a new connection subscribed to the streams of the shard, it
+// returns the streams subscribed.
+func (s *shard) connect() (*websocket.Conn, []Stream, error) {
+	url := s.c.adapter.URL()
+
+	s.log.Info(fmt.Sprintf("connecting to %s %q", s.c.adapter.Name(), url))
+
+	conn, _, err := websocket.DefaultDialer.DialContext(s.c.ctx, url, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial %s: %w", s.c.adapter.Name(), err)
+	}
+
+	s.setupDeadlines(conn)
+
+	if opener, ok := s.c.adapter.(Opener); ok {
+		if err := s.write(conn, opener.OpenMessages()); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("failed to open connection to %s: %w", s.c.adapter.Name(), err)
+		}
+	}
+
+	streams := s.subscribed()
+	if len(streams) > 0 {
+		// Acks are read by readTicks later, they are not waited for.
+		msgs, err := s.c.adapter.SubscribeMessages(s.c.nextID.Add(1), streams)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+
+		if err := s.write(conn, msgs); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("failed to subscribe to tickers on %s: %w", s.c.adapter.Name(), err)
+		}
+	}
+
+	return conn, streams, nil
+}
+
+// resync catches up the new current connection with streams acquired or
+// released while it was connecting, their requests went to the previous
+// connection or none.
+func (s *shard) resync(conn *websocket.Conn, subscribed []Stream) {
+	was := make(map[Stream]bool, len(subscribed))
+	for _, stream := range subscribed {
+		was[stream] = true
+	}
+
+	var added, removed []Stream
+	for _, stream := range s.subscribed() {
+		if !was[stream] {
+			added = append(added, stream)
+		}
+
+		delete(was, stream)
+	}
+
+	for stream := range was {
+		removed = append(removed, stream)
+	}
+
+	for _, req := range []struct {
+		streams []Stream
+		build   func(uint64, []Stream) ([]any, error)
+	}{
+		{added, s.c.adapter.SubscribeMessages},
+		{removed, s.c.adapter.UnsubscribeMessages},
+	} {
+		if len(req.streams) == 0 {
+			continue
+		}
+
+		msgs, err := req.build(s.c.nextID.Add(1), req.streams)
+		if err == nil {
+			err = s.write(conn, msgs)
+		}
+
+		if err != nil {
+			s.log.Error("failed to resync streams", "streams", req.streams, "err", err)
+		}
+	}
+}
+
+func (s *shard) reconnect() {
+	var b backoff
+
+	for {
+		var err error
+
+		select {
+		case <-s.c.ctx.Done():
+			return
+		case err = <-s.errCh:
+		}
+
+		s.log.Error(fmt.Sprintf("connection was closed with error: %v, reconnection", err))
+
+		s.mu.Lock()
+		failed := s.conn
+		s.mu.Unlock()
+
+		s.setConn(nil)
+
+		// The error may come from a writer or the watchdog while the reader
+		// still blocks on the socket.
+		if failed != nil {
+			failed.Close()
+		}
+
+		s.c.publishEvent(models.ConnEvent{Shard: s.id, State: models.ConnDisconnected, Error: err.Error()})
+
+		var (
+			conn    *websocket.Conn
+			streams []Stream
+		)
+
+		for {
+			timeout := b.next()
+
+			select {
+			case <-s.c.ctx.Done():
+				return
+			case <-time.After(timeout):
+			}
+
+			s.c.publishEvent(models.ConnEvent{Shard: s.id, State: models.ConnConnecting, Attempt: b.attempt})
+
+			var connErr error
+
+			conn, streams, connErr = s.connect()
+			if connErr != nil {
+				s.mu.Lock()
+				s.lastErr = connErr
+				s.mu.Unlock()
+
+				s.log.Error(fmt.Sprintf("error reconnection: %v, attempt %d", connErr, b.attempt))
+				s.c.publishEvent(models.ConnEvent{Shard: s.id, State: models.ConnDisconnected, Attempt: b.attempt, Error: connErr.Error()})
+
+				continue
+			}
+
+			// Success.
+			break
+		}
+
+		b.reset()
+
+		s.mu.Lock()
+		s.reconnects++
+		s.mu.Unlock()
+
+		s.setConn(conn)
+		s.resync(conn, streams)
+
+		s.log.Info("Succesfully reconnected")
+		s.c.publishEvent(models.ConnEvent{Shard: s.id, State: models.ConnConnected})
+
+		s.c.goroutine(func() { s.readTicks(conn) })
+	}
+}
+
+// setupDeadlines makes a half-open connection fail reads after ReadTimeout,
+// any frame from the venue including pings and pongs extends the deadline.
+func (s *shard) setupDeadlines(conn *websocket.Conn) {
+	timeout := s.c.keepalive.ReadTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(timeout))
+	})
+
+	conn.SetPingHandler(func(data string) error {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+
+		return err
+	})
+}
+
+func (s *shard) setConn(conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn = conn
+	if conn != nil {
+		s.lastErr = nil
+		s.connectedAt = time.Now()
+		s.lastDataAt = s.connectedAt
+	}
+
+	// Requests sent over the previous connection will never be acknowledged.
+	if conn == nil {
+		for id, req := range s.pending {
+			req.done <- errors.New("connection closed")
+			delete(s.pending, id)
+		}
+	}
+}
+
+func (s *shard) readTicks(conn *websocket.Conn) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	if pinger, ok := s.c.adapter.(Pinger); ok {
+		s.c.goroutine(func() { s.heartbeat(conn, pinger, stop) })
+	}
+
+	if s.c.keepalive.PingInterval > 0 {
+		s.c.goroutine(func() { s.ping(conn, stop) })
+	}
+
+	for {
+		select {
+		case <-s.c.ctx.Done():
+			return
+		default:
+		}
+
+		_, msg, err := conn.ReadMessage()
+		receivedAt := time.Now()
+		if err != nil {
+			if !s.isCurrent(conn) {
+				// The connection was rotated out.
+				return
+			}
+
+			s.log.Error(fmt.Sprintf("error reading message for symbol: %v", err))
+			s.fail(err)
+
+			return
+		}
+
+		if timeout := s.c.keepalive.ReadTimeout; timeout > 0 {
+			conn.SetReadDeadline(receivedAt.Add(timeout))
+		}
+
+		s.mu.Lock()
+		s.lastMessageAt = receivedAt
+		current, superseded := s.conn == conn, s.conn != conn && s.delivering
+		s.mu.Unlock()
+
+		frame, err := s.c.adapter.Normalize(msg)
+		if err != nil {
+			s.log.Error("failed to normalize message", "value", string(msg), "err", err)
+
+			continue
+		}
+
+		if frame.Ack != nil {
+			s.resolve(frame.Ack)
+		}
+
+		if superseded {
+			// The connection is rotated out and the new one publishes the
+			// same events. Trades and depth diffs are deduplicated by id,
+			// other events would be published twice.
+			frame.Quotes, frame.Marks, frame.Liquidations, frame.Klines = nil, nil, nil, nil
+		}
+
+		if len(frame.Trades) > 0 || len(frame.Depth) > 0 || len(frame.Quotes) > 0 || len(frame.Marks) > 0 ||
+			len(frame.Liquidations) > 0 || len(frame.Klines) > 0 {
+			s.mu.Lock()
+			s.lastDataAt = receivedAt
+			if current {
+				s.delivering = true
+			}
+			s.mu.Unlock()
+		}
+
+		for i := range frame.Trades {
+			frame.Trades[i].ReceiveTime = receivedAt
+			s.c.handleTrade(&frame.Trades[i])
+		}
+
+		for _, update := range frame.Depth {
+			s.c.handleDepth(update)
+		}
+
+		for i := range frame.Quotes {
+			frame.Quotes[i].ReceiveTime = receivedAt
+			s.c.publishQuote(&frame.Quotes[i])
+		}
+
+		for i := range frame.Marks {
+			s.c.publishMarkPrice(&frame.Marks[i])
+		}
+
+		for i := range frame.Liquidations {
+			s.c.publishLiquidation(&frame.Liquidations[i])
+		}
+
+		for i := range frame.Klines {
+			s.c.publishKline(&frame.Klines[i])
+		}
+	}
+}
+
+// heartbeat sends application level heartbeats until stop is closed.
+func (s *shard) heartbeat(conn *websocket.Conn, pinger Pinger, stop <-chan struct{}) {
+	msg, interval := pinger.PingMessage()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.c.ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.writeMu.Lock()
+		s.throttle()
+		err := conn.WriteMessage(websocket.TextMessage, msg)
+		s.writeMu.Unlock()
+
+		if err != nil {
+			s.log.Error("failed to send heartbeat", "err", err)
+
+			// The read loop fails and reconnects.
+			conn.Close()
+
+			return
+		}
+	}
+}
+
+// ping sends websocket pings until stop is closed, pongs extend the read deadline.
+func (s *shard) ping(conn *websocket.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(s.c.keepalive.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.c.ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+		if err != nil {
+			s.log.Error("failed to send ping", "err", err)
+
+			// The read loop fails and reconnects.
+			conn.Close()
+
+			return
+		}
+	}
+}
+
+// watchdog reconnects a connection that stopped delivering market data and
+// rotates connections before the venue closes them.
+func (s *shard) watchdog() {
+	k := s.c.keepalive
+
+	if k.StaleTimeout <= 0 && s.c.limits.MaxLifetime <= 0 {
+		return
+	}
+
+	interval := time.Minute
+	if k.StaleTimeout > 0 {
+		interval = min(interval, k.StaleTimeout/4)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		conn := s.conn
+		connectedAt := s.connectedAt
+		lastDataAt := s.lastDataAt
+		// Liquidations are legitimately quiet for long, they can't tell a
+		// stale connection.
+		streams := 0
+		for stream := range s.streams {
+			if stream.Channel != ChannelLiquidations {
+				streams++
+			}
+		}
+		s.mu.Unlock()
+
+		if conn == nil {
+			continue
+		}
+
+		if k.StaleTimeout > 0 && streams > 0 && time.Since(lastDataAt) > k.StaleTimeout {
+			s.log.Warn(fmt.Sprintf("no market data since %v, closing stale connection", lastDataAt))
+			s.c.publishEvent(models.ConnEvent{Shard: s.id, State: models.ConnStale})
+
+			// The read loop fails and reconnects.
+			conn.Close()
+
+			continue
+		}
+
+		if lifetime := s.c.limits.MaxLifetime; lifetime > 0 && time.Since(connectedAt) > lifetime-k.RotateBefore {
+			s.rotate(conn)
+		}
+	}
+}
+
+// rotate replaces the connection in make-before-break fashion: the new
+// connection is subscribed and read before the old one is closed. Trades and
+// depth diffs of the overlap are read from both, other events from the old
+// one only until the new one delivers data.
+func (s *shard) rotate(old *websocket.Conn) {
+	s.log.Info("rotating connection")
+
+	conn, streams, err := s.connect()
+	if err != nil {
+		s.log.Error("failed to rotate connection, retry later", "err", err)
+		return
+	}
+
+	s.mu.Lock()
+	if s.conn != old {
+		// Reconnected meanwhile.
+		s.mu.Unlock()
+		conn.Close()
+
+		return
+	}
+
+	s.conn = conn
+	s.connectedAt = time.Now()
+	s.delivering = false
+	s.rotations++
+	s.mu.Unlock()
+
+	s.resync(conn, streams)
+
+	s.c.goroutine(func() { s.readTicks(conn) })
+
+	select {
+	case <-s.c.ctx.Done():
+	case <-time.After(rotationOverlap):
+	}
+
+	s.writeMu.Lock()
+	old.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	s.writeMu.Unlock()
+
+	old.Close()
+
+	s.log.Info("connection rotated")
+	s.c.publishEvent(models.ConnEvent{Shard: s.id, State: models.ConnRotated})
+}
+
+func (s *shard) isCurrent(conn *websocket.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn == conn
+}
+
+func (s *shard) write(conn *websocket.Conn, msgs []any) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	for _, msg := range msgs {
+		s.throttle()
+
+		if err := conn.WriteJSON(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// throttle keeps outgoing messages within the venue rate limit, the caller
+// must hold writeMu.
+func (s *shard) throttle() {
+	if s.c.limits.MaxMessagesPerSecond > 0 {
+		gap := time.Second / time.Duration(s.c.limits.MaxMessagesPerSecond)
+		if wait := time.Until(s.lastWrite.Add(gap)); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	s.lastWrite = time.Now()
+}
+
+// request sends a (un)subscribe request on the open connection. Without a
+// connection there is nothing to do, symbols are subscribed on connect.
+func (s *shard) request(streams []Stream, build func(uint64, []Stream) ([]any, error)) error {
+	id := s.c.nextID.Add(1)
+
+	msgs, err := build(id, streams)
+	if err != nil {
+		return err
+	}
+
+	acker, ok := s.c.adapter.(Acknowledger)
+	tracked := ok && acker.Acknowledges()
+
+	s.mu.Lock()
+	conn := s.conn
+	if conn == nil {
+		s.mu.Unlock()
+		return nil
+	}
+
+	var req *pendingRequest
+	if tracked {
+		req = &pendingRequest{remaining: len(msgs), done: make(chan error, 1)}
+		s.pending[id] = req
+	}
+	s.mu.Unlock()
+
+	if err := s.write(conn, msgs); err != nil {
+		s.forget(id)
+		return fmt.Errorf("failed to send request to %s: %w", s.c.adapter.Name(), err)
+	}
+
+	if !tracked {
+		return nil
+	}
+
+	timer := time.NewTimer(ackTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-req.done:
+		return err
+	case <-timer.C:
+		s.forget(id)
+		return fmt.Errorf("request %d for %v: %w", id, streams, ErrAckTimeout)
+	case <-s.c.ctx.Done():
+		s.forget(id)
+		return s.c.ctx.Err()
+	}
+}
+
+// resolve completes the pending request once all its messages were acknowledged.
+func (s *shard) resolve(ack *Ack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, ok := s.pending[ack.ID]
+	if !ok {
+		// Requests sent on connect aren't awaited.
+		if ack.Err != nil {
+			s.log.Error("request failed", "id", ack.ID, "err", ack.Err)
+		}
+
+		return
+	}
+
+	req.remaining--
+	if ack.Err == nil && req.remaining > 0 {
+		return
+	}
+
+	delete(s.pending, ack.ID)
+	req.done <- ack.Err
+}
+
+func (s *shard) forget(id uint64) {
+	s.mu.Lock()
+	delete(s.pending, id)
+	s.mu.Unlock()
+}
+
+func (s *shard) subscribed() []Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	streams := make([]Stream, 0, len(s.streams))
+	for stream := range s.streams {
+		streams = append(streams, stream)
+	}
+
+	return streams
+}
+
+func (s *shard) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.streams)
+}
+
+func (s *shard) add(stream Stream) {
+	s.mu.Lock()
+	s.streams[stream] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *shard) remove(stream Stream) {
+	s.mu.Lock()
+	delete(s.streams, stream)
+	s.mu.Unlock()
+}
+
+func (s *shard) health() ShardHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return ShardHealth{
+		ID:          s.id,
+		Connected:   s.conn != nil,
+		Streams:     len(s.streams),
+		Reconnects:  s.reconnects,
+		Rotations:   s.rotations,
+		ConnectedAt: s.connectedAt,
+		LastMessage: s.lastMessageAt,
+		LastData:    s.lastDataAt,
+	}
+}
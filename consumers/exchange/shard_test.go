@@ -0,0 +1,65 @@
+package exchange
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestShardResync acquires and releases streams while a connection of the
+// shard is connecting, the connection catches up once it is current.
+func TestShardResync(t *testing.T) {
+	requests := make(chan bybitRequest, 4)
+
+	server := newStandIn(t, func(n int, conn *websocket.Conn) {
+		for {
+			var req bybitRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+
+			requests <- req
+		}
+	})
+
+	adapter := NewBybitAdapter()
+	adapter.BaseURL = server.wsURL()
+
+	c, _ := newTestConsumer(t, adapter)
+	s := newShard(c, 0)
+	s.add(Stream{Channel: ChannelTrades, Symbol: "btcusdt"})
+	s.add(Stream{Channel: ChannelTrades, Symbol: "ethusdt"})
+
+	conn, streams, err := s.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Requests of the meantime went to the previous connection.
+	s.add(Stream{Channel: ChannelTrades, Symbol: "solusdt"})
+	s.remove(Stream{Channel: ChannelTrades, Symbol: "ethusdt"})
+
+	s.setConn(conn)
+	s.resync(conn, streams)
+
+	want := []bybitRequest{
+		{Op: "subscribe", Args: []string{"publicTrade.BTCUSDT", "publicTrade.ETHUSDT"}},
+		{Op: "subscribe", Args: []string{"publicTrade.SOLUSDT"}},
+		{Op: "unsubscribe", Args: []string{"publicTrade.ETHUSDT"}},
+	}
+
+	for _, w := range want {
+		select {
+		case req := <-requests:
+			slices.Sort(req.Args)
+			if req.Op != w.Op || !slices.Equal(req.Args, w.Args) {
+				t.Fatalf("got request %s %v, want %s %v", req.Op, req.Args, w.Op, w.Args)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing request %s %v", w.Op, w.Args)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package exchange
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/11me/calef/models"
+)
+
+// Channel is a kind of market data a venue streams per symbol.
+type Channel string
+
+const (
+	ChannelTrades Channel = "trades"
+	ChannelDepth  Channel = "depth"
+	// ChannelQuotes is the best bid and ask.
+	ChannelQuotes Channel = "quotes"
+	// ChannelMarkPrice is the mark price and funding rate of perpetuals.
+	ChannelMarkPrice    Channel = "markprice"
+	ChannelLiquidations Channel = "liquidations"
+	// ChannelOpenInterest is polled over REST, venues don't stream it.
+	ChannelOpenInterest Channel = "openinterest"
+	// ChannelKlines is the exchange built bars of the stream timeframe.
+	ChannelKlines Channel = "klines"
+)
+
+var ErrUnsupportedChannel = errors.New("unsupported channel")
+
+// Stream is a channel of a symbol, it is the unit of subscription.
+type Stream struct {
+	Channel Channel
+	Symbol  string
+	// Timeframe is set for klines only.
+	Timeframe models.Timeframe
+}
+
+func (s Stream) String() string {
+	if s.Timeframe != 0 {
+		return fmt.Sprintf("%s@%s_%s", s.Symbol, s.Channel, s.Timeframe)
+	}
+
+	return fmt.Sprintf("%s@%s", s.Symbol, s.Channel)
+}
+
+// TradeStreams returns the trade streams of the symbols.
+func TradeStreams(symbols ...string) []Stream {
+	streams := make([]Stream, 0, len(symbols))
+	for _, symbol := range symbols {
+		streams = append(streams, Stream{Channel: ChannelTrades, Symbol: symbol})
+	}
+
+	return streams
+}
+
+// QuoteStreams returns the quote streams of the symbols.
+func QuoteStreams(symbols ...string) []Stream {
+	streams := make([]Stream, 0, len(symbols))
+	for _, symbol := range symbols {
+		streams = append(streams, Stream{Channel: ChannelQuotes, Symbol: symbol})
+	}
+
+	return streams
+}
+
+// KlineStream returns the kline stream of the symbol.
+func KlineStream(symbol string, tf models.Timeframe) Stream {
+	return Stream{Channel: ChannelKlines, Symbol: symbol, Timeframe: tf}
+}
+
+// tradeSymbols returns symbols of trade streams for adapters that support
+// nothing but trades.
+func tradeSymbols(venue string, streams []Stream) ([]string, error) {
+	symbols := make([]string, 0, len(streams))
+	for _, s := range streams {
+		if s.Channel != ChannelTrades {
+			return nil, fmt.Errorf("%s %s: %w", venue, s.Channel, ErrUnsupportedChannel)
+		}
+
+		symbols = append(symbols, s.Symbol)
+	}
+
+	return symbols, nil
+}
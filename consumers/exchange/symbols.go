@@ -0,0 +1,53 @@
+package exchange
+
+import (
+	"strings"
+)
+
+// quoteAssets are the quote currencies recognized when splitting concatenated
+// symbols. Longer assets sharing a suffix go first, e.g. "fdusd" before "usd".
+var quoteAssets = []string{
+	"fdusd", "usdt", "usdc", "busd", "tusd", "dai", "usd",
+	"eur", "gbp", "try", "btc", "eth", "bnb",
+}
+
+// splitSymbol splits a concatenated symbol like "btcusdt" into base and quote.
+func splitSymbol(symbol string) (base, quote string, ok bool) {
+	symbol = strings.ToLower(symbol)
+
+	for _, q := range quoteAssets {
+		if base, ok := strings.CutSuffix(symbol, q); ok && base != "" {
+			return base, q, true
+		}
+	}
+
+	return "", "", false
+}
+
+// QuoteAsset returns the quote currency of a concatenated symbol like
+// "btcusdt", ok is false when it isn't recognized.
+func QuoteAsset(symbol string) (quote string, ok bool) {
+	_, quote, ok = splitSymbol(symbol)
+	return quote, ok
+}
+
+// dashedSymbol converts "btcusdt" to the "BTC-USDT" notation. Symbols with an
+// unknown quote are upper-cased as is.
+func dashedSymbol(symbol string) string {
+	base, quote, ok := splitSymbol(symbol)
+	if !ok {
+		return strings.ToUpper(symbol)
+	}
+
+	return strings.ToUpper(base + "-" + quote)
+}
+
+// joinedSymbol converts "BTC-USDT" to the "btcusdt" notation used in subjects.
+func joinedSymbol(symbol string) string {
+	return strings.ToLower(strings.ReplaceAll(symbol, "-", ""))
+}
+
+// normalizeSymbol returns the symbol in the notation used in subjects.
+func normalizeSymbol(symbol string) string {
+	return strings.ToLower(strings.TrimSpace(symbol))
+}
@@ -0,0 +1,198 @@
+package monitors
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/consumers"
+	"github.com/11me/calef/consumers/exchange"
+	"github.com/11me/calef/models"
+	"github.com/expr-lang/expr/ast"
+	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+// Futures variables are named "<var>_<field>" in formulas, e.g. btcusdt_funding.
+const (
+	fieldMark    = "mark"
+	fieldIndex   = "index"
+	fieldFunding = "funding"
+	fieldOI      = "oi"
+	// fieldLiq is the notional liquidated within the current bar.
+	fieldLiq = "liq"
+)
+
+var fieldChannels = map[string]exchange.Channel{
+	fieldMark:    exchange.ChannelMarkPrice,
+	fieldIndex:   exchange.ChannelMarkPrice,
+	fieldFunding: exchange.ChannelMarkPrice,
+	fieldOI:      exchange.ChannelOpenInterest,
+	fieldLiq:     exchange.ChannelLiquidations,
+}
+
+// liqBucket is the liquidated notional of one bar.
+type liqBucket struct {
+	start    time.Time
+	notional decimal.Decimal
+}
+
+// identifiers collects the variable names of a formula.
+type identifiers map[string]struct{}
+
+func (ids identifiers) Visit(node *ast.Node) {
+	if n, ok := (*node).(*ast.IdentifierNode); ok {
+		ids[n.Value] = struct{}{}
+	}
+}
+
+// futuresChannels returns the futures channels of every instrument whose
+// variables the formula references.
+func (pm *PortfolioMonitor) futuresChannels(ids identifiers) map[models.Instrument][]exchange.Channel {
+	channels := make(map[models.Instrument][]exchange.Channel)
+
+	for _, inst := range pm.instruments {
+		prefix := c.FormulaVar(inst) + "_"
+		seen := make(map[exchange.Channel]bool)
+
+		for id := range ids {
+			field, ok := strings.CutPrefix(id, prefix)
+			if !ok {
+				continue
+			}
+
+			ch, ok := fieldChannels[field]
+			if !ok || seen[ch] {
+				continue
+			}
+
+			seen[ch] = true
+			channels[inst] = append(channels[inst], ch)
+		}
+	}
+
+	return channels
+}
+
+// subscribeFutures subscribes to the futures streams the formula references.
+func (pm *PortfolioMonitor) subscribeFutures() {
+	for inst, channels := range pm.channels {
+		for _, ch := range channels {
+			switch ch {
+			case exchange.ChannelMarkPrice:
+				pm.consumer.Subscribe(c.MarkPriceSubj(inst.Exchange, inst.Symbol), consumers.HandlerFunc(pm.handleMarkPrice))
+			case exchange.ChannelOpenInterest:
+				pm.consumer.Subscribe(c.OpenInterestSubj(inst.Exchange, inst.Symbol), consumers.HandlerFunc(pm.handleOpenInterest))
+			case exchange.ChannelLiquidations:
+				pm.consumer.Subscribe(c.LiquidationsSubj(inst.Exchange, inst.Symbol), consumers.HandlerFunc(pm.handleLiquidation))
+			}
+		}
+	}
+}
+
+func (pm *PortfolioMonitor) handleMarkPrice(msg *nats.Msg) error {
+	var mark models.MarkPrice
+	if err := json.Unmarshal(msg.Data, &mark); err != nil {
+		pm.log.Error("failed to unmarshal mark price", "err", err, "data", string(msg.Data))
+		return consumers.Permanent(err)
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	inst := models.Instrument{Exchange: mark.Exchange, Symbol: strings.ToLower(mark.Symbol)}
+	pm.setFutures(inst, fieldMark, mark.MarkPrice.InexactFloat64())
+	pm.setFutures(inst, fieldIndex, mark.IndexPrice.InexactFloat64())
+	pm.setFutures(inst, fieldFunding, mark.FundingRate.InexactFloat64())
+
+	return nil
+}
+
+func (pm *PortfolioMonitor) handleOpenInterest(msg *nats.Msg) error {
+	var oi models.OpenInterest
+	if err := json.Unmarshal(msg.Data, &oi); err != nil {
+		pm.log.Error("failed to unmarshal open interest", "err", err, "data", string(msg.Data))
+		return consumers.Permanent(err)
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.setFutures(models.Instrument{Exchange: oi.Exchange, Symbol: strings.ToLower(oi.Symbol)}, fieldOI, oi.OpenInterest.InexactFloat64())
+
+	return nil
+}
+
+func (pm *PortfolioMonitor) handleLiquidation(msg *nats.Msg) error {
+	var liq models.Liquidation
+	if err := json.Unmarshal(msg.Data, &liq); err != nil {
+		pm.log.Error("failed to unmarshal liquidation", "err", err, "data", string(msg.Data))
+		return consumers.Permanent(err)
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	inst := models.Instrument{Exchange: liq.Exchange, Symbol: strings.ToLower(liq.Symbol)}
+	start := liq.ExchangeTime.Truncate(time.Duration(pm.portfolio.Timeframe))
+
+	bucket, ok := pm.liqs[inst]
+	if !ok || start.After(bucket.start) {
+		bucket = &liqBucket{start: start}
+		pm.liqs[inst] = bucket
+	}
+
+	if start.Equal(bucket.start) {
+		bucket.notional = bucket.notional.Add(liq.AvgPrice.Mul(liq.Quantity))
+	}
+
+	return nil
+}
+
+// futuresReady reports whether every referenced futures value arrived.
+func (pm *PortfolioMonitor) futuresReady() bool {
+	for inst, channels := range pm.channels {
+		for _, ch := range channels {
+			switch ch {
+			case exchange.ChannelMarkPrice:
+				if _, ok := pm.futures[inst][fieldMark]; !ok {
+					return false
+				}
+			case exchange.ChannelOpenInterest:
+				if _, ok := pm.futures[inst][fieldOI]; !ok {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+func (pm *PortfolioMonitor) setFutures(inst models.Instrument, field string, value float64) {
+	values, ok := pm.futures[inst]
+	if !ok {
+		values = make(map[string]float64)
+		pm.futures[inst] = values
+	}
+
+	values[field] = value
+}
+
+// futuresParams adds the latest futures values to formula parameters, the
+// liquidated notional counts for the bar starting at start only.
+func (pm *PortfolioMonitor) futuresParams(params map[string]float64, start time.Time) {
+	for inst := range pm.channels {
+		prefix := c.FormulaVar(inst) + "_"
+
+		for field, value := range pm.futures[inst] {
+			params[prefix+field] = value
+		}
+
+		params[prefix+fieldLiq] = 0
+		if bucket, ok := pm.liqs[inst]; ok && bucket.start.Equal(start) {
+			params[prefix+fieldLiq] = bucket.notional.InexactFloat64()
+		}
+	}
+}
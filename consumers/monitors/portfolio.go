@@ -3,32 +3,75 @@ package monitors
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	c "github.com/11me/calef/common"
 	"github.com/11me/calef/consumers"
+	"github.com/11me/calef/consumers/exchange"
 	"github.com/11me/calef/models"
 	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
 	"github.com/expr-lang/expr/vm"
 	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
 )
 
+// historyTimeout bounds requesting the bar history of an instrument.
+const historyTimeout = 2 * time.Second
+
+// closedBuckets is the number of recent buckets whose closed bars are kept
+// for revisions, it covers the default late window of the aggregators.
+const closedBuckets = 4
+
+// closedBucket holds the closed bars of the instruments in a bucket.
+type closedBucket struct {
+	bars map[models.Instrument]*models.Bar
+	// revision is the revision of the next published synthetic bar.
+	revision int
+}
+
 type PortfolioMonitor struct {
 	ctx             context.Context
 	nc              *nats.Conn
 	log             *slog.Logger
 	portfolio       *models.Portfolio
 	compiledProgram *vm.Program
+	source          models.PriceSource
 	consumer        *consumers.Consumer
-
-	// currentBars holds the current bar for each symbol.
-	// NOTE: we don't need mutex here, because handler called sequentially for each symbol.
-	currentBars map[string]*models.Bar
+	instruments     []models.Instrument
+	// sumQuote reports whether the instruments share a quote asset, quote
+	// volumes are summed only then.
+	sumQuote bool
+	// closed consumes closed bars from durable JetStream consumers when set.
+	closed *consumers.Consumer
+
+	// mu serializes the handlers of both consumers.
+	mu sync.Mutex
+	// currentBars holds the current bar for each instrument.
+	currentBars map[models.Instrument]*models.Bar
+	// closedBars holds the closed bars of the recent buckets by start, late
+	// closes and revisions republish the closed synthetic bar of the bucket.
+	closedBars map[time.Time]*closedBucket
+
+	// channels lists the futures streams referenced by the formula.
+	channels map[models.Instrument][]exchange.Channel
+	futures  map[models.Instrument]map[string]float64
+	liqs     map[models.Instrument]*liqBucket
 }
 
 func NewPortfolioMonitor(ctx context.Context, nc *nats.Conn, portfilo *models.Portfolio) (*PortfolioMonitor, error) {
+	source := portfilo.PriceSource.Or(models.PriceTrade)
+	if !source.Valid() {
+		return nil, fmt.Errorf("unknown price source %q", portfilo.PriceSource)
+	}
+
 	program, err := expr.Compile(portfilo.Formula, expr.AllowUndefinedVariables())
 	if err != nil {
 		return nil, fmt.Errorf("failed to compile formula %q: %w", portfilo.Formula, err)
@@ -37,10 +80,14 @@ func NewPortfolioMonitor(ctx context.Context, nc *nats.Conn, portfilo *models.Po
 	pm := &PortfolioMonitor{
 		ctx:             ctx,
 		nc:              nc,
-		log:             slog.With("service", "PortfolioMonitor", "timeframe", portfilo.Timeframe.String()),
+		log:             slog.With("service", "PortfolioMonitor", "timeframe", portfilo.Timeframe.String(), "source", source),
 		portfolio:       portfilo,
 		compiledProgram: program,
-		currentBars:     make(map[string]*models.Bar),
+		source:          source,
+		currentBars:     make(map[models.Instrument]*models.Bar),
+		closedBars:      make(map[time.Time]*closedBucket),
+		futures:         make(map[models.Instrument]map[string]float64),
+		liqs:            make(map[models.Instrument]*liqBucket),
 		consumer:        consumers.NewConsumer(ctx, nc),
 	}
 
@@ -49,117 +96,434 @@ func NewPortfolioMonitor(ctx context.Context, nc *nats.Conn, portfilo *models.Po
 		SetConcurrency(1)
 
 	for _, symbol := range pm.portfolio.Symbols {
-		pm.consumer.Subscribe(c.BinanceBarsSubj(symbol, pm.portfolio.Timeframe), pm)
+		inst := c.ParseInstrument(symbol)
+		pm.instruments = append(pm.instruments, inst)
+		pm.consumer.Subscribe(pm.barsSubj(inst), pm)
 	}
 
+	pm.sumQuote = sharedQuote(pm.instruments)
+
+	ids := make(identifiers)
+	node := program.Node()
+	ast.Walk(&node, ids)
+
+	pm.channels = pm.futuresChannels(ids)
+	pm.subscribeFutures()
+
 	return pm, nil
 }
 
+// FuturesStreams returns the futures channels of each instrument the formula
+// references, e.g. mark price for btcusdt_funding.
+func (pm *PortfolioMonitor) FuturesStreams() map[models.Instrument][]exchange.Channel {
+	return pm.channels
+}
+
+// SetDurable consumes closed bars from durable JetStream consumers on the
+// closed bars subjects, so bars closed while the monitor was down complete
+// their synthetic bars once it is back. The portfolio id is appended to the
+// durable name. Mid price portfolios have no closed bars subjects and ignore
+// it.
+func (pm *PortfolioMonitor) SetDurable(d *consumers.Durable) *PortfolioMonitor {
+	if pm.source != models.PriceTrade {
+		return pm
+	}
+
+	durable := *d
+	durable.Name += "." + pm.portfolio.ID
+
+	pm.closed = consumers.NewConsumer(pm.ctx, pm.nc).
+		SetLogger(pm.log).
+		SetConcurrency(1).
+		SetDurable(&durable)
+
+	for _, inst := range pm.instruments {
+		pm.closed.Subscribe(c.ClosedBarsSubj(inst.Exchange, inst.Symbol, pm.portfolio.Timeframe), consumers.HandlerFunc(pm.handleClosed))
+	}
+
+	return pm
+}
+
+// barsSubj returns the subject of the instrument bars of the price source.
+func (pm *PortfolioMonitor) barsSubj(inst models.Instrument) string {
+	if pm.source == models.PriceMid {
+		return c.QuoteBarsSubj(inst.Exchange, inst.Symbol, pm.portfolio.Timeframe)
+	}
+
+	return c.BarsSubj(inst.Exchange, inst.Symbol, pm.portfolio.Timeframe)
+}
+
+// decodeBar decodes a bar of the price source, mid price bars have no volume.
+func (pm *PortfolioMonitor) decodeBar(data []byte) (models.Bar, error) {
+	if pm.source == models.PriceMid {
+		var qb models.QuoteBar
+		if err := json.Unmarshal(data, &qb); err != nil {
+			return models.Bar{}, err
+		}
+
+		return qb.MidBar(), nil
+	}
+
+	var bar models.Bar
+	err := json.Unmarshal(data, &bar)
+
+	return bar, err
+}
+
 func (pm *PortfolioMonitor) Spawn() error {
-	return pm.consumer.Start()
+	pm.replayHistory()
+
+	if pm.closed != nil {
+		if err := pm.closed.Start(); err != nil {
+			pm.stopClosed()
+			return err
+		}
+	}
+
+	if err := pm.consumer.Start(); err != nil {
+		pm.stopClosed()
+		return err
+	}
+
+	return nil
+}
+
+// replayHistory publishes closed synthetic bars of the instruments history
+// before the live ones. Formulas with futures variables aren't replayed,
+// their history isn't kept.
+func (pm *PortfolioMonitor) replayHistory() {
+	if pm.source != models.PriceTrade || len(pm.channels) > 0 {
+		return
+	}
+
+	series := make(map[time.Time]map[models.Instrument]*models.Bar)
+
+	for _, inst := range pm.instruments {
+		subj := c.HistorySubj(inst.Exchange, inst.Symbol, pm.portfolio.Timeframe)
+
+		msg, err := pm.nc.Request(subj, nil, historyTimeout)
+		if err != nil {
+			pm.log.Debug("bar history is not available", "subject", subj, "err", err)
+			return
+		}
+
+		var bars []models.Bar
+		if err := json.Unmarshal(msg.Data, &bars); err != nil {
+			pm.log.Error("failed to unmarshal bar history", "subject", subj, "err", err)
+			return
+		}
+
+		for i := range bars {
+			start := bars[i].StartTime.UTC()
+			if series[start] == nil {
+				series[start] = make(map[models.Instrument]*models.Bar, len(pm.instruments))
+			}
+
+			series[start][inst] = &bars[i]
+		}
+	}
+
+	starts := make([]time.Time, 0, len(series))
+	for start, bars := range series {
+		if len(bars) == len(pm.instruments) {
+			starts = append(starts, start)
+		}
+	}
+
+	slices.SortFunc(starts, time.Time.Compare)
+
+	subj := pm.syntheticSubj()
+	for _, start := range starts {
+		bar, err := pm.synthesize(series[start], start)
+		if err != nil {
+			return
+		}
+
+		bar.IsClosed = true
+		if err := pm.publishBar(subj, bar); err != nil {
+			pm.log.Error("failed to publish synthetic bar", "subject", subj, "err", err)
+			return
+		}
+	}
+
+	pm.log.Info(fmt.Sprintf("replayed %d historical bars", len(starts)))
+}
+
+func (pm *PortfolioMonitor) syntheticSubj() string {
+	return fmt.Sprintf("synthetic.bars.%s", pm.portfolio.Timeframe.String())
 }
 
 func (pm *PortfolioMonitor) Stop() error {
-	return pm.consumer.Stop()
+	return errors.Join(pm.consumer.Stop(), pm.stopClosed())
+}
+
+func (pm *PortfolioMonitor) stopClosed() error {
+	if pm.closed == nil {
+		return nil
+	}
+
+	return pm.closed.Stop()
 }
 
 func (pm *PortfolioMonitor) Handle(msg *nats.Msg) error {
-	var bar models.Bar
-	if err := json.Unmarshal(msg.Data, &bar); err != nil {
+	bar, err := pm.decodeBar(msg.Data)
+	if err != nil {
 		pm.log.Error("failed to unmarshal bar", "err", err, "data", string(msg.Data))
-		return err
+		return consumers.Permanent(err)
 	}
 
-	symbol := bar.Symbol
+	inst := models.Instrument{Exchange: bar.Exchange, Symbol: strings.ToLower(bar.Symbol)}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
 
-	// Update or create the aggregated bar for this symbol.
-	currentBar, exists := pm.currentBars[symbol]
-	if !exists || bar.StartTime.After(currentBar.StartTime) {
-		// New bucket; replace the old bar.
-		pm.currentBars[symbol] = &bar
-	} else {
-		// Same time bucket; aggregate the values.
-		if bar.High > currentBar.High {
-			currentBar.High = bar.High
+	// Closed bars, late ones and revisions included, complete the closed
+	// synthetic bar of their bucket. Durable monitors complete them from the
+	// closed bars consumer and only keep the current bar here.
+	if bar.IsClosed {
+		if pm.closed != nil {
+			pm.setCurrent(inst, &bar)
+			return nil
 		}
 
-		if bar.Low < currentBar.Low {
-			currentBar.Low = bar.Low
+		if bucket := pm.closeBar(inst, &bar); bucket != nil {
+			pm.setCurrent(inst, &bar)
+			return pm.publishClosed(bucket, bar.StartTime)
 		}
+	}
 
-		currentBar.Close = bar.Close
-		currentBar.Volume += bar.Volume
+	// Bars are snapshots of the bucket so far, the latest one replaces the
+	// current bar. Open bars of older buckets are ignored.
+	currentBar, exists := pm.currentBars[inst]
+	if exists && bar.StartTime.Before(currentBar.StartTime) {
+		return nil
 	}
 
+	pm.currentBars[inst] = &bar
+
 	// Only calculate the synthetic bar if bars for all symbols are available.
-	if len(pm.currentBars) < len(pm.portfolio.Symbols) {
-		pm.log.Debug("not all symbols have current bars", "current", len(pm.currentBars), "expected", len(pm.portfolio.Symbols))
+	if len(pm.currentBars) < len(pm.instruments) {
+		pm.log.Debug("not all symbols have current bars", "current", len(pm.currentBars), "expected", len(pm.instruments))
+
+		return nil
+	}
+
+	if !pm.futuresReady() {
+		pm.log.Debug("not all futures values are available")
 
 		return nil
 	}
 
+	syntheticBar, err := pm.synthesize(pm.currentBars, bar.StartTime)
+	if err != nil {
+		return err
+	}
+
+	// TODO: Handle the bar somehow. Trigger notification or smth.
+	subjSynthetic := pm.syntheticSubj()
+	if err := pm.publishBar(subjSynthetic, syntheticBar); err != nil {
+		pm.log.Error("failed to publish synthetic bar", "subject", subjSynthetic, "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// handleClosed completes the closed synthetic bar of the bucket with the
+// closed bar from the durable consumer.
+func (pm *PortfolioMonitor) handleClosed(msg *nats.Msg) error {
+	var bar models.Bar
+	if err := json.Unmarshal(msg.Data, &bar); err != nil {
+		pm.log.Error("failed to unmarshal closed bar", "err", err, "data", string(msg.Data))
+		return consumers.Permanent(err)
+	}
+
+	inst := models.Instrument{Exchange: bar.Exchange, Symbol: strings.ToLower(bar.Symbol)}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	bucket := pm.closeBar(inst, &bar)
+	if bucket == nil {
+		return nil
+	}
+
+	pm.setCurrent(inst, &bar)
+
+	return pm.publishClosed(bucket, bar.StartTime)
+}
+
+// setCurrent replaces the current bar of the instrument unless the bar is
+// older.
+func (pm *PortfolioMonitor) setCurrent(inst models.Instrument, bar *models.Bar) {
+	if currentBar, exists := pm.currentBars[inst]; !exists || !bar.StartTime.Before(currentBar.StartTime) {
+		pm.currentBars[inst] = bar
+	}
+}
+
+// closeBar records the closed bar and returns its bucket once the bars of all
+// instruments are closed.
+func (pm *PortfolioMonitor) closeBar(inst models.Instrument, bar *models.Bar) *closedBucket {
+	start := bar.StartTime.UTC()
+
+	bucket, ok := pm.closedBars[start]
+	if !ok {
+		bucket = &closedBucket{bars: make(map[models.Instrument]*models.Bar, len(pm.instruments))}
+		pm.closedBars[start] = bucket
+
+		// The oldest buckets are past the late window.
+		for len(pm.closedBars) > closedBuckets {
+			delete(pm.closedBars, slices.MinFunc(slices.Collect(maps.Keys(pm.closedBars)), time.Time.Compare))
+		}
+
+		if _, ok := pm.closedBars[start]; !ok {
+			return nil
+		}
+	}
+
+	bucket.bars[inst] = bar
+	if len(bucket.bars) < len(pm.instruments) {
+		return nil
+	}
+
+	return bucket
+}
+
+// publishClosed publishes the closed synthetic bar of the bucket, every
+// republish of the bucket is the next revision.
+func (pm *PortfolioMonitor) publishClosed(bucket *closedBucket, start time.Time) error {
+	if !pm.futuresReady() {
+		pm.log.Debug("not all futures values are available")
+
+		return nil
+	}
+
+	bar, err := pm.synthesize(bucket.bars, start)
+	if err != nil {
+		return err
+	}
+
+	bar.IsClosed = true
+	bar.Revision = bucket.revision
+	bucket.revision++
+
+	subj := pm.syntheticSubj()
+	if err := pm.publishBar(subj, bar); err != nil {
+		pm.log.Error("failed to publish synthetic bar", "subject", subj, "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// sharedQuote reports whether all instruments are quoted in the same
+// recognized asset, e.g. usdt.
+func sharedQuote(instruments []models.Instrument) bool {
+	var shared string
+	for _, inst := range instruments {
+		quote, ok := exchange.QuoteAsset(inst.Symbol)
+		if !ok || shared != "" && quote != shared {
+			return false
+		}
+
+		shared = quote
+	}
+
+	return shared != ""
+}
+
+// synthesize evaluates the formula on the bars of the instruments.
+func (pm *PortfolioMonitor) synthesize(bars map[models.Instrument]*models.Bar, start time.Time) (*models.Bar, error) {
 	openParams := make(map[string]float64)
 	highParams := make(map[string]float64)
 	lowParams := make(map[string]float64)
 	closeParams := make(map[string]float64)
-	volumeSum := float64(0)
+	vwapParams := make(map[string]float64)
 
-	for _, sym := range pm.portfolio.Symbols {
-		b, ok := pm.currentBars[strings.ToLower(sym)]
+	// Trades are summed, quote volumes only of a shared quote asset. Base
+	// volumes of different assets don't add up and are left zero. The end is
+	// the latest of the bars.
+	synthetic := &models.Bar{
+		Symbol:    pm.portfolio.Formula + ".synth",
+		StartTime: start,
+		IsClosed:  false,
+	}
+
+	for _, inst := range pm.instruments {
+		b, ok := bars[inst]
 		if !ok {
 			continue
 		}
 
-		openParams[sym] = b.Open
-		highParams[sym] = b.High
-		lowParams[sym] = b.Low
-		closeParams[sym] = b.Close
-		volumeSum += b.Volume
+		// Formulas are evaluated in floating point, decimals are converted
+		// here only.
+		v := c.FormulaVar(inst)
+		openParams[v] = b.Open.InexactFloat64()
+		highParams[v] = b.High.InexactFloat64()
+		lowParams[v] = b.Low.InexactFloat64()
+		closeParams[v] = b.Close.InexactFloat64()
+
+		// The VWAP is priced like the close without trades.
+		vwapParams[v] = b.VWAP.InexactFloat64()
+		if b.Trades == 0 || b.VWAP.IsZero() {
+			vwapParams[v] = closeParams[v]
+		}
+
+		if pm.sumQuote {
+			synthetic.QuoteVolume = synthetic.QuoteVolume.Add(b.QuoteVolume)
+		}
+
+		synthetic.Trades += b.Trades
+		if b.EndTime.After(synthetic.EndTime) {
+			synthetic.EndTime = b.EndTime
+		}
 	}
 
+	pm.futuresParams(openParams, start)
+	pm.futuresParams(highParams, start)
+	pm.futuresParams(lowParams, start)
+	pm.futuresParams(closeParams, start)
+	pm.futuresParams(vwapParams, start)
+
 	syntheticOpen, err := pm.evalFormula(openParams)
 	if err != nil {
 		pm.log.Error("failed to evaluate formula for open", "err", err)
-		return err
+		return nil, err
 	}
 
 	syntheticHigh, err := pm.evalFormula(highParams)
 	if err != nil {
 		pm.log.Error("failed to evaluate formula for high", "err", err)
-		return err
+		return nil, err
 	}
 
 	syntheticLow, err := pm.evalFormula(lowParams)
 	if err != nil {
 		pm.log.Error("failed to evaluate formula for low", "err", err)
-		return err
+		return nil, err
 	}
 
 	syntheticClose, err := pm.evalFormula(closeParams)
 	if err != nil {
 		pm.log.Error("failed to evaluate formula for close", "err", err)
-		return err
+		return nil, err
 	}
 
-	syntheticBar := models.Bar{
-		Symbol:    pm.portfolio.Formula + ".synth",
-		Open:      syntheticOpen,
-		High:      syntheticHigh,
-		Low:       syntheticLow,
-		Close:     syntheticClose,
-		Volume:    volumeSum,
-		StartTime: bar.StartTime,
-		IsClosed:  false,
+	// The VWAP of the synthetic is the formula of the VWAPs, unlike the
+	// quote volume over the summed base volume of different assets.
+	syntheticVWAP, err := pm.evalFormula(vwapParams)
+	if err != nil {
+		pm.log.Error("failed to evaluate formula for vwap", "err", err)
+		return nil, err
 	}
 
-	// TODO: Handle the bar somehow. Trigger notification or smth.
-	subjSynthetic := fmt.Sprintf("synthetic.bars.%s", pm.portfolio.Timeframe.String())
-	if err := pm.publishBar(subjSynthetic, &syntheticBar); err != nil {
-		pm.log.Error("failed to publish synthetic bar", "subject", subjSynthetic, "err", err)
-		return err
-	}
+	synthetic.Open = decimal.NewFromFloat(syntheticOpen)
+	synthetic.High = decimal.NewFromFloat(syntheticHigh)
+	synthetic.Low = decimal.NewFromFloat(syntheticLow)
+	synthetic.Close = decimal.NewFromFloat(syntheticClose)
+	synthetic.VWAP = decimal.NewFromFloat(syntheticVWAP)
 
-	return nil
+	return synthetic, nil
 }
 
 func (pm *PortfolioMonitor) evalFormula(parameters map[string]float64) (float64, error) {
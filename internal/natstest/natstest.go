@@ -0,0 +1,233 @@
+// Package natstest runs a minimal in-process NATS server for tests. It speaks
+// enough of the core protocol for publishing and subscribing with headers,
+// wildcards and queue groups; JetStream isn't supported.
+package natstest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+const info = `INFO {"server_id":"natstest","version":"2.10.0","headers":true,"max_payload":1048576,"proto":1}` + "\r\n"
+
+type subscription struct {
+	client *client
+	sid    string
+	subj   string
+	queue  string
+}
+
+type client struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+func (c *client) write(b []byte) {
+	c.writeMu.Lock()
+	c.conn.Write(b)
+	c.writeMu.Unlock()
+}
+
+// Server is a NATS server listening on a loopback port.
+type Server struct {
+	l net.Listener
+
+	mu   sync.Mutex
+	subs []*subscription
+	next int
+}
+
+// NewServer starts a server stopped with the test.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{l: l}
+	t.Cleanup(func() { l.Close() })
+
+	go s.accept()
+
+	return s
+}
+
+// Connect starts a server and connects to it, the connection is closed with
+// the test.
+func Connect(t testing.TB) *nats.Conn {
+	t.Helper()
+
+	nc, err := nats.Connect(NewServer(t).URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(nc.Close)
+
+	return nc
+}
+
+func (s *Server) URL() string { return "nats://" + s.l.Addr().String() }
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.serve(&client{conn: conn})
+	}
+}
+
+func (s *Server) serve(c *client) {
+	defer s.drop(c)
+	defer c.conn.Close()
+
+	c.write([]byte(info))
+
+	r := bufio.NewReader(c.conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(f[0]) {
+		case "PING":
+			c.write([]byte("PONG\r\n"))
+		case "SUB":
+			sub := &subscription{client: c, subj: f[1], sid: f[len(f)-1]}
+			if len(f) == 4 {
+				sub.queue = f[2]
+			}
+
+			s.mu.Lock()
+			s.subs = append(s.subs, sub)
+			s.mu.Unlock()
+		case "UNSUB":
+			s.unsubscribe(c, f[1])
+		case "PUB", "HPUB":
+			hdr := 0
+			if f[0] == "HPUB" {
+				hdr, _ = strconv.Atoi(f[len(f)-2])
+			}
+
+			total, _ := strconv.Atoi(f[len(f)-1])
+
+			payload := make([]byte, total+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+
+			reply := ""
+			if (f[0] == "PUB" && len(f) == 4) || (f[0] == "HPUB" && len(f) == 5) {
+				reply = f[2]
+			}
+
+			s.route(f[1], reply, hdr, payload[:total])
+		}
+	}
+}
+
+// route delivers the message to the matching subscriptions, one per queue
+// group.
+func (s *Server) route(subj, reply string, hdr int, payload []byte) {
+	s.mu.Lock()
+	var targets []*subscription
+	queues := make(map[string]bool)
+	for _, sub := range s.subs {
+		if !match(sub.subj, subj) {
+			continue
+		}
+
+		if sub.queue != "" {
+			if queues[sub.queue] {
+				continue
+			}
+
+			queues[sub.queue] = true
+		}
+
+		targets = append(targets, sub)
+	}
+	s.mu.Unlock()
+
+	for _, sub := range targets {
+		var head string
+		if hdr > 0 {
+			head = fmt.Sprintf("HMSG %s %s %s%d %d\r\n", subj, sub.sid, replyArg(reply), hdr, len(payload))
+		} else {
+			head = fmt.Sprintf("MSG %s %s %s%d\r\n", subj, sub.sid, replyArg(reply), len(payload))
+		}
+
+		msg := append([]byte(head), payload...)
+		sub.client.write(append(msg, '\r', '\n'))
+	}
+}
+
+func (s *Server) unsubscribe(c *client, sid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, sub := range s.subs {
+		if sub.client == c && sub.sid == sid {
+			s.subs = append(s.subs[:i], s.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Server) drop(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := s.subs[:0]
+	for _, sub := range s.subs {
+		if sub.client != c {
+			subs = append(subs, sub)
+		}
+	}
+
+	s.subs = subs
+}
+
+func replyArg(reply string) string {
+	if reply == "" {
+		return ""
+	}
+
+	return reply + " "
+}
+
+// match reports whether the subject matches the subscription with wildcards.
+func match(pattern, subj string) bool {
+	p, t := strings.Split(pattern, "."), strings.Split(subj, ".")
+
+	for i, tok := range p {
+		if tok == ">" {
+			return len(t) > i
+		}
+
+		if i >= len(t) || (tok != "*" && tok != t[i]) {
+			return false
+		}
+	}
+
+	return len(p) == len(t)
+}
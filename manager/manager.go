@@ -45,6 +45,7 @@ func (s *Manager) Evict(id string) error {
 	s.mu.Lock()
 	item, exists := s.items[id]
 	if !exists {
+		s.mu.Unlock()
 		return nil
 	}
 	delete(s.items, id)
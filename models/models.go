@@ -6,32 +6,407 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// TradeSchemaVersion is the version of the Trade wire format, version 2
+// encodes prices and quantities as decimal strings.
+const TradeSchemaVersion = "2"
+
+// Side is the aggressor side of a trade.
+type Side string
+
+const (
+	SideUnknown Side = ""
+	SideBuy     Side = "buy"
+	SideSell    Side = "sell"
+)
+
+// Trade is a venue-neutral trade published on the ticks subject.
+type Trade struct {
+	Exchange string          `json:"exchange"`
+	Symbol   string          `json:"symbol"`
+	Price    decimal.Decimal `json:"price"`
+	Quantity decimal.Decimal `json:"quantity"`
+	Side     Side            `json:"side"`
+	TradeID  string          `json:"tradeId"`
+
+	// ExchangeTime is the time the trade happened on the venue.
+	ExchangeTime time.Time `json:"exchangeTime"`
+	// ReceiveTime is the time the trade was read from the venue stream.
+	ReceiveTime time.Time `json:"receiveTime"`
+}
+
+// Quote is the best bid and ask of a symbol.
+type Quote struct {
+	Exchange string          `json:"exchange"`
+	Symbol   string          `json:"symbol"`
+	BidPrice decimal.Decimal `json:"bidPrice"`
+	BidQty   decimal.Decimal `json:"bidQty"`
+	AskPrice decimal.Decimal `json:"askPrice"`
+	AskQty   decimal.Decimal `json:"askQty"`
+	UpdateID int64           `json:"updateId"`
+
+	// ExchangeTime is zero when the venue doesn't report it.
+	ExchangeTime time.Time `json:"exchangeTime"`
+	ReceiveTime  time.Time `json:"receiveTime"`
+}
+
+func (q *Quote) Mid() decimal.Decimal { return q.BidPrice.Add(q.AskPrice).Div(decimal.NewFromInt(2)) }
+
+func (q *Quote) Spread() decimal.Decimal { return q.AskPrice.Sub(q.BidPrice) }
+
+// Time returns the exchange time, or the receive time when the venue doesn't report it.
+func (q *Quote) Time() time.Time {
+	if q.ExchangeTime.IsZero() {
+		return q.ReceiveTime
+	}
+
+	return q.ExchangeTime
+}
+
+// MarkPrice is the mark price of a perpetual contract with its funding.
+type MarkPrice struct {
+	Exchange   string          `json:"exchange"`
+	Symbol     string          `json:"symbol"`
+	MarkPrice  decimal.Decimal `json:"markPrice"`
+	IndexPrice decimal.Decimal `json:"indexPrice"`
+	// FundingRate is the rate of the upcoming funding.
+	FundingRate     decimal.Decimal `json:"fundingRate"`
+	NextFundingTime time.Time       `json:"nextFundingTime"`
+	ExchangeTime    time.Time       `json:"exchangeTime"`
+}
+
+// Liquidation is a forced order of a liquidated position. Side is the side
+// of the order, a sell liquidates a long.
+type Liquidation struct {
+	Exchange     string          `json:"exchange"`
+	Symbol       string          `json:"symbol"`
+	Side         Side            `json:"side"`
+	Price        decimal.Decimal `json:"price"`
+	AvgPrice     decimal.Decimal `json:"avgPrice"`
+	Quantity     decimal.Decimal `json:"quantity"`
+	Status       string          `json:"status"`
+	ExchangeTime time.Time       `json:"exchangeTime"`
+}
+
+// OpenInterest is the number of open contracts of a symbol.
+type OpenInterest struct {
+	Exchange     string          `json:"exchange"`
+	Symbol       string          `json:"symbol"`
+	OpenInterest decimal.Decimal `json:"openInterest"`
+	ExchangeTime time.Time       `json:"exchangeTime"`
+}
+
+// PriceLevel is an aggregated quantity at a price of an order book side.
+type PriceLevel struct {
+	Price    decimal.Decimal `json:"price"`
+	Quantity decimal.Decimal `json:"quantity"`
+}
+
+// DepthUpdate is a diff of an order book. Levels with zero quantity are removed.
+type DepthUpdate struct {
+	Exchange string `json:"exchange"`
+	Symbol   string `json:"symbol"`
+	// FirstUpdateID and FinalUpdateID are the range of book updates in the diff.
+	FirstUpdateID int64 `json:"firstUpdateId"`
+	FinalUpdateID int64 `json:"finalUpdateId"`
+	// PrevFinalUpdateID is the FinalUpdateID of the previous diff, zero when
+	// the venue doesn't provide it.
+	PrevFinalUpdateID int64        `json:"prevFinalUpdateId,omitempty"`
+	Bids              []PriceLevel `json:"bids"`
+	Asks              []PriceLevel `json:"asks"`
+	ExchangeTime      time.Time    `json:"exchangeTime"`
+}
+
+// OrderBook is an L2 order book, bids are sorted descending and asks ascending.
+type OrderBook struct {
+	Exchange     string       `json:"exchange"`
+	Symbol       string       `json:"symbol"`
+	LastUpdateID int64        `json:"lastUpdateId"`
+	Bids         []PriceLevel `json:"bids"`
+	Asks         []PriceLevel `json:"asks"`
+	ExchangeTime time.Time    `json:"exchangeTime"`
+}
+
+// ConnState is a state of an exchange websocket connection.
+type ConnState string
+
+const (
+	ConnConnecting   ConnState = "connecting"
+	ConnConnected    ConnState = "connected"
+	ConnDisconnected ConnState = "disconnected"
+	ConnStale        ConnState = "stale"
+	ConnRotated      ConnState = "rotated"
+	ConnStopped      ConnState = "stopped"
 )
 
-type BinanceAggTrade struct {
-	Symbol      string `json:"s"`
-	Price       string `json:"p"`
-	Quantity    string `json:"q"`
-	EventTimeMs int64  `json:"E"`
+// ConnEvent reports a connection state change of an exchange consumer.
+type ConnEvent struct {
+	Exchange string    `json:"exchange"`
+	Shard    int       `json:"shard"`
+	State    ConnState `json:"state"`
+	Attempt  int       `json:"attempt,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// GapEvent reports trades missed by an exchange consumer, e.g. during a reconnect.
+type GapEvent struct {
+	Exchange string `json:"exchange"`
+	Symbol   string `json:"symbol"`
+	// FromTradeID and ToTradeID are the inclusive range of missed trade ids.
+	FromTradeID int64     `json:"fromTradeId"`
+	ToTradeID   int64     `json:"toTradeId"`
+	Backfilled  int       `json:"backfilled"`
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
 }
 
+// Bar prices and volumes are exact decimals, encoded as strings in JSON.
 type Bar struct {
-	Symbol string  `json:"symbol"`
-	High   float64 `json:"high"`
-	Low    float64 `json:"low"`
-	Open   float64 `json:"open"`
-	Close  float64 `json:"close"`
+	Exchange string          `json:"exchange"`
+	Symbol   string          `json:"symbol"`
+	High     decimal.Decimal `json:"high"`
+	Low      decimal.Decimal `json:"low"`
+	Open     decimal.Decimal `json:"open"`
+	Close    decimal.Decimal `json:"close"`
+
+	Volume decimal.Decimal `json:"volume"`
+	// QuoteVolume is the traded value in the quote asset.
+	QuoteVolume decimal.Decimal `json:"quoteVolume"`
+	// VWAP is QuoteVolume / Volume rounded to decimal.DivisionPrecision
+	// places, zero without trades.
+	VWAP decimal.Decimal `json:"vwap"`
+	// BuyVolume and SellVolume are the volume of buyer and seller initiated
+	// trades, trades of unknown side count in neither.
+	BuyVolume  decimal.Decimal `json:"buyVolume"`
+	SellVolume decimal.Decimal `json:"sellVolume"`
+	Trades     int64           `json:"trades"`
+	// FirstTradeID and LastTradeID are empty without trades.
+	FirstTradeID string `json:"firstTradeId,omitempty"`
+	LastTradeID  string `json:"lastTradeId,omitempty"`
+
+	IsClosed  bool      `json:"isClosed"`
+	StartTime time.Time `json:"startTime"`
+	// EndTime is the end of the interval of time bars, the time of the last
+	// trade of other bars.
+	EndTime time.Time `json:"endTime"`
+	// Revision is incremented when a closed bar is amended by late trades.
+	Revision int `json:"revision,omitempty"`
+}
+
+// AddVolume accounts the volume of the trade, prices and trade ids are left
+// to the caller.
+func (b *Bar) AddVolume(t *Trade) {
+	b.Volume = b.Volume.Add(t.Quantity)
+	b.QuoteVolume = b.QuoteVolume.Add(t.Price.Mul(t.Quantity))
+	b.Trades++
+
+	switch t.Side {
+	case SideBuy:
+		b.BuyVolume = b.BuyVolume.Add(t.Quantity)
+	case SideSell:
+		b.SellVolume = b.SellVolume.Add(t.Quantity)
+	}
+
+	b.UpdateVWAP()
+}
+
+// MergeVolume accounts the volume of another bar, e.g. of a lower timeframe.
+func (b *Bar) MergeVolume(o *Bar) {
+	b.Volume = b.Volume.Add(o.Volume)
+	b.QuoteVolume = b.QuoteVolume.Add(o.QuoteVolume)
+	b.BuyVolume = b.BuyVolume.Add(o.BuyVolume)
+	b.SellVolume = b.SellVolume.Add(o.SellVolume)
+	b.Trades += o.Trades
+
+	b.UpdateVWAP()
+}
+
+// UpdateVWAP sets the VWAP from the volumes.
+func (b *Bar) UpdateVWAP() {
+	if b.Volume.IsPositive() {
+		b.VWAP = b.QuoteVolume.Div(b.Volume)
+	}
+}
+
+// Kline is a bar built by the exchange.
+type Kline struct {
+	Bar
+	Timeframe Timeframe `json:"timeframe"`
+}
+
+// BarSource selects what trade price bars are built from.
+type BarSource string
+
+const (
+	// BarSourceTrades aggregates bars from trades, it is the default.
+	BarSourceTrades BarSource = "trades"
+	// BarSourceKlines republishes the exchange klines as bars.
+	BarSourceKlines BarSource = "klines"
+	// BarSourceReconcile aggregates bars from trades and compares closed bars
+	// with the exchange klines.
+	BarSourceReconcile BarSource = "reconcile"
+)
+
+func (bs BarSource) Valid() bool {
+	return bs == BarSourceTrades || bs == BarSourceKlines || bs == BarSourceReconcile
+}
+
+// BarType is an information-driven bar type, bars of these types close on
+// trading activity or price moves instead of time.
+type BarType string
+
+const (
+	// BarTick closes every threshold trades.
+	BarTick BarType = "tick"
+	// BarVolume closes every threshold of traded base quantity.
+	BarVolume BarType = "volume"
+	// BarDollar closes every threshold of traded quote value.
+	BarDollar BarType = "dollar"
+	// BarImbalance closes when the tick imbalance exceeds its expectation,
+	// the threshold is the expected number of trades of the first bar.
+	BarImbalance BarType = "imbalance"
+	// BarRange closes when the price range reaches the threshold.
+	BarRange BarType = "range"
+	// BarRenko are bricks of the threshold size, a reversal needs two.
+	BarRenko BarType = "renko"
+)
+
+func (bt BarType) Valid() bool {
+	switch bt {
+	case BarTick, BarVolume, BarDollar, BarImbalance, BarRange, BarRenko:
+		return true
+	}
+
+	return false
+}
+
+// BarSpec is an information-driven bar type with its threshold.
+type BarSpec struct {
+	Type      BarType `json:"type"`
+	Threshold float64 `json:"threshold"`
+}
+
+// String returns "<type>:<threshold>", e.g. "tick:1000".
+func (bs BarSpec) String() string {
+	return string(bs.Type) + ":" + strconv.FormatFloat(bs.Threshold, 'f', -1, 64)
+}
+
+// ParseBarSpec parses "<type>:<threshold>", e.g. "dollar:1000000".
+func ParseBarSpec(s string) (BarSpec, error) {
+	typ, threshold, ok := strings.Cut(strings.ToLower(strings.TrimSpace(s)), ":")
+	if !ok {
+		return BarSpec{}, fmt.Errorf("invalid bar spec %q", s)
+	}
+
+	spec := BarSpec{Type: BarType(typ)}
+	if !spec.Type.Valid() {
+		return BarSpec{}, fmt.Errorf("unknown bar type %q", typ)
+	}
+
+	var err error
+	if spec.Threshold, err = strconv.ParseFloat(threshold, 64); err != nil || spec.Threshold <= 0 {
+		return BarSpec{}, fmt.Errorf("invalid threshold of bar spec %q", s)
+	}
+
+	return spec, nil
+}
+
+// BarDiscrepancy reports a closed bar that differs from the exchange kline.
+type BarDiscrepancy struct {
+	Exchange  string    `json:"exchange"`
+	Symbol    string    `json:"symbol"`
+	Timeframe Timeframe `json:"timeframe"`
+	StartTime time.Time `json:"startTime"`
+	// Fields lists the differing fields, "bar" or "kline" when one is missing.
+	Fields []string  `json:"fields"`
+	Bar    *Bar      `json:"bar,omitempty"`
+	Kline  *Bar      `json:"kline,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Instrument is a symbol traded on an exchange.
+type Instrument struct {
+	Exchange string
+	Symbol   string
+}
 
-	Volume    float64   `json:"volume"`
+func (i Instrument) String() string {
+	return i.Exchange + ":" + i.Symbol
+}
+
+// QuoteBar is a bar of the mid price with spread statistics.
+type QuoteBar struct {
+	Exchange string `json:"exchange"`
+	Symbol   string `json:"symbol"`
+
+	// High, Low, Open and Close are of the mid price.
+	High  decimal.Decimal `json:"high"`
+	Low   decimal.Decimal `json:"low"`
+	Open  decimal.Decimal `json:"open"`
+	Close decimal.Decimal `json:"close"`
+
+	SpreadHigh  decimal.Decimal `json:"spreadHigh"`
+	SpreadLow   decimal.Decimal `json:"spreadLow"`
+	SpreadOpen  decimal.Decimal `json:"spreadOpen"`
+	SpreadClose decimal.Decimal `json:"spreadClose"`
+	// TWSpread is the time-weighted average spread over the bar.
+	TWSpread decimal.Decimal `json:"twSpread"`
+
+	Quotes    int       `json:"quotes"`
 	IsClosed  bool      `json:"isClosed"`
 	StartTime time.Time `json:"startTime"`
 }
 
+// MidBar returns the mid price bar, it has no volume.
+func (qb *QuoteBar) MidBar() Bar {
+	return Bar{
+		Exchange:  qb.Exchange,
+		Symbol:    qb.Symbol,
+		High:      qb.High,
+		Low:       qb.Low,
+		Open:      qb.Open,
+		Close:     qb.Close,
+		IsClosed:  qb.IsClosed,
+		StartTime: qb.StartTime,
+	}
+}
+
+// PriceSource selects the price portfolio formulas are evaluated on.
+type PriceSource string
+
+const (
+	// PriceTrade is the last trade price, it is the default.
+	PriceTrade PriceSource = "trade"
+	// PriceMid is the mid of the best bid and ask.
+	PriceMid PriceSource = "mid"
+)
+
+// Or returns ps, or def when ps is empty.
+func (ps PriceSource) Or(def PriceSource) PriceSource {
+	if ps == "" {
+		return def
+	}
+
+	return ps
+}
+
+func (ps PriceSource) Valid() bool {
+	return ps == PriceTrade || ps == PriceMid
+}
+
 type Portfolio struct {
-	ID        string    `json:"id"`
+	ID string `json:"id"`
+	// Symbols are either plain symbols of the default exchange or
+	// "<exchange>:<symbol>" to mix venues.
 	Symbols   []string  `json:"symbols"`
 	Formula   string    `json:"formula"`
 	Timeframe Timeframe `json:"timeframe"`
+	// PriceSource is "trade" (default) or "mid".
+	PriceSource PriceSource `json:"priceSource,omitempty"`
 }
 
 type Timeframe time.Duration
@@ -51,9 +426,21 @@ func (tf *Timeframe) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
+	parsed, err := ParseTimeframe(s)
+	if err != nil {
+		return err
+	}
+
+	*tf = parsed
+
+	return nil
+}
+
+// ParseTimeframe parses strings like "1m", "5m", "1h", "1d", "1w".
+func ParseTimeframe(s string) (Timeframe, error) {
 	s = strings.TrimSpace(s)
 	if s == "" {
-		return fmt.Errorf("empty timeframe string")
+		return 0, fmt.Errorf("empty timeframe string")
 	}
 
 	// Support days ("d") and weeks ("w") which time.ParseDuration doesn't handle.
@@ -61,10 +448,9 @@ func (tf *Timeframe) UnmarshalJSON(data []byte) error {
 		numStr := strings.TrimSuffix(s, "d")
 		num, err := strconv.Atoi(numStr)
 		if err != nil {
-			return fmt.Errorf("invalid day duration %q: %w", s, err)
+			return 0, fmt.Errorf("invalid day duration %q: %w", s, err)
 		}
-		*tf = Timeframe(time.Duration(num) * 24 * time.Hour)
-		return nil
+		return Timeframe(time.Duration(num) * 24 * time.Hour), nil
 	}
 
 	if strings.HasSuffix(s, "w") {
@@ -72,22 +458,23 @@ func (tf *Timeframe) UnmarshalJSON(data []byte) error {
 
 		num, err := strconv.Atoi(numStr)
 		if err != nil {
-			return fmt.Errorf("invalid week duration %q: %w", s, err)
+			return 0, fmt.Errorf("invalid week duration %q: %w", s, err)
 		}
 
-		*tf = Timeframe(time.Duration(num) * 7 * 24 * time.Hour)
-
-		return nil
+		return Timeframe(time.Duration(num) * 7 * 24 * time.Hour), nil
 	}
 
 	d, err := time.ParseDuration(s)
 	if err != nil {
-		return fmt.Errorf("invalid duration %q: %w", s, err)
+		return 0, fmt.Errorf("invalid duration %q: %w", s, err)
 	}
 
-	*tf = Timeframe(d)
+	return Timeframe(d), nil
+}
 
-	return nil
+// MarshalJSON implements the json.Marshaler interface for Timeframe.
+func (tf Timeframe) MarshalJSON() ([]byte, error) {
+	return json.Marshal(tf.String())
 }
 
 func (tf Timeframe) String() string {
@@ -47,3 +47,13 @@ func HandleStopPortfolio(svc *services.ControlService) http.HandlerFunc {
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+func HandleStreamsHealth(svc *services.StreamService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(svc.Health()); err != nil {
+			httpLogger.Error("failed to encode streams health", "err", err)
+		}
+	}
+}
@@ -2,52 +2,397 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sync"
 
+	"github.com/11me/calef/common"
+	"github.com/11me/calef/consumers"
+	"github.com/11me/calef/consumers/exchange"
 	"github.com/11me/calef/consumers/monitors"
 	"github.com/11me/calef/manager"
 	"github.com/11me/calef/models"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
+// PortfoliosBucket is the KV bucket portfolios are shared through by sharded
+// instances.
+const PortfoliosBucket = "calef_portfolios"
+
 type ControlService struct {
+	ctx     context.Context
 	nc      *nats.Conn
 	manager *manager.Manager
+	streams *StreamService
 	log     *slog.Logger
+
+	// shard selects the portfolios monitored here. Sharded instances share
+	// portfolios through the bucket, every instance claims their streams.
+	shard Shard
+	kv    jetstream.KeyValue
+	stop  context.CancelFunc
+	wg    sync.WaitGroup
+
+	mu         sync.Mutex
+	portfolios map[string]*models.Portfolio
+	// futures holds the futures streams acquired for each portfolio.
+	futures map[string]map[models.Instrument][]exchange.Channel
+	// monitored holds the portfolios monitored here.
+	monitored map[string]bool
+
+	// durable binds the monitors of portfolios on the durable timeframes to
+	// durable consumers of their closed bars.
+	durable           *consumers.Durable
+	durableTimeframes map[models.Timeframe]bool
 }
 
-func NewControlService(ctx context.Context, nc *nats.Conn) *ControlService {
+func NewControlService(ctx context.Context, nc *nats.Conn, streams *StreamService) *ControlService {
 	return &ControlService{
-		manager: manager.NewManager(ctx),
-		nc:      nc,
-		log:     slog.With("service", "ControlService"),
+		ctx:        ctx,
+		manager:    manager.NewManager(ctx),
+		nc:         nc,
+		streams:    streams,
+		log:        slog.With("service", "ControlService"),
+		portfolios: make(map[string]*models.Portfolio),
+		futures:    make(map[string]map[models.Instrument][]exchange.Channel),
+		monitored:  make(map[string]bool),
 	}
 }
 
-func (svc *ControlService) SubmitPortfolio(ctx context.Context, portfolio *models.Portfolio) error {
-	svc.log.Info(fmt.Sprintf("Submit portfolio (ID:%s)", portfolio.ID))
+// SetShard monitors only the portfolios sharded to this instance, they are
+// shared with the other instances through the portfolios bucket once spawned.
+// Call Rebalance when the shards change.
+func (svc *ControlService) SetShard(shard Shard) *ControlService { svc.shard = shard; return svc }
 
+// SetDurable consumes the closed bars of portfolios on the timeframes, those
+// kept in a JetStream stream, from durable consumers named after the
+// portfolio.
+func (svc *ControlService) SetDurable(d *consumers.Durable, timeframes ...models.Timeframe) *ControlService {
+	svc.durable = d
+	svc.durableTimeframes = make(map[models.Timeframe]bool, len(timeframes))
+
+	for _, tf := range timeframes {
+		svc.durableTimeframes[tf] = true
+	}
+
+	return svc
+}
+
+// newMonitor creates the monitor of the portfolio.
+func (svc *ControlService) newMonitor(ctx context.Context, portfolio *models.Portfolio) (*monitors.PortfolioMonitor, error) {
 	m, err := monitors.NewPortfolioMonitor(ctx, svc.nc, portfolio)
 	if err != nil {
+		return nil, err
+	}
+
+	if svc.durable != nil && svc.durableTimeframes[portfolio.Timeframe] {
+		m.SetDurable(svc.durable)
+	}
+
+	return m, nil
+}
+
+// Spawn shares the portfolios with the other instances when sharded.
+func (svc *ControlService) Spawn() error {
+	if svc.shard == nil {
+		return nil
+	}
+
+	js, err := jetstream.New(svc.nc)
+	if err != nil {
+		return fmt.Errorf("failed to create jetstream context: %w", err)
+	}
+
+	svc.kv, err = js.CreateOrUpdateKeyValue(svc.ctx, jetstream.KeyValueConfig{Bucket: PortfoliosBucket})
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %s: %w", PortfoliosBucket, err)
+	}
+
+	ctx, stop := context.WithCancel(svc.ctx)
+	svc.stop = stop
+
+	watcher, err := svc.kv.WatchAll(ctx)
+	if err != nil {
+		stop()
+		return fmt.Errorf("failed to watch bucket %s: %w", PortfoliosBucket, err)
+	}
+
+	svc.wg.Add(1)
+	go func() {
+		defer svc.wg.Done()
+		defer watcher.Stop()
+		svc.watch(ctx, watcher)
+	}()
+
+	return nil
+}
+
+// Stop stops sharing portfolios and every monitor of this instance.
+func (svc *ControlService) Stop() error {
+	if svc.stop != nil {
+		svc.stop()
+		svc.wg.Wait()
+	}
+
+	return svc.manager.StopAll()
+}
+
+// watch starts and stops the portfolios of the bucket, the existing ones
+// first.
+func (svc *ControlService) watch(ctx context.Context, watcher jetstream.KeyWatcher) {
+	for {
+		var entry jetstream.KeyValueEntry
+
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-watcher.Updates():
+			if !ok {
+				return
+			}
+
+			entry = e
+		}
+
+		// A nil entry marks the end of the existing portfolios.
+		if entry == nil {
+			continue
+		}
+
+		if entry.Operation() != jetstream.KeyValuePut {
+			if err := svc.stopPortfolio(entry.Key()); err != nil {
+				svc.log.Error("failed to stop portfolio", "id", entry.Key(), "err", err)
+			}
+
+			continue
+		}
+
+		var portfolio models.Portfolio
+		if err := json.Unmarshal(entry.Value(), &portfolio); err != nil {
+			svc.log.Error("failed to parse portfolio", "id", entry.Key(), "err", err)
+			continue
+		}
+
+		if err := svc.submitPortfolio(svc.ctx, &portfolio); err != nil {
+			svc.log.Error("failed to submit portfolio", "id", entry.Key(), "err", err)
+		}
+	}
+}
+
+// SubmitPortfolio starts monitoring the portfolio, sharded instances put it
+// into the bucket for the owner.
+func (svc *ControlService) SubmitPortfolio(ctx context.Context, portfolio *models.Portfolio) error {
+	portfolio.PriceSource = portfolio.PriceSource.Or(models.PriceTrade)
+
+	if svc.kv == nil {
+		return svc.submitPortfolio(ctx, portfolio)
+	}
+
+	// Invalid portfolios are rejected before they are shared.
+	if _, err := svc.newMonitor(ctx, portfolio); err != nil {
 		return fmt.Errorf("failed to create porfolio: %w", err)
 	}
 
-	err = svc.manager.Spawn(portfolio.ID, m)
+	data, err := json.Marshal(portfolio)
 	if err != nil {
-		return fmt.Errorf("failed to spawn monitor: %w", err)
+		return err
+	}
+
+	if _, err := svc.kv.Create(ctx, portfolio.ID, data); err != nil {
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			return fmt.Errorf("portfolio with id %q already exists", portfolio.ID)
+		}
+
+		return fmt.Errorf("failed to share portfolio %q: %w", portfolio.ID, err)
 	}
 
 	return nil
 }
 
+// StopPortfolio stops monitoring the portfolio, sharded instances delete it
+// from the bucket.
 func (svc *ControlService) StopPortfolio(ctx context.Context, id string) error {
+	if svc.kv == nil {
+		return svc.stopPortfolio(id)
+	}
+
+	if err := svc.kv.Delete(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete portfolio %q: %w", id, err)
+	}
+
+	return nil
+}
+
+// owns reports whether the portfolio is monitored by this instance.
+func (svc *ControlService) owns(id string) bool {
+	return svc.shard == nil || svc.shard.Owns(id)
+}
+
+// Rebalance starts the monitors of portfolios sharded here and stops the
+// others, e.g. after a node joined or left the cluster.
+func (svc *ControlService) Rebalance() {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	for id, portfolio := range svc.portfolios {
+		owns := svc.owns(id)
+
+		switch {
+		case owns && !svc.monitored[id]:
+			m, err := svc.newMonitor(svc.ctx, portfolio)
+			if err == nil {
+				err = svc.manager.Spawn(id, m)
+			}
+
+			if err != nil {
+				svc.log.Error("failed to take over portfolio", "id", id, "err", err)
+				continue
+			}
+
+			svc.monitored[id] = true
+			svc.log.Info(fmt.Sprintf("took over portfolio %s", id))
+		case !owns && svc.monitored[id]:
+			if err := svc.manager.Evict(id); err != nil {
+				svc.log.Error("failed to hand over portfolio", "id", id, "err", err)
+			}
+
+			delete(svc.monitored, id)
+			svc.log.Info(fmt.Sprintf("handed over portfolio %s", id))
+		}
+	}
+}
+
+// submitPortfolio claims the streams of the portfolio and monitors it when
+// it is sharded here.
+func (svc *ControlService) submitPortfolio(ctx context.Context, portfolio *models.Portfolio) error {
+	svc.log.Info(fmt.Sprintf("Submit portfolio (ID:%s)", portfolio.ID))
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if _, exists := svc.portfolios[portfolio.ID]; exists {
+		return fmt.Errorf("portfolio with id %q already exists", portfolio.ID)
+	}
+
+	portfolio.PriceSource = portfolio.PriceSource.Or(models.PriceTrade)
+
+	m, err := svc.newMonitor(ctx, portfolio)
+	if err != nil {
+		return fmt.Errorf("failed to create porfolio: %w", err)
+	}
+
+	if err := svc.acquireStreams(portfolio); err != nil {
+		return err
+	}
+
+	futures := m.FuturesStreams()
+	if err := svc.acquireFutures(futures); err != nil {
+		svc.releaseStreams(portfolio)
+		return err
+	}
+
+	if svc.owns(portfolio.ID) {
+		err = svc.manager.Spawn(portfolio.ID, m)
+		if err != nil {
+			svc.releaseStreams(portfolio)
+			svc.releaseFutures(futures)
+			return fmt.Errorf("failed to spawn monitor: %w", err)
+		}
+
+		svc.monitored[portfolio.ID] = true
+	}
+
+	svc.portfolios[portfolio.ID] = portfolio
+	svc.futures[portfolio.ID] = futures
+
+	return nil
+}
+
+// stopPortfolio stops the monitor and releases the streams of the portfolio.
+func (svc *ControlService) stopPortfolio(id string) error {
 	svc.log.Info(fmt.Sprintf("Stop portfolio (ID:%s)", id))
 
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	delete(svc.monitored, id)
+
 	err := svc.manager.Evict(id)
 	if err != nil {
 		return fmt.Errorf("failed to evict portfolio with id %q: %w", id, err)
 	}
 
+	if portfolio, ok := svc.portfolios[id]; ok {
+		delete(svc.portfolios, id)
+
+		err := errors.Join(svc.releaseStreams(portfolio), svc.releaseFutures(svc.futures[id]))
+		delete(svc.futures, id)
+
+		if err != nil {
+			return fmt.Errorf("failed to release streams of portfolio %q: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// acquireStreams requests ticks and bars for every portfolio symbol, already
+// acquired ones are released on failure.
+func (svc *ControlService) acquireStreams(portfolio *models.Portfolio) error {
+	for i, symbol := range portfolio.Symbols {
+		inst := common.ParseInstrument(symbol)
+
+		if err := svc.streams.Acquire(inst, portfolio.Timeframe, portfolio.PriceSource); err != nil {
+			for _, acquired := range portfolio.Symbols[:i] {
+				svc.streams.Release(common.ParseInstrument(acquired), portfolio.Timeframe, portfolio.PriceSource)
+			}
+
+			return fmt.Errorf("failed to acquire streams for %s: %w", inst, err)
+		}
+	}
+
 	return nil
 }
+
+func (svc *ControlService) releaseStreams(portfolio *models.Portfolio) error {
+	var ee error
+	for _, symbol := range portfolio.Symbols {
+		if err := svc.streams.Release(common.ParseInstrument(symbol), portfolio.Timeframe, portfolio.PriceSource); err != nil {
+			ee = errors.Join(ee, err)
+		}
+	}
+
+	return ee
+}
+
+// acquireFutures requests the futures streams referenced by a formula,
+// already acquired ones are released on failure.
+func (svc *ControlService) acquireFutures(futures map[models.Instrument][]exchange.Channel) error {
+	acquired := make(map[models.Instrument][]exchange.Channel, len(futures))
+
+	for inst, channels := range futures {
+		// Streams stay referenced on subscribe errors, so they are released too.
+		acquired[inst] = channels
+
+		if err := svc.streams.AcquireChannels(inst, channels...); err != nil {
+			svc.releaseFutures(acquired)
+			return fmt.Errorf("failed to acquire futures streams for %s: %w", inst, err)
+		}
+	}
+
+	return nil
+}
+
+func (svc *ControlService) releaseFutures(futures map[models.Instrument][]exchange.Channel) error {
+	var ee error
+	for inst, channels := range futures {
+		if err := svc.streams.ReleaseChannels(inst, channels...); err != nil {
+			ee = errors.Join(ee, err)
+		}
+	}
+
+	return ee
+}
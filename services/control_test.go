@@ -0,0 +1,99 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/11me/calef/common"
+	"github.com/11me/calef/consumers/exchange"
+	"github.com/11me/calef/internal/natstest"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+func TestControlSubmitPortfolio(t *testing.T) {
+	ctx := context.Background()
+	nc := natstest.Connect(t)
+
+	// The exchange isn't started, acquired streams are only referenced.
+	adapter := exchange.NewBinanceAdapter(exchange.BinanceUSDM)
+	streams := NewStreamService(ctx, nc, exchange.NewConsumer(ctx, nc, adapter))
+	t.Cleanup(func() { streams.StopAll() })
+
+	svc := NewControlService(ctx, nc, streams)
+	t.Cleanup(func() { svc.Stop() })
+
+	// An empty history replays nothing.
+	history, err := nc.Subscribe(common.HistorySubj(adapter.Name(), "*", models.M1), func(msg *nats.Msg) {
+		msg.Respond([]byte("[]"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { history.Unsubscribe() })
+
+	synthetic := make(chan *nats.Msg, 16)
+	if _, err := nc.ChanSubscribe("synthetic.bars.1m", synthetic); err != nil {
+		t.Fatal(err)
+	}
+
+	portfolio := &models.Portfolio{
+		ID:        "spread",
+		Symbols:   []string{"btcusdt", "ethusdt"},
+		Formula:   "btcusdt - ethusdt",
+		Timeframe: models.M1,
+	}
+
+	if err := svc.SubmitPortfolio(ctx, portfolio); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.SubmitPortfolio(ctx, portfolio); err == nil {
+		t.Error("resubmitted portfolio isn't rejected")
+	}
+
+	start := time.Now().UTC().Truncate(time.Minute)
+	for symbol, close := range map[string]string{"btcusdt": "67000", "ethusdt": "3500"} {
+		price := decimal.RequireFromString(close)
+		bar := models.Bar{
+			Exchange: adapter.Name(), Symbol: symbol,
+			Open: price, High: price, Low: price, Close: price, QuoteVolume: price,
+			StartTime: start, EndTime: start.Add(time.Minute),
+		}
+
+		data, err := json.Marshal(bar)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := nc.Publish(common.BarsSubj(adapter.Name(), symbol, models.M1), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var bar models.Bar
+	select {
+	case msg := <-synthetic:
+		if err := json.Unmarshal(msg.Data, &bar); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no synthetic bar published")
+	}
+
+	// Both symbols are quoted in usdt, their quote volumes add up.
+	if !bar.StartTime.Equal(start) || !bar.Close.Equal(decimal.NewFromInt(63500)) || !bar.QuoteVolume.Equal(decimal.NewFromInt(70500)) || bar.IsClosed {
+		t.Errorf("unexpected synthetic bar %+v", bar)
+	}
+
+	if err := svc.StopPortfolio(ctx, portfolio.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.SubmitPortfolio(ctx, portfolio); err != nil {
+		t.Errorf("stopped portfolio can't be submitted again: %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/11me/calef/consumers"
+	"github.com/11me/calef/consumers/exchange"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+)
+
+// historyFetchTimeout bounds fetching klines of one instrument.
+const historyFetchTimeout = 10 * time.Second
+
+// HistoryService keeps the latest closed bars of acquired instruments. The
+// history is backfilled from exchange klines and appended with closed bars
+// afterwards, it is served on the history subjects.
+type HistoryService struct {
+	ctx       context.Context
+	nc        *nats.Conn
+	log       *slog.Logger
+	consumers map[string]*exchange.Consumer
+	consumer  *consumers.Consumer
+	// limit is the number of bars kept per instrument and timeframe.
+	limit int
+
+	mu   sync.Mutex
+	bars map[string][]models.Bar
+}
+
+func NewHistoryService(ctx context.Context, nc *nats.Conn, limit int, exchangeConsumers ...*exchange.Consumer) *HistoryService {
+	svc := &HistoryService{
+		ctx:       ctx,
+		nc:        nc,
+		log:       slog.With("service", "HistoryService"),
+		consumers: make(map[string]*exchange.Consumer, len(exchangeConsumers)),
+		consumer:  consumers.NewConsumer(ctx, nc),
+		limit:     limit,
+		bars:      make(map[string][]models.Bar),
+	}
+
+	for _, c := range exchangeConsumers {
+		svc.consumers[c.Name()] = c
+	}
+
+	svc.consumer.
+		SetLogger(svc.log).
+		Subscribe("*.closedbars.*.*", consumers.HandlerFunc(svc.handleBar)).
+		Subscribe("*.history.*.*", consumers.HandlerFunc(svc.handleRequest))
+
+	return svc
+}
+
+func (svc *HistoryService) Spawn() error {
+	return svc.consumer.Start()
+}
+
+func (svc *HistoryService) Stop() error {
+	return svc.consumer.Stop()
+}
+
+// Fill replaces the history of the instrument with the exchange klines and
+// returns the open bar, if any, to seed the aggregator with.
+func (svc *HistoryService) Fill(inst models.Instrument, tf models.Timeframe) (*models.Bar, error) {
+	consumer, ok := svc.consumers[inst.Exchange]
+	if !ok {
+		return nil, fmt.Errorf("exchange %q is not streamed", inst.Exchange)
+	}
+
+	ctx, cancel := context.WithTimeout(svc.ctx, historyFetchTimeout)
+	defer cancel()
+
+	// One more for the open kline.
+	klines, err := consumer.Klines(ctx, inst.Symbol, tf, svc.limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch klines of %s: %w", inst, err)
+	}
+
+	var (
+		closed = make([]models.Bar, 0, len(klines))
+		open   *models.Bar
+	)
+
+	for _, k := range klines {
+		if !k.IsClosed {
+			open = &k.Bar
+			continue
+		}
+
+		closed = append(closed, k.Bar)
+	}
+
+	if len(closed) > svc.limit {
+		closed = closed[len(closed)-svc.limit:]
+	}
+
+	svc.mu.Lock()
+	svc.bars[historyKey(inst, tf)] = closed
+	svc.mu.Unlock()
+
+	svc.log.Info(fmt.Sprintf("backfilled %d bars of %s", len(closed), historyKey(inst, tf)))
+
+	return open, nil
+}
+
+// Forget drops the history of a released instrument.
+func (svc *HistoryService) Forget(inst models.Instrument, tf models.Timeframe) {
+	svc.mu.Lock()
+	delete(svc.bars, historyKey(inst, tf))
+	svc.mu.Unlock()
+}
+
+// Bars returns the history of the instrument, oldest first.
+func (svc *HistoryService) Bars(inst models.Instrument, tf models.Timeframe) []models.Bar {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	return append([]models.Bar(nil), svc.bars[historyKey(inst, tf)]...)
+}
+
+// handleBar appends closed bars of instruments with history.
+func (svc *HistoryService) handleBar(msg *nats.Msg) error {
+	inst, tf, err := parseSeriesSubj(msg.Subject)
+	if err != nil {
+		return err
+	}
+
+	var bar models.Bar
+	if err := json.Unmarshal(msg.Data, &bar); err != nil {
+		return fmt.Errorf("failed to unmarshal bar: %w", err)
+	}
+
+	key := historyKey(inst, tf)
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	bars, ok := svc.bars[key]
+	if !ok {
+		return nil
+	}
+
+	if len(bars) > 0 && !bar.StartTime.After(bars[len(bars)-1].StartTime) {
+		// Revisions of closed bars replace them.
+		for i := len(bars) - 1; i >= 0; i-- {
+			if bars[i].StartTime.Equal(bar.StartTime) && bar.Revision > bars[i].Revision {
+				bars[i] = bar
+				break
+			}
+		}
+
+		return nil
+	}
+
+	bars = append(bars, bar)
+	if len(bars) > svc.limit {
+		bars = bars[len(bars)-svc.limit:]
+	}
+
+	svc.bars[key] = bars
+
+	return nil
+}
+
+// handleRequest replies with the history of the requested instrument. Other
+// instruments are left to the instance keeping their history.
+func (svc *HistoryService) handleRequest(msg *nats.Msg) error {
+	inst, tf, err := parseSeriesSubj(msg.Subject)
+	if err != nil {
+		return err
+	}
+
+	svc.mu.Lock()
+	bars, ok := svc.bars[historyKey(inst, tf)]
+	data, err := json.Marshal(bars)
+	svc.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return msg.Respond(data)
+}
+
+func historyKey(inst models.Instrument, tf models.Timeframe) string {
+	return inst.String() + ":" + tf.String()
+}
+
+// parseSeriesSubj parses "<exchange>.<kind>.<timeframe>.<symbol>" subjects.
+func parseSeriesSubj(subj string) (models.Instrument, models.Timeframe, error) {
+	tokens := strings.Split(subj, ".")
+	if len(tokens) != 4 {
+		return models.Instrument{}, 0, fmt.Errorf("unexpected subject %q", subj)
+	}
+
+	tf, err := models.ParseTimeframe(tokens[2])
+	if err != nil {
+		return models.Instrument{}, 0, fmt.Errorf("unexpected subject %q: %w", subj, err)
+	}
+
+	return models.Instrument{Exchange: tokens[0], Symbol: tokens[3]}, tf, nil
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/11me/calef/common"
+	"github.com/11me/calef/consumers/aggregators"
+	"github.com/11me/calef/consumers/exchange"
+	"github.com/11me/calef/internal/natstest"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+	"github.com/shopspring/decimal"
+)
+
+// klinesServer serves the recorded klines with the last one open at now.
+func klinesServer(t *testing.T, queries chan<- string) *httptest.Server {
+	t.Helper()
+
+	data, err := os.ReadFile("testdata/binance_klines.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fapi/v1/klines" {
+			http.NotFound(w, r)
+			return
+		}
+
+		queries <- r.URL.RawQuery
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+
+		var klines [][]any
+		if err := dec.Decode(&klines); err != nil {
+			t.Error(err)
+			return
+		}
+
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		klines = klines[max(len(klines)-limit, 0):]
+
+		// Shift the open and close times so the last kline is open.
+		last, _ := klines[len(klines)-1][0].(json.Number).Int64()
+		shift := time.Now().Truncate(time.Minute).UnixMilli() - last
+
+		for _, k := range klines {
+			for _, i := range []int{0, 6} {
+				ms, _ := k[i].(json.Number).Int64()
+				k[i] = ms + shift
+			}
+		}
+
+		json.NewEncoder(w).Encode(klines)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestHistoryFill(t *testing.T) {
+	ctx := context.Background()
+	nc := natstest.Connect(t)
+	queries := make(chan string, 1)
+
+	adapter := exchange.NewBinanceAdapter(exchange.BinanceUSDM)
+	adapter.RestURL = klinesServer(t, queries).URL
+
+	svc := NewHistoryService(ctx, nc, 3, exchange.NewConsumer(ctx, nc, adapter))
+	if err := svc.Spawn(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { svc.Stop() })
+
+	inst := models.Instrument{Exchange: adapter.Name(), Symbol: "btcusdt"}
+
+	seed, err := svc.Fill(inst, models.M1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One more kline than the history for the open one.
+	if q := <-queries; q != "interval=1m&limit=4&symbol=BTCUSDT" {
+		t.Errorf("unexpected klines query %q", q)
+	}
+
+	if seed == nil || seed.IsClosed || seed.Close.String() != "67012.5" || seed.Trades != 312 {
+		t.Fatalf("unexpected open bar %+v", seed)
+	}
+
+	// Only the instance keeping the history replies.
+	reply, err := nc.Request(common.HistorySubj(inst.Exchange, inst.Symbol, models.M1), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var replied []models.Bar
+	if err := json.Unmarshal(reply.Data, &replied); err != nil || len(replied) != 3 {
+		t.Errorf("unexpected history reply %s: %v", reply.Data, err)
+	}
+
+	if _, err := nc.Request(common.HistorySubj(inst.Exchange, "ethusdt", models.M1), nil, 100*time.Millisecond); err == nil {
+		t.Error("history of another instrument is answered")
+	}
+
+	history := svc.Bars(inst, models.M1)
+	if len(history) != 3 {
+		t.Fatalf("got %d bars, want 3", len(history))
+	}
+
+	for i, want := range []string{"67018.8", "67001.5", "67009.9"} {
+		bar := history[i]
+		if !bar.IsClosed || bar.Close.String() != want || !bar.EndTime.Equal(seed.StartTime.Add(time.Duration(i-2)*time.Minute)) {
+			t.Errorf("bar %d: got %+v, want close %s", i, bar, want)
+		}
+	}
+
+	// The aggregator continues the open bar.
+	agg := aggregators.NewBarAggregator(ctx, nc, inst.Exchange, inst.Symbol, models.M1).
+		SetGrace(time.Minute).
+		SetSeed(seed)
+	if err := agg.Spawn(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agg.Stop() })
+
+	bars := make(chan *nats.Msg, 16)
+	if _, err := nc.ChanSubscribe(common.BarsSubj(inst.Exchange, inst.Symbol, models.M1), bars); err != nil {
+		t.Fatal(err)
+	}
+
+	trade := models.Trade{
+		Exchange: inst.Exchange, Symbol: inst.Symbol, TradeID: "1",
+		Price: decimal.RequireFromString("67030"), Quantity: decimal.RequireFromString("0.5"), Side: models.SideBuy,
+		ExchangeTime: seed.StartTime.Add(30 * time.Second),
+	}
+
+	msg, err := common.NewTradeMsg(common.TicksSubj(inst.Exchange, inst.Symbol), &trade)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nc.PublishMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var current models.Bar
+	select {
+	case msg := <-bars:
+		if err := json.Unmarshal(msg.Data, &current); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no bar published")
+	}
+
+	if !current.StartTime.Equal(seed.StartTime) || current.Open.String() != "67009.9" || current.High.String() != "67030" ||
+		current.Low.String() != "67006.1" || current.Volume.String() != "2.618" || current.Trades != 313 {
+		t.Errorf("bar doesn't continue the seed: %+v", current)
+	}
+
+	// Closed bars are appended to the history.
+	current.IsClosed = true
+
+	data, err := json.Marshal(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nc.Publish(common.ClosedBarsSubj(inst.Exchange, inst.Symbol, models.M1), data); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		history = svc.Bars(inst, models.M1)
+		if last := history[len(history)-1]; last.StartTime.Equal(seed.StartTime) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("closed bar not appended")
+		}
+	}
+
+	if len(history) != 3 || history[0].Close.String() != "67001.5" {
+		t.Errorf("history isn't trimmed to the limit: %+v", history)
+	}
+}
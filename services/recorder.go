@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	c "github.com/11me/calef/common"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// TicksStream is the JetStream stream of ticks of all exchanges.
+	TicksStream = "TICKS"
+	// DefaultDuplicateWindow is how long message ids are tracked by default.
+	DefaultDuplicateWindow = 2 * time.Minute
+)
+
+// BarsStream is the JetStream stream of closed bars of the timeframe.
+func BarsStream(tf models.Timeframe) string {
+	return "BARS_" + tf.String()
+}
+
+// RecorderService persists ticks and closed bars to JetStream. The streams
+// capture the tick and closed bar subjects directly, their message ids drop
+// duplicates, e.g. bars published by several instances.
+type RecorderService struct {
+	ctx context.Context
+	nc  *nats.Conn
+	js  jetstream.JetStream
+	log *slog.Logger
+
+	ticksRetention  time.Duration
+	barsRetention   map[models.Timeframe]time.Duration
+	duplicateWindow time.Duration
+}
+
+func NewRecorderService(ctx context.Context, nc *nats.Conn) (*RecorderService, error) {
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create jetstream context: %w", err)
+	}
+
+	svc := &RecorderService{
+		ctx:             ctx,
+		nc:              nc,
+		js:              js,
+		log:             slog.With("service", "RecorderService"),
+		barsRetention:   make(map[models.Timeframe]time.Duration),
+		duplicateWindow: DefaultDuplicateWindow,
+	}
+
+	return svc, nil
+}
+
+// SetTicksRetention sets how long ticks are kept, zero keeps them forever.
+func (svc *RecorderService) SetTicksRetention(d time.Duration) *RecorderService {
+	svc.ticksRetention = d
+	return svc
+}
+
+// SetBarsRetention sets how long closed bars are kept per timeframe, zero
+// keeps them forever. Bars of other timeframes aren't persisted.
+func (svc *RecorderService) SetBarsRetention(retention map[models.Timeframe]time.Duration) *RecorderService {
+	svc.barsRetention = retention
+	return svc
+}
+
+// SetDuplicateWindow sets how long message ids are tracked to drop duplicates.
+func (svc *RecorderService) SetDuplicateWindow(d time.Duration) *RecorderService {
+	if d > 0 {
+		svc.duplicateWindow = d
+	}
+
+	return svc
+}
+
+// Spawn creates or updates the streams.
+func (svc *RecorderService) Spawn() error {
+	if err := svc.ensureStream(TicksStream, "*.ticks.*", svc.ticksRetention); err != nil {
+		return err
+	}
+
+	for tf, retention := range svc.barsRetention {
+		if err := svc.ensureStream(BarsStream(tf), c.ClosedBarsSubj("*", "*", tf), retention); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (svc *RecorderService) Stop() error {
+	return nil
+}
+
+func (svc *RecorderService) ensureStream(name, subject string, retention time.Duration) error {
+	// The duplicate window can't exceed the retention.
+	duplicates := svc.duplicateWindow
+	if retention > 0 {
+		duplicates = min(duplicates, retention)
+	}
+
+	_, err := svc.js.CreateOrUpdateStream(svc.ctx, jetstream.StreamConfig{
+		Name:       name,
+		Subjects:   []string{subject},
+		MaxAge:     retention,
+		Duplicates: duplicates,
+		Storage:    jetstream.FileStorage,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create stream %s: %w", name, err)
+	}
+
+	svc.log.Info(fmt.Sprintf("stream %s keeps %s for %s", name, subject, retentionString(retention)))
+
+	return nil
+}
+
+func retentionString(d time.Duration) string {
+	if d == 0 {
+		return "ever"
+	}
+
+	return d.String()
+}
@@ -0,0 +1,763 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/11me/calef/consumers/aggregators"
+	"github.com/11me/calef/consumers/exchange"
+	"github.com/11me/calef/manager"
+	"github.com/11me/calef/models"
+	"github.com/nats-io/nats.go"
+)
+
+// Shard selects the keys, e.g. instruments or portfolios, handled by this
+// instance when work is partitioned across instances.
+type Shard interface {
+	Owns(key string) bool
+}
+
+// StreamService hands out tick streams and bar aggregators on demand. Both
+// are reference counted and stopped when nobody needs them anymore.
+type StreamService struct {
+	ctx         context.Context
+	nc          *nats.Conn
+	log         *slog.Logger
+	consumers   map[string]*exchange.Consumer
+	aggregators *manager.Manager
+	barSource   models.BarSource
+	barGrace    time.Duration
+	lateWindow  int
+	history     *HistoryService
+	// base is the timeframe aggregated from trades, its multiples are rolled
+	// up from its bars.
+	base models.Timeframe
+
+	mu   sync.Mutex
+	refs map[string]int
+
+	// shard selects the instruments streamed by this instance, claims of
+	// other instruments are kept until they are sharded here.
+	shard Shard
+	// claimsMu guards the claims map only, each claim has its own lock.
+	claimsMu sync.Mutex
+	claims   map[string]*claim
+}
+
+func NewStreamService(ctx context.Context, nc *nats.Conn, consumers ...*exchange.Consumer) *StreamService {
+	svc := &StreamService{
+		ctx:         ctx,
+		nc:          nc,
+		log:         slog.With("service", "StreamService"),
+		consumers:   make(map[string]*exchange.Consumer, len(consumers)),
+		aggregators: manager.NewManager(ctx),
+		barSource:   models.BarSourceTrades,
+		barGrace:    aggregators.DefaultGrace,
+		lateWindow:  aggregators.DefaultLateWindow,
+		base:        models.M1,
+		refs:        make(map[string]int),
+		claims:      make(map[string]*claim),
+	}
+
+	for _, c := range consumers {
+		svc.consumers[c.Name()] = c
+	}
+
+	return svc
+}
+
+// SetBarSource selects what trade price bars are built from.
+func (svc *StreamService) SetBarSource(bs models.BarSource) *StreamService {
+	if bs.Valid() {
+		svc.barSource = bs
+	}
+
+	return svc
+}
+
+// SetBarGrace sets how long trade-built bars wait for late trades.
+func (svc *StreamService) SetBarGrace(d time.Duration) *StreamService { svc.barGrace = d; return svc }
+
+// SetBarLateWindow sets the number of closed bars amended by late trades.
+func (svc *StreamService) SetBarLateWindow(n int) *StreamService { svc.lateWindow = n; return svc }
+
+// SetBaseTimeframe sets the timeframe trade-built bars are aggregated from
+// ticks at, zero aggregates every timeframe from ticks.
+func (svc *StreamService) SetBaseTimeframe(tf models.Timeframe) *StreamService {
+	svc.base = tf
+	return svc
+}
+
+// SetHistory backfills the history of trade price bars on first acquire.
+func (svc *StreamService) SetHistory(h *HistoryService) *StreamService { svc.history = h; return svc }
+
+// SetShard streams only the instruments sharded to this instance, nil
+// streams all of them. Call Rebalance when the shards change.
+func (svc *StreamService) SetShard(shard Shard) *StreamService { svc.shard = shard; return svc }
+
+// stage is an aggregator of a bar pipeline, trade aggregators continue the
+// seed bar.
+type stage struct {
+	id    string
+	spawn func(seed *models.Bar) manager.Spawnable
+}
+
+// pipeline returns the streams bars of the price source are built from and
+// the aggregators building them.
+func (svc *StreamService) pipeline(inst models.Instrument, tf models.Timeframe, source models.PriceSource) ([]exchange.Stream, []stage) {
+	id := aggregatorID(inst, tf, source)
+
+	if source == models.PriceMid {
+		return exchange.QuoteStreams(inst.Symbol), []stage{{id, func(seed *models.Bar) manager.Spawnable {
+			return aggregators.NewQuoteAggregator(svc.ctx, svc.nc, inst.Exchange, inst.Symbol, tf)
+		}}}
+	}
+
+	trades := stage{id, func(seed *models.Bar) manager.Spawnable {
+		return aggregators.NewBarAggregator(svc.ctx, svc.nc, inst.Exchange, inst.Symbol, tf).
+			SetGrace(svc.barGrace).
+			SetLateWindow(svc.lateWindow).
+			SetSeed(seed)
+	}}
+	tradeStreams := exchange.TradeStreams(inst.Symbol)
+
+	if svc.rollup(tf) {
+		// Ticks are streamed for the base timeframe, the open bar is continued
+		// from its history.
+		trades = stage{id, func(seed *models.Bar) manager.Spawnable {
+			r := aggregators.NewBarRollup(svc.ctx, svc.nc, inst.Exchange, inst.Symbol, tf, svc.base).
+				SetLateWindow(svc.lateWindow)
+			if svc.history != nil {
+				r.SetSeed(svc.history.Bars(inst, svc.base))
+			}
+
+			return r
+		}}
+		tradeStreams = nil
+	}
+
+	switch svc.barSource {
+	case models.BarSourceKlines:
+		return []exchange.Stream{exchange.KlineStream(inst.Symbol, tf)}, []stage{{id, func(seed *models.Bar) manager.Spawnable {
+			return aggregators.NewKlineBarSource(svc.ctx, svc.nc, inst.Exchange, inst.Symbol, tf)
+		}}}
+	case models.BarSourceReconcile:
+		streams := append(tradeStreams, exchange.KlineStream(inst.Symbol, tf))
+
+		return streams, []stage{trades, {id + ":reconcile", func(seed *models.Bar) manager.Spawnable {
+			return aggregators.NewBarReconciler(svc.ctx, svc.nc, inst.Exchange, inst.Symbol, tf)
+		}}}
+	default:
+		return tradeStreams, []stage{trades}
+	}
+}
+
+// rollup reports whether trade price bars of the timeframe are rolled up from
+// base bars.
+func (svc *StreamService) rollup(tf models.Timeframe) bool {
+	return svc.barSource != models.BarSourceKlines && svc.base > 0 && tf > svc.base && tf%svc.base == 0
+}
+
+// Acquire makes sure ticks or quotes of the instrument, depending on the
+// price source, are streamed and aggregated into bars of the timeframe.
+func (svc *StreamService) Acquire(inst models.Instrument, tf models.Timeframe, source models.PriceSource) error {
+	return svc.claim("bars:"+aggregatorID(inst, tf, source), inst,
+		func() error { return svc.acquireBars(inst, tf, source) },
+		func() error { return svc.releaseBars(inst, tf, source) })
+}
+
+// Release drops the reference taken by Acquire.
+func (svc *StreamService) Release(inst models.Instrument, tf models.Timeframe, source models.PriceSource) error {
+	return svc.unclaim("bars:" + aggregatorID(inst, tf, source))
+}
+
+// AcquireInfoBars makes sure ticks of the instrument are streamed and
+// aggregated into information-driven bars of the spec.
+func (svc *StreamService) AcquireInfoBars(inst models.Instrument, spec models.BarSpec) error {
+	return svc.claim("infobars:"+inst.String()+":"+spec.String(), inst,
+		func() error { return svc.acquireInfoBars(inst, spec) },
+		func() error { return svc.releaseInfoBars(inst, spec) })
+}
+
+// ReleaseInfoBars drops the reference taken by AcquireInfoBars.
+func (svc *StreamService) ReleaseInfoBars(inst models.Instrument, spec models.BarSpec) error {
+	return svc.unclaim("infobars:" + inst.String() + ":" + spec.String())
+}
+
+// AcquireHeikinAshi makes sure trade price bars of the timeframe are
+// aggregated and Heikin-Ashi candles derived from them.
+func (svc *StreamService) AcquireHeikinAshi(inst models.Instrument, tf models.Timeframe) error {
+	return svc.claim("heikinashi:"+aggregatorID(inst, tf, models.PriceTrade), inst,
+		func() error { return svc.acquireHeikinAshi(inst, tf) },
+		func() error { return svc.releaseHeikinAshi(inst, tf) })
+}
+
+// ReleaseHeikinAshi drops the reference taken by AcquireHeikinAshi.
+func (svc *StreamService) ReleaseHeikinAshi(inst models.Instrument, tf models.Timeframe) error {
+	return svc.unclaim("heikinashi:" + aggregatorID(inst, tf, models.PriceTrade))
+}
+
+// AcquireDepth makes sure the order book of the instrument is maintained and
+// published.
+func (svc *StreamService) AcquireDepth(inst models.Instrument) error {
+	return svc.claim("depth:"+inst.String(), inst,
+		func() error { return svc.acquireDepth(inst) },
+		func() error { return svc.releaseDepth(inst) })
+}
+
+// ReleaseDepth drops the reference taken by AcquireDepth.
+func (svc *StreamService) ReleaseDepth(inst models.Instrument) error {
+	return svc.unclaim("depth:" + inst.String())
+}
+
+// AcquireChannels makes sure the channels of the instrument are streamed, e.g.
+// futures mark price or open interest.
+func (svc *StreamService) AcquireChannels(inst models.Instrument, channels ...exchange.Channel) error {
+	return svc.claim(channelsKey(inst, channels), inst,
+		func() error { return svc.acquireChannels(inst, channels...) },
+		func() error { return svc.releaseChannels(inst, channels...) })
+}
+
+// ReleaseChannels drops the reference taken by AcquireChannels.
+func (svc *StreamService) ReleaseChannels(inst models.Instrument, channels ...exchange.Channel) error {
+	return svc.unclaim(channelsKey(inst, channels))
+}
+
+// claim is the references of a stream, taken while its instrument is sharded
+// here.
+type claim struct {
+	inst    models.Instrument
+	acquire func() error
+	release func() error
+
+	// mu guards the references, streams are acquired and released under it
+	// only, so claims of other streams don't wait for them.
+	mu      sync.Mutex
+	refs    int
+	active  bool
+	removed bool
+}
+
+// owns reports whether the instrument is streamed by this instance.
+func (svc *StreamService) owns(inst models.Instrument) bool {
+	return svc.shard == nil || svc.shard.Owns(inst.String())
+}
+
+// lockClaim returns the locked claim of the key, a new one without references
+// when there is none.
+func (svc *StreamService) lockClaim(key string, inst models.Instrument, acquire, release func() error) *claim {
+	for {
+		svc.claimsMu.Lock()
+		cl, ok := svc.claims[key]
+		if !ok {
+			cl = &claim{inst: inst, acquire: acquire, release: release}
+			svc.claims[key] = cl
+		}
+		svc.claimsMu.Unlock()
+
+		cl.mu.Lock()
+		if !cl.removed {
+			return cl
+		}
+
+		// The last reference was dropped meanwhile, claim anew.
+		cl.mu.Unlock()
+	}
+}
+
+// removeClaim removes the claim without references from the claims. The
+// caller must hold its mu.
+func (svc *StreamService) removeClaim(key string, cl *claim) {
+	svc.claimsMu.Lock()
+	if svc.claims[key] == cl {
+		delete(svc.claims, key)
+	}
+	svc.claimsMu.Unlock()
+
+	cl.removed = true
+}
+
+// claim references the stream, it is acquired only when the instrument is
+// sharded here.
+func (svc *StreamService) claim(key string, inst models.Instrument, acquire, release func() error) error {
+	cl := svc.lockClaim(key, inst, acquire, release)
+	defer cl.mu.Unlock()
+
+	var err error
+
+	switch {
+	case cl.active:
+		if err = cl.acquire(); err == nil {
+			cl.refs++
+		}
+	case svc.owns(inst):
+		cl.refs++
+		if err = cl.take(); err != nil {
+			cl.refs--
+		}
+	default:
+		cl.refs++
+	}
+
+	if cl.refs == 0 {
+		svc.removeClaim(key, cl)
+	}
+
+	return err
+}
+
+// unclaim drops the reference taken by claim.
+func (svc *StreamService) unclaim(key string) error {
+	svc.claimsMu.Lock()
+	cl, ok := svc.claims[key]
+	svc.claimsMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.removed {
+		return nil
+	}
+
+	cl.refs--
+	if cl.refs == 0 {
+		svc.removeClaim(key, cl)
+	}
+
+	if cl.active {
+		return cl.release()
+	}
+
+	return nil
+}
+
+// take acquires every reference of the claim, none on failure. The caller
+// must hold its mu.
+func (cl *claim) take() error {
+	for i := range cl.refs {
+		if err := cl.acquire(); err != nil {
+			for range i {
+				cl.release()
+			}
+
+			return err
+		}
+	}
+
+	cl.active = true
+
+	return nil
+}
+
+// drop releases every reference of the claim. The caller must hold its mu.
+func (cl *claim) drop() error {
+	var ee error
+	for range cl.refs {
+		ee = errors.Join(ee, cl.release())
+	}
+
+	cl.active = false
+
+	return ee
+}
+
+// Rebalance acquires the claimed streams of instruments sharded here and
+// releases the others, e.g. after a node joined or left the cluster.
+func (svc *StreamService) Rebalance() {
+	svc.claimsMu.Lock()
+	claims := maps.Clone(svc.claims)
+	svc.claimsMu.Unlock()
+
+	for key, cl := range claims {
+		svc.rebalance(key, cl)
+	}
+}
+
+// rebalance takes or drops the claim by the shard.
+func (svc *StreamService) rebalance(key string, cl *claim) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.removed {
+		return
+	}
+
+	owns := svc.owns(cl.inst)
+
+	switch {
+	case owns && !cl.active:
+		if err := cl.take(); err != nil {
+			svc.log.Error("failed to take over stream", "stream", key, "err", err)
+			return
+		}
+
+		svc.log.Info(fmt.Sprintf("took over stream %s", key))
+	case !owns && cl.active:
+		if err := cl.drop(); err != nil {
+			svc.log.Error("failed to hand over stream", "stream", key, "err", err)
+			return
+		}
+
+		svc.log.Info(fmt.Sprintf("handed over stream %s", key))
+	}
+}
+
+// acquireBars makes sure ticks or quotes of the instrument, depending on the
+// price source, are streamed and aggregated into bars of the timeframe.
+func (svc *StreamService) acquireBars(inst models.Instrument, tf models.Timeframe, source models.PriceSource) error {
+	consumer, ok := svc.consumers[inst.Exchange]
+	if !ok {
+		return fmt.Errorf("exchange %q is not streamed", inst.Exchange)
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	return svc.acquire(consumer, inst, tf, source)
+}
+
+// acquire takes a reference of the bars, rolled up bars reference their base
+// bars first. The caller must hold mu.
+func (svc *StreamService) acquire(consumer *exchange.Consumer, inst models.Instrument, tf models.Timeframe, source models.PriceSource) error {
+	id := aggregatorID(inst, tf, source)
+	streams, stages := svc.pipeline(inst, tf, source)
+	rollup := source == models.PriceTrade && svc.rollup(tf)
+
+	if rollup {
+		if err := svc.acquire(consumer, inst, svc.base, source); err != nil {
+			return err
+		}
+	}
+
+	if svc.refs[id] == 0 {
+		seed := svc.backfill(inst, tf, source)
+
+		for i, st := range stages {
+			if err := svc.aggregators.Spawn(st.id, st.spawn(seed)); err != nil {
+				for _, spawned := range stages[:i] {
+					svc.aggregators.Evict(spawned.id)
+				}
+
+				if rollup {
+					svc.release(consumer, inst, svc.base, source)
+				}
+
+				return fmt.Errorf("failed to spawn aggregator %s: %w", st.id, err)
+			}
+
+			svc.log.Info(fmt.Sprintf("spawned aggregator %s", st.id))
+		}
+	}
+
+	svc.refs[id]++
+
+	if err := consumer.Acquire(streams...); err != nil {
+		// The symbol remains referenced and is subscribed on reconnect.
+		svc.log.Error("failed to subscribe", "instrument", inst.String(), "source", source, "err", err)
+	}
+
+	return nil
+}
+
+// releaseBars drops the reference taken by acquireBars.
+func (svc *StreamService) releaseBars(inst models.Instrument, tf models.Timeframe, source models.PriceSource) error {
+	consumer, ok := svc.consumers[inst.Exchange]
+	if !ok {
+		return fmt.Errorf("exchange %q is not streamed", inst.Exchange)
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	return svc.release(consumer, inst, tf, source)
+}
+
+// release drops the reference taken by acquire. The caller must hold mu.
+func (svc *StreamService) release(consumer *exchange.Consumer, inst models.Instrument, tf models.Timeframe, source models.PriceSource) error {
+	id := aggregatorID(inst, tf, source)
+	streams, stages := svc.pipeline(inst, tf, source)
+
+	if svc.refs[id] == 0 {
+		return nil
+	}
+
+	var ee error
+
+	if err := consumer.Release(streams...); err != nil {
+		ee = errors.Join(ee, fmt.Errorf("failed to unsubscribe from %s of %s: %w", source, inst, err))
+	}
+
+	svc.refs[id]--
+	if svc.refs[id] == 0 {
+		delete(svc.refs, id)
+
+		if svc.history != nil && source == models.PriceTrade {
+			svc.history.Forget(inst, tf)
+		}
+
+		for _, st := range stages {
+			if err := svc.aggregators.Evict(st.id); err != nil {
+				ee = errors.Join(ee, fmt.Errorf("failed to stop aggregator %s: %w", st.id, err))
+			}
+
+			svc.log.Info(fmt.Sprintf("stopped aggregator %s", st.id))
+		}
+	}
+
+	if source == models.PriceTrade && svc.rollup(tf) {
+		ee = errors.Join(ee, svc.release(consumer, inst, svc.base, source))
+	}
+
+	return ee
+}
+
+// backfill fills the history of trade price bars and returns the open bar,
+// history is optional so failures are only logged.
+func (svc *StreamService) backfill(inst models.Instrument, tf models.Timeframe, source models.PriceSource) *models.Bar {
+	if svc.history == nil || source != models.PriceTrade {
+		return nil
+	}
+
+	seed, err := svc.history.Fill(inst, tf)
+	if err != nil {
+		svc.log.Warn("failed to backfill bars", "instrument", inst.String(), "timeframe", tf.String(), "err", err)
+		return nil
+	}
+
+	return seed
+}
+
+// acquireInfoBars makes sure ticks of the instrument are streamed and
+// aggregated into information-driven bars of the spec.
+func (svc *StreamService) acquireInfoBars(inst models.Instrument, spec models.BarSpec) error {
+	consumer, ok := svc.consumers[inst.Exchange]
+	if !ok {
+		return fmt.Errorf("exchange %q is not streamed", inst.Exchange)
+	}
+
+	id := inst.String() + ":" + spec.String()
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if svc.refs[id] == 0 {
+		var agg manager.Spawnable = aggregators.NewInfoBarAggregator(svc.ctx, svc.nc, inst.Exchange, inst.Symbol, spec)
+		if spec.Type == models.BarRenko {
+			agg = aggregators.NewRenkoAggregator(svc.ctx, svc.nc, inst.Exchange, inst.Symbol, spec)
+		}
+
+		if err := svc.aggregators.Spawn(id, agg); err != nil {
+			return fmt.Errorf("failed to spawn aggregator %s: %w", id, err)
+		}
+
+		svc.log.Info(fmt.Sprintf("spawned aggregator %s", id))
+	}
+
+	svc.refs[id]++
+
+	if err := consumer.Acquire(exchange.TradeStreams(inst.Symbol)...); err != nil {
+		// The symbol remains referenced and is subscribed on reconnect.
+		svc.log.Error("failed to subscribe", "instrument", inst.String(), "bars", spec.String(), "err", err)
+	}
+
+	return nil
+}
+
+// releaseInfoBars drops the reference taken by acquireInfoBars.
+func (svc *StreamService) releaseInfoBars(inst models.Instrument, spec models.BarSpec) error {
+	consumer, ok := svc.consumers[inst.Exchange]
+	if !ok {
+		return fmt.Errorf("exchange %q is not streamed", inst.Exchange)
+	}
+
+	id := inst.String() + ":" + spec.String()
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if svc.refs[id] == 0 {
+		return nil
+	}
+
+	var ee error
+
+	if err := consumer.Release(exchange.TradeStreams(inst.Symbol)...); err != nil {
+		ee = errors.Join(ee, fmt.Errorf("failed to unsubscribe from trades of %s: %w", inst, err))
+	}
+
+	svc.refs[id]--
+	if svc.refs[id] == 0 {
+		delete(svc.refs, id)
+
+		if err := svc.aggregators.Evict(id); err != nil {
+			ee = errors.Join(ee, fmt.Errorf("failed to stop aggregator %s: %w", id, err))
+		}
+
+		svc.log.Info(fmt.Sprintf("stopped aggregator %s", id))
+	}
+
+	return ee
+}
+
+// acquireHeikinAshi makes sure trade price bars of the timeframe are
+// aggregated and Heikin-Ashi candles derived from them.
+func (svc *StreamService) acquireHeikinAshi(inst models.Instrument, tf models.Timeframe) error {
+	consumer, ok := svc.consumers[inst.Exchange]
+	if !ok {
+		return fmt.Errorf("exchange %q is not streamed", inst.Exchange)
+	}
+
+	id := aggregatorID(inst, tf, models.PriceTrade) + ":heikinashi"
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if err := svc.acquire(consumer, inst, tf, models.PriceTrade); err != nil {
+		return err
+	}
+
+	if svc.refs[id] == 0 {
+		agg := aggregators.NewHeikinAshiAggregator(svc.ctx, svc.nc, inst.Exchange, inst.Symbol, tf)
+		if err := svc.aggregators.Spawn(id, agg); err != nil {
+			svc.release(consumer, inst, tf, models.PriceTrade)
+			return fmt.Errorf("failed to spawn aggregator %s: %w", id, err)
+		}
+
+		svc.log.Info(fmt.Sprintf("spawned aggregator %s", id))
+	}
+
+	svc.refs[id]++
+
+	return nil
+}
+
+// releaseHeikinAshi drops the reference taken by acquireHeikinAshi.
+func (svc *StreamService) releaseHeikinAshi(inst models.Instrument, tf models.Timeframe) error {
+	consumer, ok := svc.consumers[inst.Exchange]
+	if !ok {
+		return fmt.Errorf("exchange %q is not streamed", inst.Exchange)
+	}
+
+	id := aggregatorID(inst, tf, models.PriceTrade) + ":heikinashi"
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if svc.refs[id] == 0 {
+		return nil
+	}
+
+	var ee error
+
+	svc.refs[id]--
+	if svc.refs[id] == 0 {
+		delete(svc.refs, id)
+
+		if err := svc.aggregators.Evict(id); err != nil {
+			ee = errors.Join(ee, fmt.Errorf("failed to stop aggregator %s: %w", id, err))
+		}
+
+		svc.log.Info(fmt.Sprintf("stopped aggregator %s", id))
+	}
+
+	return errors.Join(ee, svc.release(consumer, inst, tf, models.PriceTrade))
+}
+
+// acquireDepth makes sure the order book of the instrument is maintained and
+// published.
+func (svc *StreamService) acquireDepth(inst models.Instrument) error {
+	consumer, ok := svc.consumers[inst.Exchange]
+	if !ok {
+		return fmt.Errorf("exchange %q is not streamed", inst.Exchange)
+	}
+
+	return consumer.Acquire(exchange.Stream{Channel: exchange.ChannelDepth, Symbol: inst.Symbol})
+}
+
+// releaseDepth drops the reference taken by acquireDepth.
+func (svc *StreamService) releaseDepth(inst models.Instrument) error {
+	consumer, ok := svc.consumers[inst.Exchange]
+	if !ok {
+		return fmt.Errorf("exchange %q is not streamed", inst.Exchange)
+	}
+
+	return consumer.Release(exchange.Stream{Channel: exchange.ChannelDepth, Symbol: inst.Symbol})
+}
+
+// acquireChannels makes sure the channels of the instrument are streamed, e.g.
+// futures mark price or open interest.
+func (svc *StreamService) acquireChannels(inst models.Instrument, channels ...exchange.Channel) error {
+	consumer, ok := svc.consumers[inst.Exchange]
+	if !ok {
+		return fmt.Errorf("exchange %q is not streamed", inst.Exchange)
+	}
+
+	return consumer.Acquire(channelStreams(inst, channels)...)
+}
+
+// releaseChannels drops the reference taken by acquireChannels.
+func (svc *StreamService) releaseChannels(inst models.Instrument, channels ...exchange.Channel) error {
+	consumer, ok := svc.consumers[inst.Exchange]
+	if !ok {
+		return fmt.Errorf("exchange %q is not streamed", inst.Exchange)
+	}
+
+	return consumer.Release(channelStreams(inst, channels)...)
+}
+
+// Health returns the connection pool state of every exchange.
+func (svc *StreamService) Health() map[string][]exchange.ShardHealth {
+	health := make(map[string][]exchange.ShardHealth, len(svc.consumers))
+	for name, c := range svc.consumers {
+		health[name] = c.Health()
+	}
+
+	return health
+}
+
+func (svc *StreamService) StopAll() error {
+	svc.claimsMu.Lock()
+	svc.claims = make(map[string]*claim)
+	svc.claimsMu.Unlock()
+
+	svc.mu.Lock()
+	svc.refs = make(map[string]int)
+	svc.mu.Unlock()
+
+	return svc.aggregators.StopAll()
+}
+
+func aggregatorID(inst models.Instrument, tf models.Timeframe, source models.PriceSource) string {
+	if source == models.PriceMid {
+		return inst.String() + ":" + tf.String() + ":" + string(source)
+	}
+
+	return inst.String() + ":" + tf.String()
+}
+
+func channelsKey(inst models.Instrument, channels []exchange.Channel) string {
+	key := "channels:" + inst.String()
+	for _, ch := range channels {
+		key += ":" + string(ch)
+	}
+
+	return key
+}
+
+func channelStreams(inst models.Instrument, channels []exchange.Channel) []exchange.Stream {
+	streams := make([]exchange.Stream, 0, len(channels))
+	for _, ch := range channels {
+		streams = append(streams, exchange.Stream{Channel: ch, Symbol: inst.Symbol})
+	}
+
+	return streams
+}